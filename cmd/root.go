@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/cobra"
 
 	"github.com/spf13/viper"
@@ -57,7 +58,12 @@ func initConfig() {
 	}
 
 	// Unmashal config
-	if err := viper.Unmarshal(&config.C); err != nil {
+	hook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		config.StringToReverseProxyHook,
+	))
+	if err := viper.Unmarshal(&config.C, hook); err != nil {
 		fmt.Printf("Unmarshal config: %s Config file: %s\n", err, viper.ConfigFileUsed())
 		os.Exit(1)
 	}
@@ -75,7 +81,10 @@ func initFlags() {
 	viper.SetDefault("mode", "server")
 	viper.SetDefault("addr", "0.0.0.0:443")
 	viper.SetDefault("httpRedirect", false)
+	viper.SetDefault("httpAddr", ":80")
 	viper.SetDefault("conf", "/etc/akari/conf")
+	viper.SetDefault("watchConf", false)
+	viper.SetDefault("traffic.interval", 60)
 	// TLS Config
 	viper.SetDefault("tls.fs", false)
 }
@@ -83,4 +92,5 @@ func initFlags() {
 func initCmds() {
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(usageCmd)
 }
@@ -15,6 +15,7 @@ const configTemplate = `{
 	"Mode": "{{.Mode}}",
 	"Addr": "{{.Addr}}",
 	"Conf": "{{.Conf}}",
+	"WatchConf": {{.WatchConf}},
 	"HTTPRedirect": {{.HTTPRedirect}},
 	"TLS": {
 		"ForwardSecurity": "{{.TLS.ForwardSecurity}}",
@@ -42,6 +42,14 @@ func run(cmd *cobra.Command, args []string) error {
 			log.Fatalf("%s: %s", utils.GetFunctionName(t), err)
 		}
 	}
+	// reload conf on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go reload(ctx, hupChan)
+	// log rule hit counters on SIGUSR1
+	usr1Chan := make(chan os.Signal, 1)
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
+	go logRules(ctx, usr1Chan)
 	// wait for signal
 	sigChan := make(chan os.Signal, 1)
 	exitChan := make(chan struct{})
@@ -117,3 +125,27 @@ func serve(ctx *context) error {
 	}
 	return nil
 }
+
+func reload(ctx *context, hupChan chan os.Signal) {
+	for sig := range hupChan {
+		log.Info("signal:", sig, " signal received, reloading conf")
+		if ctx.Config.Mode == "server" {
+			if err := ctx.Server.Reload(); err != nil {
+				log.Error("ctx.Server.Reload:", err)
+			}
+		} else if ctx.Config.Mode == "agent" {
+			if err := ctx.Agent.Reload(); err != nil {
+				log.Error("ctx.Agent.Reload:", err)
+			}
+		}
+	}
+}
+
+func logRules(ctx *context, usr1Chan chan os.Signal) {
+	for sig := range usr1Chan {
+		log.Info("signal:", sig, " signal received, logging rule hits")
+		if ctx.Config.Mode == "server" {
+			ctx.Server.LogRules()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/traffic"
+)
+
+var usageFile string
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Print traffic usage of users saved by server",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		storage := usageFile
+		if len(storage) == 0 {
+			storage = config.C.Traffic.Storage
+		}
+		if len(storage) == 0 {
+			return errors.New("empty traffic storage")
+		}
+		report, err := traffic.Load(storage)
+		if err != nil {
+			return errors.Wrap(err, "traffic.Load")
+		}
+		printUsage(report)
+		return nil
+	},
+}
+
+func init() {
+	usageCmd.Flags().StringVarP(&usageFile, "file", "f", "", "traffic storage file (default is Traffic.Storage in config file)")
+}
+
+func printUsage(report *traffic.Report) {
+	now := time.Now()
+	routes := make([]string, 0, len(report.Routes))
+	for route := range report.Routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Printf("Updated: %s\n", report.Updated.Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUTE\tUSER\tDAY UP\tDAY DOWN\tMONTH UP\tMONTH DOWN\tTOTAL UP\tTOTAL DOWN")
+	for _, route := range routes {
+		users := report.Routes[route]
+		names := make([]string, 0, len(users))
+		for name := range users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			u := users[name].Current(now)
+			if len(name) == 0 {
+				name = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", route, name,
+				formatBytes(u.DayUpload), formatBytes(u.DayDownload),
+				formatBytes(u.MonthUpload), formatBytes(u.MonthDownload),
+				formatBytes(u.Upload), formatBytes(u.Download))
+		}
+	}
+	w.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
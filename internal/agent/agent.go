@@ -9,7 +9,9 @@ import (
 
 	"github.com/mikumaycry/akari/internal/config"
 	"github.com/mikumaycry/akari/internal/pkg/mux"
+	"github.com/mikumaycry/akari/internal/pkg/socks5"
 	"github.com/mikumaycry/akari/internal/pkg/transport"
+	"github.com/mikumaycry/akari/internal/utils"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
@@ -17,11 +19,20 @@ import (
 var (
 	defaultIdle = 8
 	defaultMux  = 8
+	// drainTimeout bounds the wait of Close for open conns, e.g. long lived ssh tunnels, which are closed after it
+	drainTimeout = 10 * time.Second
 )
 
-// Agent hold a slice of Listener
+// Agent hold Listeners keyed by conf file name
 type Agent struct {
-	lns []*Listener
+	mu        sync.Mutex
+	lns       map[string]*Listener
+	conf      string
+	watchConf bool
+	closeChan chan struct{}
+	// draining counts listeners closed by Close or reload whose conns are still open, they are kept in retired
+	draining sync.WaitGroup
+	retired  map[*Listener]struct{}
 }
 
 // New method
@@ -30,63 +41,164 @@ func New(cfg *config.Config) (*Agent, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "loadAgentConf")
 	}
-	s := &Agent{}
-	for _, v := range confs {
-		ln, err := net.Listen("tcp", v.Local)
+	s := &Agent{
+		lns:       make(map[string]*Listener),
+		retired:   make(map[*Listener]struct{}),
+		conf:      cfg.Conf,
+		watchConf: cfg.WatchConf,
+		closeChan: make(chan struct{}),
+	}
+	for name, v := range confs {
+		listener, err := newListener(v)
 		if err != nil {
-			return nil, errors.Wrapf(err, "net.Listen: %v", v)
-		}
-		dialFn := func() (io.ReadWriteCloser, error) {
-			return tls.Dial("tcp", v.Remote, &tls.Config{
-				ServerName: v.SNI,
-				MinVersion: tls.VersionTLS12,
-			})
-		}
-		listener := &Listener{
-			ln:     ln,
-			cfg:    v,
-			dialFn: dialFn,
-		}
-		if v.Mux {
-			if v.Pool {
-				maxIdle, maxMux := defaultIdle, defaultMux
-				if v.MaxIdle != 0 {
-					maxIdle = v.MaxIdle
-				}
-				if v.MaxMux != 0 {
-					maxMux = v.MaxMux
-				}
-				listener.pool = mux.NewPool(maxIdle, maxMux, dialFn)
-			} else {
-				listener.conn = mux.NewConn(dialFn)
-			}
+			s.Close()
+			return nil, errors.Wrapf(err, "newListener: %s", name)
 		}
-		s.lns = append(s.lns, listener)
+		s.lns[name] = listener
 	}
 	return s, nil
 }
 
 // Serve method
 func (a *Agent) Serve() error {
-	for i := range a.lns {
-		go func(i int) {
-			a.lns[i].serve()
-		}(i)
+	a.mu.Lock()
+	for _, ln := range a.lns {
+		go ln.serve()
+	}
+	a.mu.Unlock()
+	if a.watchConf {
+		err := utils.WatchDir(a.conf, time.Second, a.closeChan, func() {
+			if err := a.Reload(); err != nil {
+				log.Errorf("agent: reload %s: %s", a.conf, err)
+			}
+		})
+		if err != nil {
+			log.Errorf("agent: watch %s: %s", a.conf, err)
+		}
 	}
 	return nil
 }
 
-// Close method
+// Close stops listeners and waits for their conns up to drainTimeout, conns still open after it are closed
 func (a *Agent) Close() error {
-	for i := range a.lns {
-		a.lns[i].close()
+	a.mu.Lock()
+	select {
+	case <-a.closeChan:
+	default:
+		close(a.closeChan)
+	}
+	for name, ln := range a.lns {
+		delete(a.lns, name)
+		a.retire(ln)
+	}
+	a.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		a.draining.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(drainTimeout):
+	}
+	a.mu.Lock()
+	for ln := range a.retired {
+		ln.closeConns()
+	}
+	a.mu.Unlock()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(drainTimeout):
+		return errors.New("drain timeout")
+	}
+}
+
+// retire closes listener socket at once, so its addr can be bound again, and drains its conns in background,
+// a.mu must be held
+func (a *Agent) retire(ln *Listener) {
+	ln.stop()
+	a.retired[ln] = struct{}{}
+	a.draining.Add(1)
+	go func() {
+		defer a.draining.Done()
+		ln.drain()
+		a.mu.Lock()
+		delete(a.retired, ln)
+		a.mu.Unlock()
+	}()
+}
+
+// Reload loads conf dir, opens listeners for new files, drains listeners of removed files
+// and rebuilds backends of changed files, listeners of unchanged or unreadable files are kept
+func (a *Agent) Reload() error {
+	confs, err := loadAgentConf(a.conf)
+	errs, _ := err.(confErrors)
+	if err != nil && errs == nil {
+		return errors.Wrap(err, "loadAgentConf")
+	}
+	for _, v := range errs {
+		log.Errorf("agent: reload conf: %s", v)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// old listeners are closed before new ones bind, e.g. a local addr moved between files
+	moved := make(map[string]bool)
+	for name, ln := range a.lns {
+		v, ok := confs[name]
+		switch {
+		case !ok && errs.has(name):
+			continue
+		case !ok:
+			log.Infof("agent: remove %s, draining %s", name, ln.ln.Addr())
+		case ln.local != v.Local:
+			log.Infof("agent: update %s, moving listener from %s to %s", name, ln.local, v.Local)
+			moved[name] = true
+		default:
+			continue
+		}
+		delete(a.lns, name)
+		a.retire(ln)
 	}
+	for name, v := range confs {
+		ln, ok := a.lns[name]
+		switch {
+		case !ok:
+			if !moved[name] {
+				log.Infof("agent: add %s", name)
+			}
+		case ln.getBackend().cfg == v:
+			continue
+		default:
+			log.Infof("agent: update %s, rebuilding backend", name)
+			b, err := newBackend(v)
+			if err != nil {
+				errs = append(errs, &confError{name: name, err: errors.Wrap(err, "newBackend")})
+				log.Errorf("agent: reload conf: %s: newBackend: %s", name, err)
+				continue
+			}
+			ln.setBackend(b)
+			continue
+		}
+		listener, err := newListener(v)
+		if err != nil {
+			errs = append(errs, &confError{name: name, err: errors.Wrap(err, "newListener")})
+			log.Errorf("agent: reload conf: %s: newListener: %s", name, err)
+			continue
+		}
+		a.lns[name] = listener
+		go listener.serve()
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	log.Infof("agent: reload %s success", a.conf)
 	return nil
 }
 
-// Listener provide tcp, mux-tcp and mux-pool conn
-type Listener struct {
-	ln     net.Listener
+// backend holds dialer and mux conns built from one AgentConf
+type backend struct {
 	cfg    config.AgentConf
 	pool   *mux.Pool
 	conn   *mux.Conn
@@ -94,12 +206,121 @@ type Listener struct {
 	dialFn func() (io.ReadWriteCloser, error)
 }
 
+func newBackend(v config.AgentConf) (*backend, error) {
+	tlsConfig, err := utils.NewTLSConfig("", v.ClientCert, v.ClientKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "utils.NewTLSConfig")
+	}
+	tlsConfig.ServerName = v.SNI
+	tlsConfig.MinVersion = tls.VersionTLS12
+	if len(v.ALPN) != 0 {
+		tlsConfig.NextProtos = []string{v.ALPN}
+	}
+	dialFn := func() (io.ReadWriteCloser, error) {
+		return tls.Dial("tcp", v.Remote, tlsConfig)
+	}
+	b := &backend{
+		cfg:    v,
+		dialFn: dialFn,
+	}
+	if v.Mux {
+		if v.Pool {
+			maxIdle, maxMux := defaultIdle, defaultMux
+			if v.MaxIdle != 0 {
+				maxIdle = v.MaxIdle
+			}
+			if v.MaxMux != 0 {
+				maxMux = v.MaxMux
+			}
+			b.pool = mux.NewPool(maxIdle, maxMux, dialFn)
+		} else {
+			b.conn = mux.NewConn(dialFn)
+		}
+	}
+	return b, nil
+}
+
+// drain waits for conns on backend and closes mux conns
+func (b *backend) drain() {
+	b.wg.Wait()
+	if b.pool != nil {
+		b.pool.Close()
+	}
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+// Listener provide tcp, mux-tcp and mux-pool conn
+type Listener struct {
+	ln      net.Listener
+	local   string
+	mu      sync.Mutex
+	backend *backend
+	closed  bool
+	wg      sync.WaitGroup
+	// conns are accepted conns still open, closed by closeConns, later ones are closed at once if forced
+	conns  map[net.Conn]struct{}
+	forced bool
+}
+
+func newListener(v config.AgentConf) (*Listener, error) {
+	ln, err := net.Listen("tcp", v.Local)
+	if err != nil {
+		return nil, errors.Wrapf(err, "net.Listen: %v", v)
+	}
+	b, err := newBackend(v)
+	if err != nil {
+		ln.Close()
+		return nil, errors.Wrap(err, "newBackend")
+	}
+	listener := &Listener{
+		ln:      ln,
+		local:   v.Local,
+		backend: b,
+		conns:   make(map[net.Conn]struct{}),
+	}
+	return listener, nil
+}
+
+func (l *Listener) getBackend() *backend {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.backend
+}
+
+// setBackend swaps backend, the old one is closed after its conns finish
+func (l *Listener) setBackend(b *backend) {
+	l.mu.Lock()
+	old := l.backend
+	l.backend = b
+	l.mu.Unlock()
+	go old.drain()
+}
+
+// acquireBackend returns current backend and counts conn on it
+func (l *Listener) acquireBackend() *backend {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.backend.wg.Add(1)
+	return l.backend
+}
+
+func (l *Listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
 func (l *Listener) serve() error {
 	log.Infof("start listening %s", l.ln.Addr())
 	var tempDelay time.Duration
 	for {
 		conn, err := l.ln.Accept()
 		if err != nil {
+			if l.isClosed() {
+				return nil
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -117,22 +338,58 @@ func (l *Listener) serve() error {
 		}
 		tempDelay = 0
 		l.wg.Add(1)
+		l.mu.Lock()
+		if l.forced {
+			conn.Close()
+		}
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
 		go func() {
 			defer l.wg.Done()
 			l.handleConn(conn)
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
 		}()
 	}
 }
 
-func (l *Listener) close() error {
+// stop closes listener socket, accepted conns keep running
+func (l *Listener) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if err := l.ln.Close(); err != nil {
+		log.Errorf("agent: close %s: %s", l.ln.Addr(), err)
+	}
+	log.Infof("stop listening %s", l.ln.Addr())
+}
+
+// closeConns closes accepted conns, their handlers return and close conns to server
+func (l *Listener) closeConns() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.forced = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+}
+
+// drain waits for conns of stopped listener to finish and closes backend
+func (l *Listener) drain() {
 	l.wg.Wait()
-	return l.ln.Close()
+	l.getBackend().drain()
 }
 
 func (l *Listener) handleConn(srcConn net.Conn) {
+	b := l.acquireBackend()
+	defer b.wg.Done()
 	logEntry := log.WithFields(log.Fields{
-		"Mode":   l.cfg.ConnMode(),
-		"SNI":    l.cfg.SNI,
+		"Mode":   b.cfg.ConnMode(),
+		"SNI":    b.cfg.SNI,
 		"Remote": srcConn.RemoteAddr().String(),
 	})
 	defer func() {
@@ -140,43 +397,40 @@ func (l *Listener) handleConn(srcConn net.Conn) {
 		srcConn.Close()
 	}()
 	logEntry.Info("Open Conn")
-	if l.cfg.Mux {
-		if l.cfg.Pool {
-			l.handlePoolConn(srcConn, logEntry)
-		} else {
-			l.handleMuxTCPConn(srcConn, logEntry)
-		}
-	} else {
-		l.handleSingleTCPConn(srcConn, logEntry)
-	}
-}
-
-func (l *Listener) handleSingleTCPConn(srcConn net.Conn, logEntry *log.Entry) {
-	dstConn, err := l.dialFn()
+	dstConn, err := b.open()
 	if err != nil {
-		logEntry.Errorf("dialFn: %s", err)
+		logEntry.Errorf("open: %s", err)
 		return
 	}
 	defer dstConn.Close()
-	transport.Transport(srcConn, dstConn)
-}
-
-func (l *Listener) handleMuxTCPConn(srcConn net.Conn, logEntry *log.Entry) {
-	stream, err := l.conn.OpenStream()
-	if err != nil {
-		logEntry.Errorf("conn.OpenStream: %s", err)
+	if b.cfg.UDP {
+		if err := socks5.RelayConn(srcConn, dstConn, logEntry); err != nil {
+			logEntry.Errorf("socks5.RelayConn: %s", err)
+		}
 		return
 	}
-	defer stream.Close()
-	transport.Transport(srcConn, stream)
+	transport.Transport(srcConn, dstConn)
 }
 
-func (l *Listener) handlePoolConn(srcConn net.Conn, logEntry *log.Entry) {
-	dstConn, err := l.pool.GetStream()
+// open returns a tls conn or a mux stream to server
+func (b *backend) open() (io.ReadWriteCloser, error) {
+	if !b.cfg.Mux {
+		conn, err := b.dialFn()
+		if err != nil {
+			return nil, errors.Wrap(err, "dialFn")
+		}
+		return conn, nil
+	}
+	if b.cfg.Pool {
+		stream, err := b.pool.GetStream()
+		if err != nil {
+			return nil, errors.Wrap(err, "pool.GetStream")
+		}
+		return stream, nil
+	}
+	stream, err := b.conn.OpenStream()
 	if err != nil {
-		logEntry.Errorf("pool.GetStream: %s", err)
-		return
+		return nil, errors.Wrap(err, "conn.OpenStream")
 	}
-	defer dstConn.Close()
-	transport.Transport(srcConn, dstConn)
+	return stream, nil
 }
@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+)
+
+// pipeListener returns a listener whose backend dials pipes echoing to the server side
+func pipeListener(t *testing.T) *Listener {
+	ln, err := newListener(config.AgentConf{Local: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.backend.dialFn = func() (io.ReadWriteCloser, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			io.Copy(c2, c2)
+			c2.Close()
+		}()
+		return c1, nil
+	}
+	return ln
+}
+
+func TestAgentClose(t *testing.T) {
+	old := drainTimeout
+	drainTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { drainTimeout = old })
+
+	ln := pipeListener(t)
+	a := &Agent{
+		lns:       map[string]*Listener{"a.json": ln},
+		retired:   make(map[*Listener]struct{}),
+		closeChan: make(chan struct{}),
+	}
+	go ln.serve()
+
+	conn, err := net.Dial("tcp", ln.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	start := time.Now()
+	go func() { errc <- a.Close() }()
+
+	// lock is released while conns drain, e.g. a reload does not block
+	time.Sleep(50 * time.Millisecond)
+	if !a.mu.TryLock() {
+		t.Fatal("lock held while draining")
+	}
+	a.mu.Unlock()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked")
+	}
+	if d := time.Since(start); d < drainTimeout {
+		t.Fatalf("Close returned after %s, before drain timeout", d)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("conn not closed: %s", err)
+	}
+	if _, err := net.Dial("tcp", ln.ln.Addr().String()); err == nil {
+		t.Fatal("listener still open")
+	}
+}
+
+func TestAgentCloseIdle(t *testing.T) {
+	ln := pipeListener(t)
+	a := &Agent{
+		lns:       map[string]*Listener{"a.json": ln},
+		retired:   make(map[*Listener]struct{}),
+		closeChan: make(chan struct{}),
+	}
+	go ln.serve()
+	start := time.Now()
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= drainTimeout {
+		t.Fatalf("Close of idle agent took %s", d)
+	}
+	// Close twice does not panic on closed chan
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freeAddr returns a local addr nothing listens on
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func writeConf(t *testing.T, dir, name, data string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func agentConf(sni, local string) string {
+	return `{"sni": "` + sni + `", "remote": "127.0.0.1:1", "local": "` + local + `"}`
+}
+
+func listening(addr string) bool {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestAgentReload(t *testing.T) {
+	dir := t.TempDir()
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	writeConf(t, dir, "a.json", agentConf("a.test", addrs[0]))
+	writeConf(t, dir, "b.json", agentConf("b.test", addrs[1]))
+	a, err := New(&config.Config{Conf: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	a.Serve()
+	lnOf := func(name string) *Listener {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.lns[name]
+	}
+	lnA := lnOf("a.json")
+
+	// changed backend is rebuilt on the same listener
+	writeConf(t, dir, "a.json", agentConf("a2.test", addrs[0]))
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if ln := lnOf("a.json"); ln != lnA || ln.getBackend().cfg.SNI != "a2.test" {
+		t.Errorf("a.json: listener %p sni %s, want listener %p sni a2.test", ln, ln.getBackend().cfg.SNI, lnA)
+	}
+
+	// backend failed to build keeps the running one
+	writeConf(t, dir, "a.json", `{"sni": "a3.test", "remote": "127.0.0.1:1", "local": "`+addrs[0]+`", "clientCert": "missing.pem", "clientKey": "missing.pem"}`)
+	if err := a.Reload(); err == nil {
+		t.Error("Reload() of invalid client cert succeeded")
+	}
+	if ln := lnOf("a.json"); ln != lnA || ln.getBackend().cfg.SNI != "a2.test" {
+		t.Errorf("a.json: backend is not kept after failed rebuild")
+	}
+
+	// unreadable file keeps its listener, other files are still loaded
+	writeConf(t, dir, "a.json", "{")
+	writeConf(t, dir, "c.json", agentConf("c.test", addrs[2]))
+	if err := a.Reload(); err == nil {
+		t.Error("Reload() of unreadable file succeeded")
+	}
+	if lnOf("a.json") != lnA || !listening(addrs[0]) {
+		t.Error("a.json: listener is not kept for unreadable file")
+	}
+	if lnOf("c.json") == nil || !listening(addrs[2]) {
+		t.Error("c.json: listener is not added")
+	}
+
+	// removed file stops listening, and a local addr moves between files
+	writeConf(t, dir, "a.json", agentConf("a.test", addrs[1]))
+	if err := os.Remove(filepath.Join(dir, "b.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if lnOf("b.json") != nil {
+		t.Error("b.json: listener is not removed")
+	}
+	if ln := lnOf("a.json"); ln == lnA || ln.local != addrs[1] || !listening(addrs[1]) {
+		t.Error("a.json: listener is not moved")
+	}
+	if listening(addrs[0]) {
+		t.Error("a.json: old local addr still listening")
+	}
+	if lnOf("c.json") == nil {
+		t.Error("c.json: unchanged listener is removed")
+	}
+}
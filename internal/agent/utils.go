@@ -4,27 +4,72 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 
 	"github.com/mikumaycry/akari/internal/config"
 	"github.com/pkg/errors"
 )
 
-func loadAgentConf(confDir string) ([]config.AgentConf, error) {
-	var m []config.AgentConf
+func loadAgentConf(confDir string) (map[string]config.AgentConf, error) {
+	m := make(map[string]config.AgentConf)
 	fileInfo, err := ioutil.ReadDir(confDir)
 	if err != nil {
 		return nil, errors.Wrap(err, "ioutil.ReadDir")
 	}
+	var errs confErrors
 	for _, file := range fileInfo {
-		data, err := ioutil.ReadFile(filepath.Join(confDir, file.Name()))
+		item, err := loadAgentConfFile(filepath.Join(confDir, file.Name()))
 		if err != nil {
-			return nil, errors.Wrap(err, "ioutil.ReadFile")
+			errs = append(errs, &confError{name: file.Name(), err: err})
+			continue
 		}
-		var item config.AgentConf
-		if err := json.Unmarshal(data, &item); err != nil {
-			return nil, errors.Wrap(err, "json.Unmarshal")
-		}
-		m = append(m, item)
+		m[file.Name()] = item
+	}
+	if len(errs) != 0 {
+		return m, errs
 	}
 	return m, nil
 }
+
+func loadAgentConfFile(name string) (config.AgentConf, error) {
+	var item config.AgentConf
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return item, errors.Wrap(err, "ioutil.ReadFile")
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, errors.Wrap(err, "json.Unmarshal")
+	}
+	return item, nil
+}
+
+// confError is the error of one conf file
+type confError struct {
+	name string
+	err  error
+}
+
+func (e *confError) Error() string {
+	return e.name + ": " + e.err.Error()
+}
+
+// confErrors collects errors of every conf file, confs of other files are still returned
+type confErrors []*confError
+
+func (e confErrors) Error() string {
+	s := make([]string, 0, len(e))
+	for _, v := range e {
+		s = append(s, v.Error())
+	}
+	return strings.Join(s, "; ")
+}
+
+// has reports whether file name failed to load
+func (e confErrors) has(name string) bool {
+	for _, v := range e {
+		if v.name == name {
+			return true
+		}
+	}
+	return false
+}
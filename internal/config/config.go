@@ -1,53 +1,224 @@
 package config
 
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/auth"
+	"github.com/mikumaycry/akari/internal/pkg/balancer"
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/mikumaycry/akari/internal/pkg/resolver"
+	"github.com/mikumaycry/akari/internal/pkg/rules"
+)
+
 var C Config
 
 type Config struct {
-	Version      string
-	LogLevel     int       `mapstructure:"logLevel"`
-	Mode         string    `mapstructure:"mode"`
-	Addr         string    `mapstructure:"addr"`
-	Conf         string    `mapstructure:"conf"`
-	HTTPRedirect bool      `mapstructure:"httpRedirect"`
-	TLS          TLSConfig `mapstructure:"tls"`
+	Version       string
+	LogLevel      int                 `mapstructure:"logLevel"`
+	Mode          string              `mapstructure:"mode"`
+	Addr          string              `mapstructure:"addr"`
+	Conf          string              `mapstructure:"conf"`
+	WatchConf     bool                `mapstructure:"watchConf"`
+	HTTPRedirect  bool                `mapstructure:"httpRedirect"`
+	HTTPAddr      string              `mapstructure:"httpAddr"`
+	TLS           TLSConfig           `mapstructure:"tls"`
+	Fallback      *ServerConf         `mapstructure:"fallback"`
+	ProxyProtocol ProxyProtocolConfig `mapstructure:"proxyProtocol"`
+	Traffic       TrafficConfig       `mapstructure:"traffic"`
+	Outbounds     []outbound.Conf     `mapstructure:"outbounds"`
+	DNS           *resolver.Conf      `mapstructure:"dns"`
+}
+
+type TrafficConfig struct {
+	Storage  string `mapstructure:"storage"`
+	Interval int    `mapstructure:"interval"`
+}
+
+type ProxyProtocolConfig struct {
+	Enable  bool     `mapstructure:"enable"`
+	Trusted []string `mapstructure:"trusted"`
 }
 
 type TLSConfig struct {
 	ForwardSecurity bool          `mapstructure:"fs"`
 	Certs           []TLSCertPair `mapstructure:"certs"`
+	ACME            *ACMEConfig   `mapstructure:"acme"`
 }
 
 type TLSCertPair struct {
+	Name string `mapstructure:"name"`
 	Cert string `mapstructure:"cert"`
 	Key  string `mapstructure:"key"`
 }
 
+type ACMEConfig struct {
+	Directory   string        `mapstructure:"directory"`
+	Email       string        `mapstructure:"email"`
+	Storage     string        `mapstructure:"storage"`
+	CACert      string        `mapstructure:"caCert"`
+	Challenge   string        `mapstructure:"challenge"`
+	RenewBefore int           `mapstructure:"renewBefore"`
+	DNS         ACMEDNSConfig `mapstructure:"dns"`
+	Certs       []ACMECert    `mapstructure:"certs"`
+}
+
+type ACMEDNSConfig struct {
+	Provider string `mapstructure:"provider"`
+	Command  string `mapstructure:"command"`
+	Wait     int    `mapstructure:"wait"`
+}
+
+type ACMECert struct {
+	Name    string   `mapstructure:"name"`
+	Domains []string `mapstructure:"domains"`
+}
+
 type ServerConf struct {
-	SNI                 string            `json:"sni"`
-	Mode                string            `json:"mode"`
-	Addr                string            `json:"addr"`
-	Auth                string            `json:"auth"`
-	Mux                 bool              `json:"mux"`
-	DisableForwardProxy bool              `json:"disableForwardProxy"`
-	ReverseProxy        map[string]string `json:"reverseProxy"`
+	SNI                 string                      `json:"sni"`
+	Mode                string                      `json:"mode"`
+	Addr                string                      `json:"addr"`
+	Backends            []balancer.BackendConf      `json:"backends"`
+	Balance             string                      `json:"balance"`
+	HealthCheck         *balancer.HealthCheckConf   `json:"healthCheck"`
+	Auth                string                      `json:"auth"`
+	Users               []string                    `json:"users"`
+	HTPasswd            string                      `json:"htpasswd"`
+	Cert                string                      `json:"cert"`
+	ClientCA            string                      `json:"clientCA"`
+	Mux                 bool                        `json:"mux"`
+	ProxyProtocol       int                         `json:"proxyProtocol"`
+	EnableBind          bool                        `json:"enableBind"`
+	DisableForwardProxy bool                        `json:"disableForwardProxy"`
+	ReverseProxy        map[string]ReverseProxyConf `json:"reverseProxy"`
+	Outbound            string                      `json:"outbound"`
+	Rules               string                      `json:"rules"`
+	IPPreference        string                      `json:"ipPreference"`
+	ACL                 *acl.Conf                   `json:"acl"`
+	Quota               *QuotaConf                  `json:"quota"`
+	Limit               *LimitConf                  `json:"limit"`
+	UserLimit           *LimitConf                  `json:"userLimit"`
+	UserLimits          map[string]LimitConf        `json:"userLimits"`
+	ALPN                []ALPNConf                  `json:"alpn"`
+	// Credentials is built from Auth, Users and HTPasswd on load, nil means no auth
+	Credentials *auth.Users `json:"-"`
+	// Policy is built from ACL on load, nil means the default policy
+	Policy *acl.Policy `json:"-"`
+	// Dialer is looked up by Outbound on load
+	Dialer outbound.Dialer `json:"-"`
+	// Router is built from Rules on load, nil means every destination uses Dialer
+	Router *rules.Router `json:"-"`
+	// Balancer is built from Backends on load, nil means Addr is the only backend
+	Balancer *balancer.Balancer `json:"-"`
+}
+
+// QuotaConf limits bytes of each user on a route, zero means unlimited
+type QuotaConf struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+// LimitConf limits bandwidth in bytes per second and new conns or streams per second, zero means unlimited
+type LimitConf struct {
+	Upload   int64   `json:"upload"`
+	Download int64   `json:"download"`
+	Conns    float64 `json:"conns"`
+	Streams  float64 `json:"streams"`
+}
+
+// ReverseProxyConf is backend of a path prefix in https mode, a json string is taken as Addr
+type ReverseProxyConf struct {
+	Addr string `json:"addr"`
+	// StripPrefix removes the matched prefix from path sent to backend
+	StripPrefix bool `json:"stripPrefix"`
+	// Host header sent to backend, the client's is kept if empty
+	Host string `json:"host"`
+	// H2C talks h2c with prior knowledge to backend, e.g. gRPC services
+	H2C bool `json:"h2c"`
+}
+
+// UnmarshalJSON accepts an addr string or an object
+func (r *ReverseProxyConf) UnmarshalJSON(data []byte) error {
+	var addr string
+	if err := json.Unmarshal(data, &addr); err == nil {
+		*r = ReverseProxyConf{Addr: addr}
+		return nil
+	}
+	type conf ReverseProxyConf
+	return json.Unmarshal(data, (*conf)(r))
+}
+
+// StringToReverseProxyHook decodes an addr string of reverseProxy in akari config
+func StringToReverseProxyHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() == reflect.String && to == reflect.TypeOf(ReverseProxyConf{}) {
+		return ReverseProxyConf{Addr: data.(string)}, nil
+	}
+	return data, nil
+}
+
+// ALPNConf routes conns negotiated protocol to a sub conf
+type ALPNConf struct {
+	Protocol string `json:"protocol"`
+	ServerConf
+}
+
+// Dial connects to addr of forward proxy requested by user through Policy, Router and Dialer
+func (s *ServerConf) Dial(user, network, addr string) (net.Conn, error) {
+	return s.Router.Dial(s.Policy, s.Dialer, user, network, addr)
+}
+
+// NextProtos returns ALPN protocols in preference order
+func (s *ServerConf) NextProtos() []string {
+	var protos []string
+	for _, v := range s.ALPN {
+		protos = append(protos, v.Protocol)
+	}
+	return protos
+}
+
+// ALPNRoute returns sub conf of negotiated protocol
+func (s *ServerConf) ALPNRoute(proto string) (*ServerConf, bool) {
+	for i := range s.ALPN {
+		if s.ALPN[i].Protocol == proto {
+			return &s.ALPN[i].ServerConf, true
+		}
+	}
+	return nil, false
+}
+
+// LimitOf returns limit of an authenticated user, nil for anonymous or unlimited users
+func (s *ServerConf) LimitOf(user string) *LimitConf {
+	if len(user) == 0 {
+		return nil
+	}
+	if v, ok := s.UserLimits[user]; ok {
+		return &v
+	}
+	return s.UserLimit
 }
 
 func (s *ServerConf) ConnMode() string {
-	if s.Mux {
+	if s.Mux && s.Mode != "passthrough" {
 		return "mux-" + s.Mode
 	}
 	return s.Mode
 }
 
 type AgentConf struct {
-	SNI     string `json:"sni"`
-	Remote  string `json:"remote"`
-	Local   string `json:"local"`
-	Auth    string `json:"auth"`
-	Mux     bool   `json:"mux"`
-	Pool    bool   `json:"pool"`
-	MaxIdle int    `json:"maxIdle"`
-	MaxMux  int    `json:"maxMux"`
+	SNI        string `json:"sni"`
+	Remote     string `json:"remote"`
+	Local      string `json:"local"`
+	Auth       string `json:"auth"`
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+	ALPN       string `json:"alpn"`
+	UDP        bool   `json:"udp"`
+	Mux        bool   `json:"mux"`
+	Pool       bool   `json:"pool"`
+	MaxIdle    int    `json:"maxIdle"`
+	MaxMux     int    `json:"maxMux"`
 }
 
 func (a *AgentConf) ConnMode() string {
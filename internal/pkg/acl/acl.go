@@ -0,0 +1,341 @@
+package acl
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/mikumaycry/akari/internal/pkg/resolver"
+	"github.com/pkg/errors"
+)
+
+// Conf checks destinations of forward proxy, rules are evaluated in order and the first match wins,
+// private networks are denied unless AllowPrivate is set or an allow rule has a cidr containing the ip
+type Conf struct {
+	Default      string     `json:"default"`
+	AllowPrivate bool       `json:"allowPrivate"`
+	Rules        []RuleConf `json:"rules"`
+}
+
+// RuleConf matches when every non empty field matches, domain is a suffix and port is a number or range like 8000-9000
+type RuleConf struct {
+	Action string   `json:"action"`
+	CIDR   []string `json:"cidr"`
+	Domain []string `json:"domain"`
+	Port   []string `json:"port"`
+}
+
+// ErrDenied is returned when a destination is denied by policy
+var ErrDenied = errors.New("destination denied by acl")
+
+// privateCIDRs are denied unless allowed by a cidr rule or AllowPrivate is set
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var resolveTimeout = 10 * time.Second
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// Contains reports whether port is in r
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+type rule struct {
+	allow   bool
+	nets    []*net.IPNet
+	domains []string
+	ports   []PortRange
+}
+
+// match reports whether every criterion of rule matches, empty criteria match anything
+func (r *rule) match(host string, ip net.IP, port int) bool {
+	if len(r.nets) != 0 {
+		ok := false
+		for _, v := range r.nets {
+			if v.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.domains) != 0 {
+		ok := false
+		for _, v := range r.domains {
+			if host == v || strings.HasSuffix(host, "."+v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.ports) != 0 {
+		ok := false
+		for _, v := range r.ports {
+			if v.Contains(port) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy checks destinations of forward proxy after DNS resolution, rules are evaluated in order and the first match wins.
+// Private networks and addresses of this host are only allowed by AllowPrivate or an allow rule with a cidr containing the ip,
+// so allow rules of domains or ports can not reach them, even if DNS of the domain is rebound
+type Policy struct {
+	rules        []rule
+	private      []*net.IPNet
+	allowPrivate bool
+	deny         bool
+	resolver     *resolver.Resolver
+	prefer       resolver.Preference
+}
+
+var defaultPolicy, _ = New(nil, nil, resolver.PreferIPv4)
+
+// New builds policy from cfg, nil cfg gives the default policy, names are looked up by res in prefer order
+func New(cfg *Conf, res *resolver.Resolver, prefer resolver.Preference) (*Policy, error) {
+	p := &Policy{resolver: res, prefer: prefer}
+	if cfg != nil {
+		switch cfg.Default {
+		case "", "allow":
+		case "deny":
+			p.deny = true
+		default:
+			return nil, errors.Errorf("invalid default action: %s", cfg.Default)
+		}
+		p.allowPrivate = cfg.AllowPrivate
+		for i, v := range cfg.Rules {
+			r, err := newRule(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rule %d", i)
+			}
+			p.rules = append(p.rules, r)
+		}
+	}
+	for _, v := range privateCIDRs {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "net.ParseCIDR")
+		}
+		p.private = append(p.private, ipNet)
+	}
+	// deny the server itself, e.g. admin ports on public address
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, v := range addrs {
+			if ipNet, ok := v.(*net.IPNet); ok {
+				bits := 8 * len(ipNet.IP)
+				p.private = append(p.private, &net.IPNet{IP: ipNet.IP, Mask: net.CIDRMask(bits, bits)})
+			}
+		}
+	}
+	return p, nil
+}
+
+func newRule(v RuleConf) (rule, error) {
+	var r rule
+	switch v.Action {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return r, errors.Errorf("invalid action: %s", v.Action)
+	}
+	for _, c := range v.CIDR {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return r, errors.Wrap(err, "net.ParseCIDR")
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+	for _, d := range v.Domain {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if len(d) == 0 {
+			return r, errors.New("empty domain")
+		}
+		r.domains = append(r.domains, d)
+	}
+	for _, p := range v.Port {
+		pr, err := ParsePortRange(p)
+		if err != nil {
+			return r, errors.Wrapf(err, "invalid port: %s", p)
+		}
+		r.ports = append(r.ports, pr)
+	}
+	return r, nil
+}
+
+// ParsePortRange parses a port like 443 or a range like 8000-9000
+func ParsePortRange(s string) (PortRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return PortRange{}, err
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return PortRange{}, err
+		}
+	}
+	if min < 0 || max > 65535 || min > max {
+		return PortRange{}, errors.New("out of range")
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+// Allowed reports whether ip resolved from host is allowed on port, ip is nil if host is resolved by upstream,
+// then cidr rules and private networks do not match
+func (p *Policy) Allowed(host string, ip net.IP, port int) bool {
+	if p == nil {
+		p = defaultPolicy
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	private := p.isPrivate(ip)
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !r.match(host, ip, port) {
+			continue
+		}
+		// a matched cidr contains ip, other allow rules do not open private networks
+		if private && r.allow && len(r.nets) == 0 {
+			continue
+		}
+		return r.allow
+	}
+	return !private && !p.deny
+}
+
+func (p *Policy) isPrivate(ip net.IP) bool {
+	if p.allowPrivate {
+		return false
+	}
+	for _, v := range p.private {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve looks up host of addr and returns allowed ips and port, ErrDenied is returned if none is allowed
+func (p *Policy) Resolve(ctx context.Context, addr string) ([]net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "net.SplitHostPort")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "strconv.Atoi port")
+	}
+	if p == nil {
+		p = defaultPolicy
+	}
+	ips, err := p.resolver.LookupIP(ctx, host, p.prefer)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "resolver.LookupIP")
+	}
+	allowed := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if p.Allowed(host, ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, 0, errors.Wrap(ErrDenied, addr)
+	}
+	return allowed, port, nil
+}
+
+// Dial connects to allowed ips of addr in order with dialer, the checked ip is dialed,
+// so DNS rebinding can not bypass policy. Names are passed to dialer resolving them remotely
+// after host and port are checked, and ips are checked as is
+func (p *Policy) Dial(dialer outbound.Dialer, network, addr string) (net.Conn, error) {
+	if outbound.Remote(dialer) {
+		if err := p.CheckRemote(addr); err != nil {
+			return nil, err
+		}
+		conn, err := dialer.Dial(network, addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "dialer.Dial")
+		}
+		return conn, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, port, err := p.Resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return DialIPs(dialer, network, ips, port)
+}
+
+// CheckRemote checks addr resolved by upstream without DNS lookup, ErrDenied is returned if it is denied
+func (p *Policy) CheckRemote(addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "net.SplitHostPort")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.Wrap(err, "strconv.Atoi port")
+	}
+	if !p.Allowed(host, net.ParseIP(host), port) {
+		return errors.Wrap(ErrDenied, addr)
+	}
+	return nil
+}
+
+// DialIPs connects to ips on port in order with dialer, nil dialer dials directly
+func DialIPs(dialer outbound.Dialer, network string, ips []net.IP, port int) (net.Conn, error) {
+	if dialer == nil {
+		dialer = outbound.Direct
+	}
+	var err error
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errors.Wrap(err, "dialer.Dial")
+}
@@ -0,0 +1,337 @@
+package acl
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/mikumaycry/akari/internal/pkg/resolver"
+	"github.com/pkg/errors"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s    string
+		want PortRange
+		ok   bool
+	}{
+		{"443", PortRange{443, 443}, true},
+		{" 8000 - 9000 ", PortRange{8000, 9000}, true},
+		{"0-65535", PortRange{0, 65535}, true},
+		{"9000-8000", PortRange{}, false},
+		{"65536", PortRange{}, false},
+		{"-1", PortRange{}, false},
+		{"http", PortRange{}, false},
+		{"80-", PortRange{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParsePortRange(%q) = %v, %v, want %v, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Conf
+	}{
+		{"default", Conf{Default: "drop"}},
+		{"action", Conf{Rules: []RuleConf{{Action: "reject"}}}},
+		{"cidr", Conf{Rules: []RuleConf{{Action: "deny", CIDR: []string{"10.0.0.0/33"}}}}},
+		{"domain", Conf{Rules: []RuleConf{{Action: "deny", Domain: []string{" . "}}}}},
+		{"port", Conf{Rules: []RuleConf{{Action: "deny", Port: []string{"1-0"}}}}},
+	}
+	for _, tt := range tests {
+		if _, err := New(&tt.cfg, nil, resolver.PreferIPv4); err == nil {
+			t.Errorf("%s: New should fail", tt.name)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	p, err := New(&Conf{
+		Rules: []RuleConf{
+			{Action: "allow", CIDR: []string{"10.1.0.0/16"}, Port: []string{"443"}},
+			{Action: "allow", Domain: []string{".Internal."}},
+			{Action: "deny", Domain: []string{"blocked.example.com"}},
+			{Action: "deny", CIDR: []string{"192.0.2.1", "2001:db8::/32"}},
+			{Action: "deny", Port: []string{"25", "6000-7000"}},
+		},
+	}, nil, resolver.PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports, err := New(&Conf{
+		Rules: []RuleConf{
+			{Action: "allow", Port: []string{"80", "443"}},
+			{Action: "deny", Domain: []string{"admin.test"}},
+			{Action: "allow", CIDR: []string{"10.9.0.0/16"}},
+		},
+	}, nil, resolver.PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := New(&Conf{
+		Default:      "deny",
+		AllowPrivate: true,
+		Rules:        []RuleConf{{Action: "allow", Domain: []string{"example.com"}, Port: []string{"80", "443"}}},
+	}, nil, resolver.PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		policy *Policy
+		host   string
+		ip     string
+		port   int
+		want   bool
+	}{
+		{"public", p, "www.example.org", "198.51.100.1", 443, true},
+		{"cidr and port", p, "a.example.org", "10.1.2.3", 443, true},
+		{"cidr other port", p, "a.example.org", "10.1.2.3", 80, false},
+		{"domain", p, "db.internal", "198.51.100.1", 5432, true},
+		{"domain is case insensitive with trailing dot", p, "DB.Internal.", "198.51.100.1", 5432, true},
+		{"domain label boundary", p, "dbinternal", "10.2.0.1", 5432, false},
+		{"domain does not open private", p, "db.internal", "10.2.0.1", 5432, false},
+		{"rebound domain does not open loopback", p, "db.internal", "127.0.0.1", 5432, false},
+		{"port", ports, "a.example.org", "198.51.100.1", 80, true},
+		{"port does not open loopback", ports, "a.example.org", "127.0.0.1", 80, false},
+		{"port does not open metadata", ports, "a.example.org", "169.254.169.254", 80, false},
+		{"port does not open ipv6 loopback", ports, "a.example.org", "::1", 443, false},
+		{"deny rule after skipped allow", ports, "admin.test", "10.9.0.1", 443, false},
+		{"cidr after skipped allow opens private", ports, "a.example.org", "10.9.0.1", 443, true},
+		{"private outside allowed cidr", ports, "a.example.org", "10.8.0.1", 443, false},
+		{"domain exact", p, "blocked.example.com", "198.51.100.1", 443, false},
+		{"domain subdomain", p, "a.blocked.example.com", "198.51.100.1", 443, false},
+		{"single ip", p, "a.example.org", "192.0.2.1", 443, false},
+		{"ipv6 cidr", p, "a.example.org", "2001:db8::1", 443, false},
+		{"port", p, "a.example.org", "198.51.100.1", 25, false},
+		{"port range", p, "a.example.org", "198.51.100.1", 6500, false},
+		{"first match wins", p, "db.internal", "192.0.2.1", 25, true},
+		{"loopback", p, "localhost", "127.0.0.1", 80, false},
+		{"metadata", p, "a.example.org", "169.254.169.254", 80, false},
+		{"ipv6 loopback", p, "a.example.org", "::1", 80, false},
+		{"ipv6 unique local", p, "a.example.org", "fd00::1", 80, false},
+		{"name resolved by upstream", p, "a.example.org", "", 443, true},
+		{"name resolved by upstream is checked by port", p, "a.example.org", "", 25, false},
+		{"default deny", deny, "a.example.org", "198.51.100.1", 443, false},
+		{"default deny allowed rule", deny, "www.example.com", "198.51.100.1", 443, true},
+		{"default deny other port", deny, "www.example.com", "198.51.100.1", 22, false},
+		{"allow private", deny, "example.com", "10.0.0.1", 80, true},
+		{"nil policy", nil, "localhost", "127.0.0.1", 80, false},
+		{"nil policy public", nil, "a.example.org", "198.51.100.1", 80, true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Allowed(tt.host, net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("%s: Allowed(%q, %q, %d) = %v, want %v", tt.name, tt.host, tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	res, err := resolver.New(&resolver.Conf{Hosts: []string{
+		"10.0.0.1 mixed.test",
+		"192.0.2.10 mixed.test",
+		"10.0.0.2 private.test",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(nil, res, resolver.PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		ips  []string
+		port int
+		err  error
+	}{
+		{"mixed.test:443", []string{"192.0.2.10"}, 443, nil},
+		{"private.test:443", nil, 0, ErrDenied},
+		{"192.0.2.20:80", []string{"192.0.2.20"}, 80, nil},
+		{"127.0.0.1:80", nil, 0, ErrDenied},
+		{"mixed.test", nil, 0, nil},
+		{"mixed.test:http", nil, 0, nil},
+	}
+	for _, tt := range tests {
+		ips, port, err := p.Resolve(context.Background(), tt.addr)
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual(got, tt.ips) || port != tt.port {
+			t.Errorf("Resolve(%q) = %v, %d, %v, want %v, %d", tt.addr, got, port, err, tt.ips, tt.port)
+		}
+		if tt.ips == nil && err == nil {
+			t.Errorf("Resolve(%q) should fail", tt.addr)
+		}
+		if tt.err != nil && errors.Cause(err) != tt.err {
+			t.Errorf("Resolve(%q) error = %v, want %v", tt.addr, err, tt.err)
+		}
+	}
+}
+
+func TestCheckRemote(t *testing.T) {
+	p, err := New(&Conf{Rules: []RuleConf{{Action: "deny", Domain: []string{"blocked.test"}}}}, nil, resolver.PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"a.test:443", true},
+		{"a.blocked.test:443", false},
+		{"127.0.0.1:443", false},
+		{"[::1]:443", false},
+		{"a.test", false},
+	}
+	for _, tt := range tests {
+		if err := p.CheckRemote(tt.addr); (err == nil) != tt.ok {
+			t.Errorf("CheckRemote(%q) error = %v, want ok %v", tt.addr, err, tt.ok)
+		}
+	}
+}
+
+// recordDialer records dialed addrs and fails for addrs in fail
+type recordDialer struct {
+	fail   map[string]bool
+	dialed []string
+}
+
+func (d *recordDialer) Dial(network, addr string) (net.Conn, error) {
+	d.dialed = append(d.dialed, addr)
+	if d.fail[addr] {
+		return nil, errors.New("refused")
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestDialIPs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+	tests := []struct {
+		name   string
+		fail   []string
+		dialed []string
+		ok     bool
+	}{
+		{"first", nil, []string{"192.0.2.1:443"}, true},
+		{"next on failure", []string{"192.0.2.1:443"}, []string{"192.0.2.1:443", "[2001:db8::1]:443"}, true},
+		{"all failed", []string{"192.0.2.1:443", "[2001:db8::1]:443"}, []string{"192.0.2.1:443", "[2001:db8::1]:443"}, false},
+	}
+	for _, tt := range tests {
+		d := &recordDialer{fail: make(map[string]bool)}
+		for _, v := range tt.fail {
+			d.fail[v] = true
+		}
+		conn, err := DialIPs(d, "tcp", ips, 443)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: DialIPs error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if !reflect.DeepEqual(d.dialed, tt.dialed) {
+			t.Errorf("%s: dialed %v, want %v", tt.name, d.dialed, tt.dialed)
+		}
+	}
+}
+
+// socks5Upstream accepts socks5 connects without auth and sends ATYP and DST.ADDR of each request to dsts
+func socks5Upstream(t *testing.T) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	dsts := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 262)
+			io.ReadFull(conn, b[:3])
+			conn.Write([]byte{0x05, 0x00})
+			io.ReadFull(conn, b[:4])
+			var n int
+			switch b[3] {
+			case 0x01:
+				n = net.IPv4len
+			case 0x03:
+				io.ReadFull(conn, b[:1])
+				n = int(b[0])
+			}
+			io.ReadFull(conn, b[:n+2])
+			if b[3] == 0x01 && n == net.IPv4len {
+				dsts <- net.IP(b[:n]).String()
+			} else {
+				dsts <- string(b[:n])
+			}
+			conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String(), dsts
+}
+
+func TestDialRemote(t *testing.T) {
+	res, err := resolver.New(&resolver.Conf{Hosts: []string{"192.0.2.1 a.test a.blocked.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(&Conf{Rules: []RuleConf{{Action: "deny", Domain: []string{"blocked.test"}}}}, res, resolver.PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, dsts := socks5Upstream(t)
+	dialers, err := outbound.New([]outbound.Conf{
+		{Name: "remote", Type: "socks5", Addr: addr},
+		{Name: "local", Type: "socks5", Addr: addr, LocalDNS: true},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		dialer string
+		addr   string
+		dst    string
+		ok     bool
+	}{
+		// names are sent to upstream unresolved
+		{"remote name", "remote", "a.test:443", "a.test", true},
+		{"remote denied", "remote", "a.blocked.test:443", "", false},
+		{"remote private ip", "remote", "127.0.0.1:443", "", false},
+		// names are resolved on this host and the checked ip is sent
+		{"local name", "local", "a.test:443", "192.0.2.1", true},
+		{"local denied", "local", "a.blocked.test:443", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := p.Dial(dialers[tt.dialer], "tcp", tt.addr)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Dial() error = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				if errors.Cause(err) != ErrDenied {
+					t.Errorf("Dial() error = %v, want ErrDenied", err)
+				}
+				return
+			}
+			conn.Close()
+			if dst := <-dsts; dst != tt.dst {
+				t.Errorf("upstream got %q, want %q", dst, tt.dst)
+			}
+		})
+	}
+}
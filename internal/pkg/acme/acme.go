@@ -0,0 +1,505 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/cert"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	acmeapi "golang.org/x/crypto/acme"
+)
+
+const (
+	challengeHTTP01    = "http-01"
+	challengeTLSALPN01 = "tls-alpn-01"
+	challengeDNS01     = "dns-01"
+)
+
+var (
+	defaultStorage     = "/etc/akari/acme"
+	defaultRenewBefore = 30 // days
+	checkInterval      = 12 * time.Hour
+	// first retries stay under the failed validation limit of Let's Encrypt, 5 per hour
+	minRetryDelay     = 2 * time.Minute
+	maxRetryDelay     = time.Hour
+	obtainTimeout     = 10 * time.Minute
+	httpChallengePath = "/.well-known/acme-challenge/"
+)
+
+// ALPNProto is the ALPN protocol of tls-alpn-01 challenge
+const ALPNProto = acmeapi.ALPNProto
+
+// Manager obtains and renews certs through ACME, certs are stored on disk and set into cert.Store
+type Manager struct {
+	cfg         config.ACMEConfig
+	store       *cert.Store
+	client      *acmeapi.Client
+	dns         DNSProvider
+	renewBefore time.Duration
+	mu          sync.Mutex
+	registered  bool
+	tokens      map[string]string
+	alpnCerts   map[string]*tls.Certificate
+}
+
+// New method
+func New(cfg config.ACMEConfig, store *cert.Store) (*Manager, error) {
+	if len(cfg.Directory) == 0 {
+		cfg.Directory = acmeapi.LetsEncryptURL
+	}
+	if len(cfg.Storage) == 0 {
+		cfg.Storage = defaultStorage
+	}
+	if len(cfg.Challenge) == 0 {
+		cfg.Challenge = challengeHTTP01
+	}
+	if cfg.RenewBefore == 0 {
+		cfg.RenewBefore = defaultRenewBefore
+	}
+	m := &Manager{
+		cfg:         cfg,
+		store:       store,
+		renewBefore: time.Duration(cfg.RenewBefore) * 24 * time.Hour,
+		tokens:      make(map[string]string),
+		alpnCerts:   make(map[string]*tls.Certificate),
+	}
+	switch cfg.Challenge {
+	case challengeHTTP01, challengeTLSALPN01:
+	case challengeDNS01:
+		dns, err := NewDNSProvider(cfg.DNS)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewDNSProvider")
+		}
+		m.dns = dns
+	default:
+		return nil, errors.Errorf("invalid challenge: %s", cfg.Challenge)
+	}
+	if len(cfg.Certs) == 0 {
+		return nil, errors.New("empty ACME certs")
+	}
+	for _, v := range cfg.Certs {
+		if len(v.Name) == 0 || strings.ContainsAny(v.Name, `/\`) || strings.HasPrefix(v.Name, ".") {
+			return nil, errors.Errorf("invalid cert name: %q", v.Name)
+		}
+		if len(v.Domains) == 0 {
+			return nil, errors.Errorf("empty domains: %s", v.Name)
+		}
+		for _, d := range v.Domains {
+			if strings.HasPrefix(d, "*.") && cfg.Challenge != challengeDNS01 {
+				return nil, errors.Errorf("wildcard domain %s requires dns-01 challenge", d)
+			}
+		}
+	}
+	if err := os.MkdirAll(cfg.Storage, 0700); err != nil {
+		return nil, errors.Wrap(err, "os.MkdirAll")
+	}
+	key, err := loadOrCreateKey(filepath.Join(cfg.Storage, "account.key"))
+	if err != nil {
+		return nil, errors.Wrap(err, "loadOrCreateKey")
+	}
+	httpClient, err := newHTTPClient(cfg.CACert)
+	if err != nil {
+		return nil, errors.Wrap(err, "newHTTPClient")
+	}
+	m.client = &acmeapi.Client{
+		Key:          key,
+		DirectoryURL: cfg.Directory,
+		HTTPClient:   httpClient,
+		UserAgent:    "akari",
+	}
+	for _, v := range cfg.Certs {
+		store.Declare(v.Name)
+		kp, err := tls.LoadX509KeyPair(m.certFile(v.Name), m.keyFile(v.Name))
+		if err != nil {
+			if !os.IsNotExist(errors.Cause(err)) {
+				log.Warnf("acme: load %s: %s", v.Name, err)
+			}
+			continue
+		}
+		if err := store.Set(v.Name, kp); err != nil {
+			log.Warnf("acme: set %s: %s", v.Name, err)
+		}
+	}
+	return m, nil
+}
+
+// Run obtains missing certs and renews expiring ones until done is closed,
+// failed certs are retried with exponential backoff before next check
+func (m *Manager) Run(done <-chan struct{}) {
+	failures := make(map[string]int)
+	retryAt := make(map[string]time.Time)
+	for {
+		next := time.Now().Add(checkInterval)
+		for _, v := range m.cfg.Certs {
+			if t, ok := retryAt[v.Name]; ok && time.Now().Before(t) {
+				if t.Before(next) {
+					next = t
+				}
+				continue
+			}
+			if !m.needRenew(v.Name) {
+				delete(failures, v.Name)
+				delete(retryAt, v.Name)
+				continue
+			}
+			logger := log.WithFields(log.Fields{"Cert": v.Name, "Domains": v.Domains})
+			logger.Info("acme: obtaining cert")
+			if err := m.obtain(v); err != nil {
+				failures[v.Name]++
+				delay := retryDelay(failures[v.Name])
+				logger.Errorf("acme: obtain: %s, retry in %s", err, delay)
+				retryAt[v.Name] = time.Now().Add(delay)
+				if retryAt[v.Name].Before(next) {
+					next = retryAt[v.Name]
+				}
+				continue
+			}
+			delete(failures, v.Name)
+			delete(retryAt, v.Name)
+			logger.Info("acme: obtain cert success")
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDelay returns backoff after n consecutive failures
+func retryDelay(n int) time.Duration {
+	d := minRetryDelay
+	for i := 1; i < n && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// HTTPHandler serves http-01 challenge and passes other requests to fallback
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, httpChallengePath) {
+			fallback.ServeHTTP(w, req)
+			return
+		}
+		m.mu.Lock()
+		resp, ok := m.tokens[strings.TrimPrefix(req.URL.Path, httpChallengePath)]
+		m.mu.Unlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(resp))
+	})
+}
+
+// ChallengeCert returns tls-alpn-01 challenge cert when hello is a validation request
+func (m *Manager) ChallengeCert(hello *tls.ClientHelloInfo) (*tls.Certificate, bool) {
+	isChallenge := false
+	for _, v := range hello.SupportedProtos {
+		if v == ALPNProto {
+			isChallenge = true
+		}
+	}
+	if !isChallenge {
+		return nil, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.alpnCerts[strings.ToLower(hello.ServerName)]
+	return c, ok
+}
+
+func (m *Manager) needRenew(name string) bool {
+	c, err := m.store.Get(name, "")
+	if err != nil {
+		return true
+	}
+	return time.Until(c.Leaf.NotAfter) < m.renewBefore
+}
+
+func (m *Manager) obtain(v config.ACMECert) error {
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+	if err := m.register(ctx); err != nil {
+		return errors.Wrap(err, "register")
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acmeapi.DomainIDs(v.Domains...))
+	if err != nil {
+		return errors.Wrap(err, "client.AuthorizeOrder")
+	}
+	// order url is only returned on creation
+	orderURL := order.URI
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u); err != nil {
+			return errors.Wrap(err, "authorize")
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, orderURL)
+	if err != nil {
+		return errors.Wrap(err, "client.WaitOrder")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "ecdsa.GenerateKey")
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: v.Domains}, key)
+	if err != nil {
+		return errors.Wrap(err, "x509.CreateCertificateRequest")
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		if !isEmptyURLError(err) {
+			return errors.Wrap(err, "client.CreateOrderCert")
+		}
+		// CA may process finalization asynchronously without Location header in response,
+		// then client polls an empty url, so poll the order by its own url
+		if der, err = m.fetchOrderCert(ctx, orderURL); err != nil {
+			return errors.Wrap(err, "fetchOrderCert")
+		}
+	}
+	if err := m.save(v.Name, der, key); err != nil {
+		return errors.Wrap(err, "save")
+	}
+	kp := tls.Certificate{Certificate: der, PrivateKey: key}
+	if err := m.store.Set(v.Name, kp); err != nil {
+		return errors.Wrap(err, "store.Set")
+	}
+	return nil
+}
+
+// isEmptyURLError reports whether err is returned by a request to an empty url
+func isEmptyURLError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && len(urlErr.URL) == 0
+}
+
+func (m *Manager) fetchOrderCert(ctx context.Context, u string) ([][]byte, error) {
+	order, err := m.client.WaitOrder(ctx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "client.WaitOrder")
+	}
+	if order.Status != acmeapi.StatusValid {
+		return nil, errors.Errorf("invalid order status: %s", order.Status)
+	}
+	der, err := m.client.FetchCert(ctx, order.CertURL, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "client.FetchCert")
+	}
+	return der, nil
+}
+
+func (m *Manager) register(ctx context.Context) error {
+	if m.registered {
+		return nil
+	}
+	acct := &acmeapi.Account{}
+	if len(m.cfg.Email) != 0 {
+		acct.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	_, err := m.client.Register(ctx, acct, acmeapi.AcceptTOS)
+	if err != nil && err != acmeapi.ErrAccountAlreadyExists {
+		return errors.Wrap(err, "client.Register")
+	}
+	m.registered = true
+	return nil
+}
+
+func (m *Manager) authorize(ctx context.Context, u string) error {
+	z, err := m.client.GetAuthorization(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, "client.GetAuthorization")
+	}
+	if z.Status == acmeapi.StatusValid {
+		return nil
+	}
+	var chal *acmeapi.Challenge
+	for _, v := range z.Challenges {
+		if v.Type == m.cfg.Challenge {
+			chal = v
+			break
+		}
+	}
+	if chal == nil {
+		return errors.Errorf("challenge %s not offered for %s", m.cfg.Challenge, z.Identifier.Value)
+	}
+	cleanup, err := m.prepare(chal, z.Identifier.Value)
+	if err != nil {
+		return errors.Wrap(err, "prepare")
+	}
+	defer cleanup()
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return errors.Wrap(err, "client.Accept")
+	}
+	if _, err := m.client.WaitAuthorization(ctx, z.URI); err != nil {
+		return errors.Wrap(err, "client.WaitAuthorization")
+	}
+	return nil
+}
+
+// prepare provisions challenge response and returns func to remove it
+func (m *Manager) prepare(chal *acmeapi.Challenge, domain string) (func(), error) {
+	switch chal.Type {
+	case challengeHTTP01:
+		resp, err := m.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, errors.Wrap(err, "client.HTTP01ChallengeResponse")
+		}
+		m.mu.Lock()
+		m.tokens[chal.Token] = resp
+		m.mu.Unlock()
+		return func() {
+			m.mu.Lock()
+			delete(m.tokens, chal.Token)
+			m.mu.Unlock()
+		}, nil
+	case challengeTLSALPN01:
+		c, err := m.client.TLSALPN01ChallengeCert(chal.Token, domain)
+		if err != nil {
+			return nil, errors.Wrap(err, "client.TLSALPN01ChallengeCert")
+		}
+		m.mu.Lock()
+		m.alpnCerts[domain] = &c
+		m.mu.Unlock()
+		return func() {
+			m.mu.Lock()
+			delete(m.alpnCerts, domain)
+			m.mu.Unlock()
+		}, nil
+	case challengeDNS01:
+		value, err := m.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, errors.Wrap(err, "client.DNS01ChallengeRecord")
+		}
+		fqdn := "_acme-challenge." + domain + "."
+		if err := m.dns.Present(fqdn, value); err != nil {
+			return nil, errors.Wrap(err, "dns.Present")
+		}
+		time.Sleep(time.Duration(m.cfg.DNS.Wait) * time.Second)
+		return func() {
+			if err := m.dns.CleanUp(fqdn, value); err != nil {
+				log.Errorf("acme: dns.CleanUp: %s", err)
+			}
+		}, nil
+	}
+	return nil, errors.Errorf("invalid challenge: %s", chal.Type)
+}
+
+func (m *Manager) certFile(name string) string {
+	return filepath.Join(m.cfg.Storage, name+".crt")
+}
+
+func (m *Manager) keyFile(name string) string {
+	return filepath.Join(m.cfg.Storage, name+".key")
+}
+
+func (m *Manager) save(name string, der [][]byte, key *ecdsa.PrivateKey) error {
+	var certPEM []byte
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return errors.Wrap(err, "encodeKey")
+	}
+	if err := writeFile(m.keyFile(name), keyPEM, 0600); err != nil {
+		return errors.Wrap(err, "writeFile key")
+	}
+	if err := writeFile(m.certFile(name), certPEM, 0644); err != nil {
+		return errors.Wrap(err, "writeFile cert")
+	}
+	return nil
+}
+
+// writeFile replaces file by rename so readers never see partial content
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return errors.Wrap(err, "ioutil.WriteFile")
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return errors.Wrap(err, "os.Rename")
+	}
+	return nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "x509.MarshalECPrivateKey")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil
+}
+
+func loadOrCreateKey(name string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(name)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.Errorf("invalid pem: %s", name)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "x509.ParseECPrivateKey")
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "ioutil.ReadFile")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "ecdsa.GenerateKey")
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "encodeKey")
+	}
+	if err := writeFile(name, keyPEM, 0600); err != nil {
+		return nil, errors.Wrap(err, "writeFile")
+	}
+	return key, nil
+}
+
+// newHTTPClient trusts caCert besides system roots, e.g. root of a local test server
+func newHTTPClient(caCert string) (*http.Client, error) {
+	if len(caCert) == 0 {
+		return http.DefaultClient, nil
+	}
+	data, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadFile")
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("invalid ca cert: %s", caCert)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,121 @@
+package acme
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/cert"
+	"github.com/pkg/errors"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 2 * time.Minute},
+		{2, 4 * time.Minute},
+		{3, 8 * time.Minute},
+		{5, 32 * time.Minute},
+		{6, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.failures); got != tt.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestIsEmptyURLError(t *testing.T) {
+	_, emptyErr := http.Post("", "text/plain", nil)
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"empty url", emptyErr, true},
+		{"wrapped empty url", errors.Wrap(emptyErr, "client.WaitOrder"), true},
+		{"other url", &net.OpError{Op: "dial", Err: errors.New("refused")}, false},
+		{"plain", errors.New("urn:ietf:params:acme:error:badCSR"), false},
+	}
+	for _, tt := range tests {
+		if got := isEmptyURLError(tt.err); got != tt.want {
+			t.Errorf("%s: isEmptyURLError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestPebble obtains a cert from a local ACME test server, e.g. pebble started with PEBBLE_VA_ALWAYS_VALID=1:
+//
+//	AKARI_ACME_DIRECTORY=https://127.0.0.1:14000/dir AKARI_ACME_CACERT=pebble.minica.pem go test ./internal/pkg/acme
+//
+// AKARI_ACME_HTTP_ADDR serves http-01 challenge if the server validates challenges (pebble httpPort, 5002)
+func TestPebble(t *testing.T) {
+	directory := os.Getenv("AKARI_ACME_DIRECTORY")
+	if len(directory) == 0 {
+		t.Skip("AKARI_ACME_DIRECTORY is not set")
+	}
+	storage, err := ioutil.TempDir("", "akari-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storage)
+	store, err := cert.NewStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.ACMEConfig{
+		Directory: directory,
+		CACert:    os.Getenv("AKARI_ACME_CACERT"),
+		Storage:   storage,
+		Challenge: challengeHTTP01,
+		Certs:     []config.ACMECert{{Name: "test", Domains: []string{"akari.test", "www.akari.test"}}},
+	}
+	m, err := New(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := os.Getenv("AKARI_ACME_HTTP_ADDR"); len(addr) != 0 {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: m.HTTPHandler(http.NotFoundHandler())}
+		go srv.Serve(ln)
+		defer srv.Close()
+	}
+	if !m.needRenew("test") {
+		t.Fatal("missing cert should be obtained")
+	}
+	if err := m.obtain(cfg.Certs[0]); err != nil {
+		t.Fatalf("obtain: %s", err)
+	}
+	c, err := store.Get("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Leaf.VerifyHostname("www.akari.test"); err != nil {
+		t.Error(err)
+	}
+	if m.needRenew("test") {
+		t.Error("obtained cert should not be renewed")
+	}
+	// a new manager loads saved cert and reuses the registered account key
+	store2, err := cert.NewStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := New(cfg, store2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.needRenew("test") {
+		t.Error("saved cert should be loaded")
+	}
+}
@@ -0,0 +1,51 @@
+package acme
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/pkg/errors"
+)
+
+// DNSProvider sets and removes TXT records for dns-01 challenge
+type DNSProvider interface {
+	// Present creates TXT record fqdn with value
+	Present(fqdn, value string) error
+	// CleanUp removes TXT record fqdn with value
+	CleanUp(fqdn, value string) error
+}
+
+// NewDNSProvider method
+func NewDNSProvider(cfg config.ACMEDNSConfig) (DNSProvider, error) {
+	switch cfg.Provider {
+	case "exec":
+		if len(cfg.Command) == 0 {
+			return nil, errors.New("empty exec command")
+		}
+		return &execProvider{command: cfg.Command}, nil
+	default:
+		return nil, errors.Errorf("invalid dns provider: %s", cfg.Provider)
+	}
+}
+
+// execProvider runs `command present|cleanup <fqdn> <value>`
+type execProvider struct {
+	command string
+}
+
+func (p *execProvider) Present(fqdn, value string) error {
+	return p.run("present", fqdn, value)
+}
+
+func (p *execProvider) CleanUp(fqdn, value string) error {
+	return p.run("cleanup", fqdn, value)
+}
+
+func (p *execProvider) run(action, fqdn, value string) error {
+	out, err := exec.Command(p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "exec %s %s: %s", p.command, action, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users verifies username and password of a route, passwords are plain text, bcrypt or argon2 hashes
+type Users struct {
+	users map[string]verifier
+	// dummy is the verifier of a configured user run for unknown users,
+	// a hashed one is preferred, so unknown users take similar time to known ones
+	dummy  verifier
+	hashed bool
+}
+
+type verifier func(password []byte) bool
+
+// New builds Users from user:password entries and a htpasswd file, nil is returned when both are empty
+func New(entries []string, htpasswd string) (*Users, error) {
+	if len(entries) == 0 && len(htpasswd) == 0 {
+		return nil, nil
+	}
+	u := &Users{users: make(map[string]verifier)}
+	for _, v := range entries {
+		if err := u.add(v, true); err != nil {
+			return nil, err
+		}
+	}
+	if len(htpasswd) != 0 {
+		if err := u.load(htpasswd); err != nil {
+			return nil, errors.Wrap(err, "load htpasswd")
+		}
+	}
+	return u, nil
+}
+
+// load reads user:hash lines, empty lines and lines start with # are skipped
+func (u *Users) load(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "os.Open")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := u.add(line, false); err != nil {
+			return errors.Wrapf(err, "line %d", n)
+		}
+	}
+	return scanner.Err()
+}
+
+func (u *Users) add(entry string, allowPlain bool) error {
+	idx := strings.IndexByte(entry, ':')
+	if idx <= 0 {
+		return errors.New("invalid user entry, user:password format is required")
+	}
+	user, password := entry[:idx], entry[idx+1:]
+	if _, ok := u.users[user]; ok {
+		return errors.Errorf("duplicate user: %s", user)
+	}
+	var fn verifier
+	hashed := true
+	switch {
+	case strings.HasPrefix(password, "$2a$"), strings.HasPrefix(password, "$2b$"), strings.HasPrefix(password, "$2y$"):
+		hash := []byte(password)
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return errors.Wrapf(err, "user %s: bcrypt.Cost", user)
+		}
+		fn = func(p []byte) bool {
+			return bcrypt.CompareHashAndPassword(hash, p) == nil
+		}
+	case strings.HasPrefix(password, "$argon2"):
+		h, err := parseArgon2(password)
+		if err != nil {
+			return errors.Wrapf(err, "user %s: parseArgon2", user)
+		}
+		fn = h.verify
+	case allowPlain:
+		hashed = false
+		plain := []byte(password)
+		fn = func(p []byte) bool {
+			return subtle.ConstantTimeCompare(plain, p) == 1
+		}
+	default:
+		return errors.Errorf("user %s: unsupported hash, bcrypt or argon2 is required", user)
+	}
+	u.users[user] = fn
+	if u.dummy == nil || hashed && !u.hashed {
+		u.dummy, u.hashed = fn, hashed
+	}
+	return nil
+}
+
+// Verify checks password of user in constant time
+func (u *Users) Verify(user, password string) bool {
+	fn, ok := u.users[user]
+	if !ok {
+		// verify anyway and drop the result, so usernames can't be told by timing
+		if u.dummy != nil {
+			u.dummy([]byte(password))
+		}
+		return false
+	}
+	return fn([]byte(password))
+}
+
+// VerifyPair checks user:password string
+func (u *Users) VerifyPair(pair string) (string, bool) {
+	idx := strings.IndexByte(pair, ':')
+	if idx < 0 {
+		return "", false
+	}
+	user := pair[:idx]
+	return user, u.Verify(user, pair[idx+1:])
+}
+
+// maxArgon2Memory is the max memory in KiB of argon2 hashes, 4 GiB
+const maxArgon2Memory = 4 * 1024 * 1024
+
+// argon2Hash is a PHC string: $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+type argon2Hash struct {
+	id      bool
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+func parseArgon2(s string) (*argon2Hash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid argon2 hash")
+	}
+	h := &argon2Hash{}
+	switch parts[1] {
+	case "argon2id":
+		h.id = true
+	case "argon2i":
+	default:
+		return nil, errors.Errorf("unsupported variant: %s", parts[1])
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, errors.Wrap(err, "parse version")
+	}
+	if version != argon2.Version {
+		return nil, errors.Errorf("unsupported version: %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, errors.Wrap(err, "parse params")
+	}
+	// argon2 panics on zero time or threads
+	if h.time < 1 || h.threads < 1 {
+		return nil, errors.Errorf("invalid params: t=%d, p=%d", h.time, h.threads)
+	}
+	if h.memory < 8*uint32(h.threads) || h.memory > maxArgon2Memory {
+		return nil, errors.Errorf("invalid memory: m=%d", h.memory)
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.Wrap(err, "decode salt")
+	}
+	if h.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, errors.Wrap(err, "decode hash")
+	}
+	if len(h.hash) == 0 {
+		return nil, errors.New("empty hash")
+	}
+	return h, nil
+}
+
+func (h *argon2Hash) verify(password []byte) bool {
+	var key []byte
+	if h.id {
+		key = argon2.IDKey(password, h.salt, h.time, h.memory, h.threads, uint32(len(h.hash)))
+	} else {
+		key = argon2.Key(password, h.salt, h.time, h.memory, h.threads, uint32(len(h.hash)))
+	}
+	return subtle.ConstantTimeCompare(key, h.hash) == 1
+}
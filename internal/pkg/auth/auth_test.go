@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func argon2String(id bool, password string, memory, time uint32, threads uint8) string {
+	salt := []byte("0123456789abcdef")
+	variant := "argon2i"
+	key := argon2.Key([]byte(password), salt, time, memory, threads, 32)
+	if id {
+		variant = "argon2id"
+		key = argon2.IDKey([]byte(password), salt, time, memory, threads, 32)
+	}
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", variant, argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func writeHtpasswd(t *testing.T, lines string) string {
+	dir, err := ioutil.TempDir("", "akari-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	name := filepath.Join(dir, "htpasswd")
+	if err := ioutil.WriteFile(name, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestParseArgon2(t *testing.T) {
+	valid := argon2String(true, "pass", 64, 1, 1)
+	tests := []struct {
+		name string
+		hash string
+		ok   bool
+	}{
+		{"argon2id", valid, true},
+		{"argon2i", argon2String(false, "pass", 64, 1, 1), true},
+		{"zero time", "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$aGFzaA", false},
+		{"zero threads", "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$aGFzaA", false},
+		{"small memory", "$argon2id$v=19$m=7,t=1,p=1$c2FsdHNhbHQ$aGFzaA", false},
+		{"huge memory", "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdHNhbHQ$aGFzaA", false},
+		{"bad version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA", false},
+		{"bad variant", "$argon2d$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA", false},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!$aGFzaA", false},
+		{"empty hash", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$", false},
+		{"missing field", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseArgon2(tt.hash)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseArgon2(%q) error = %v, want ok %v", tt.hash, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestUsersVerify(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bpass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := writeHtpasswd(t, fmt.Sprintf("# comment\n\nbob:%s\ncarol:%s\ndave:%s\n",
+		bcryptHash, argon2String(true, "cpass", 64, 1, 1), argon2String(false, "dpass", 64, 1, 1)))
+	users, err := New([]string{"alice:apass"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pair string
+		user string
+		ok   bool
+	}{
+		{"alice:apass", "alice", true},
+		{"alice:wrong", "alice", false},
+		{"bob:bpass", "bob", true},
+		{"bob:apass", "bob", false},
+		{"carol:cpass", "carol", true},
+		{"carol:", "carol", false},
+		{"dave:dpass", "dave", true},
+		{"eve:bpass", "eve", false},
+		{"eve", "", false},
+		{":apass", "", false},
+	}
+	for _, tt := range tests {
+		user, ok := users.VerifyPair(tt.pair)
+		if user != tt.user || ok != tt.ok {
+			t.Errorf("VerifyPair(%q) = %q, %v, want %q, %v", tt.pair, user, ok, tt.user, tt.ok)
+		}
+	}
+	if !users.hashed {
+		t.Error("unknown users should be verified against a hashed user")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []string
+		htpasswd string
+		ok       bool
+	}{
+		{"plain entries", []string{"a:1", "b:2"}, "", true},
+		{"duplicate user", []string{"a:1", "a:2"}, "", false},
+		{"missing colon", []string{"a"}, "", false},
+		{"empty user", []string{":1"}, "", false},
+		{"plain in file", nil, "a:1\n", false},
+		{"zero argon2 time in file", nil, "a:$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$aGFzaA\n", false},
+		{"bad bcrypt in file", nil, "a:$2a$xx\n", false},
+		{"duplicate across file", []string{"a:1"}, "a:" + argon2String(true, "p", 64, 1, 1) + "\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var file string
+			if len(tt.htpasswd) != 0 {
+				file = writeHtpasswd(t, tt.htpasswd)
+			}
+			_, err := New(tt.entries, file)
+			if (err == nil) != tt.ok {
+				t.Fatalf("New error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+	if u, err := New(nil, ""); u != nil || err != nil {
+		t.Fatalf("New(nil, \"\") = %v, %v, want nil, nil", u, err)
+	}
+}
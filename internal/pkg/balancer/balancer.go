@@ -0,0 +1,213 @@
+package balancer
+
+import (
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/pkg/errors"
+)
+
+const (
+	RoundRobin = "roundrobin"
+	LeastConn  = "leastconn"
+	Hash       = "hash"
+
+	// replicas of each weight unit on hash ring
+	replicas = 64
+)
+
+// BackendConf is a dst addr of tcp route
+type BackendConf struct {
+	Addr string `json:"addr"`
+	// Weight defaults to 1
+	Weight int `json:"weight"`
+}
+
+type backend struct {
+	addr   string
+	weight int
+	// current weight of smooth weighted round-robin
+	current int
+	active  int64
+	healthy int32
+}
+
+func (b *backend) isHealthy() bool {
+	return atomic.LoadInt32(&b.healthy) == 1
+}
+
+type point struct {
+	hash    uint32
+	backend *backend
+}
+
+// Balancer picks backends of a tcp route, unhealthy backends are skipped unless all of them are unhealthy
+type Balancer struct {
+	name     string
+	method   string
+	backends []*backend
+	ring     []point
+	mu       sync.Mutex
+	checker  *checker
+}
+
+// New builds balancer of backends by method, name is used in logs, health checks start if hc is not nil
+func New(name string, backends []BackendConf, method string, hc *HealthCheckConf, dialer outbound.Dialer) (*Balancer, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("empty backends")
+	}
+	switch method {
+	case "":
+		method = RoundRobin
+	case RoundRobin, LeastConn, Hash:
+	default:
+		return nil, errors.Errorf("invalid balance: %s", method)
+	}
+	b := &Balancer{name: name, method: method}
+	seen := make(map[string]struct{})
+	for _, v := range backends {
+		if _, _, err := net.SplitHostPort(v.Addr); err != nil {
+			return nil, errors.Wrap(err, "net.SplitHostPort")
+		}
+		if _, ok := seen[v.Addr]; ok {
+			return nil, errors.Errorf("duplicate backend: %s", v.Addr)
+		}
+		seen[v.Addr] = struct{}{}
+		weight := v.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		if weight < 0 {
+			return nil, errors.Errorf("invalid weight of %s: %d", v.Addr, v.Weight)
+		}
+		be := &backend{addr: v.Addr, weight: weight, healthy: 1}
+		b.backends = append(b.backends, be)
+		if method == Hash {
+			for i := 0; i < replicas*weight; i++ {
+				h := crc32.ChecksumIEEE([]byte(v.Addr + "#" + strconv.Itoa(i)))
+				b.ring = append(b.ring, point{hash: h, backend: be})
+			}
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	if hc != nil {
+		c, err := newChecker(name, b.backends, hc, dialer)
+		if err != nil {
+			return nil, errors.Wrap(err, "newChecker")
+		}
+		b.checker = c
+		go c.run()
+	}
+	return b, nil
+}
+
+// Close stops health checks
+func (b *Balancer) Close() {
+	if b != nil && b.checker != nil {
+		b.checker.stop()
+	}
+}
+
+// Dial connects to backends in picked order through dialer, the next backend is tried on failure,
+// client addr is the key of hash method
+func (b *Balancer) Dial(dialer outbound.Dialer, client net.Addr) (net.Conn, string, error) {
+	var err error
+	for _, be := range b.order(client) {
+		var conn net.Conn
+		conn, err = dialer.Dial("tcp", be.addr)
+		if err == nil {
+			atomic.AddInt64(&be.active, 1)
+			return &backendConn{Conn: conn, backend: be}, be.addr, nil
+		}
+		err = errors.Wrap(err, be.addr)
+	}
+	return nil, "", errors.Wrap(err, "all backends failed")
+}
+
+// order returns healthy backends with the picked one first, all backends if none is healthy
+func (b *Balancer) order(client net.Addr) []*backend {
+	candidates := make([]*backend, 0, len(b.backends))
+	for _, be := range b.backends {
+		if be.isHealthy() {
+			candidates = append(candidates, be)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, b.backends...)
+	}
+	switch b.method {
+	case LeastConn:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			// compare active/weight without division
+			return atomic.LoadInt64(&candidates[i].active)*int64(candidates[j].weight) <
+				atomic.LoadInt64(&candidates[j].active)*int64(candidates[i].weight)
+		})
+		return candidates
+	case Hash:
+		return b.ringOrder(client, candidates)
+	}
+	return b.roundRobin(candidates)
+}
+
+// roundRobin moves the pick of smooth weighted round-robin to front
+func (b *Balancer) roundRobin(candidates []*backend) []*backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := 0
+	best := 0
+	for i, be := range candidates {
+		be.current += be.weight
+		total += be.weight
+		if be.current > candidates[best].current {
+			best = i
+		}
+	}
+	candidates[best].current -= total
+	candidates[0], candidates[best] = candidates[best], candidates[0]
+	return candidates
+}
+
+// ringOrder walks hash ring from client ip, so a client sticks to a backend while it is healthy
+func (b *Balancer) ringOrder(client net.Addr, candidates []*backend) []*backend {
+	allowed := make(map[*backend]struct{}, len(candidates))
+	for _, be := range candidates {
+		allowed[be] = struct{}{}
+	}
+	key := ""
+	if client != nil {
+		key = client.String()
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	ordered := make([]*backend, 0, len(candidates))
+	for i := 0; i < len(b.ring) && len(ordered) < len(candidates); i++ {
+		be := b.ring[(start+i)%len(b.ring)].backend
+		if _, ok := allowed[be]; ok {
+			delete(allowed, be)
+			ordered = append(ordered, be)
+		}
+	}
+	return ordered
+}
+
+// backendConn counts active conns of backend
+type backendConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.backend.active, -1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,196 @@
+package balancer
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func newTestBalancer(t *testing.T, method string, backends ...BackendConf) *Balancer {
+	b, err := New("test", backends, method, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func addrs(backends []*backend) []string {
+	var s []string
+	for _, be := range backends {
+		s = append(s, be.addr)
+	}
+	return s
+}
+
+func setHealthy(b *Balancer, addr string, healthy bool) {
+	for _, be := range b.backends {
+		if be.addr == addr {
+			v := int32(0)
+			if healthy {
+				v = 1
+			}
+			atomic.StoreInt32(&be.healthy, v)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		backends []BackendConf
+		method   string
+		ok       bool
+	}{
+		{"default method", []BackendConf{{Addr: "a:1"}}, "", true},
+		{"hash", []BackendConf{{Addr: "a:1", Weight: 2}, {Addr: "b:1"}}, Hash, true},
+		{"empty", nil, "", false},
+		{"invalid method", []BackendConf{{Addr: "a:1"}}, "random", false},
+		{"missing port", []BackendConf{{Addr: "a"}}, "", false},
+		{"duplicate", []BackendConf{{Addr: "a:1"}, {Addr: "a:1"}}, "", false},
+		{"negative weight", []BackendConf{{Addr: "a:1", Weight: -1}}, "", false},
+	}
+	for _, tt := range tests {
+		b, err := New("test", tt.backends, tt.method, nil, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: New error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		b.Close()
+	}
+	b := newTestBalancer(t, Hash, BackendConf{Addr: "a:1", Weight: 2}, BackendConf{Addr: "b:1"})
+	if len(b.ring) != 3*replicas {
+		t.Errorf("ring has %d points, want %d", len(b.ring), 3*replicas)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name      string
+		backends  []BackendConf
+		unhealthy []string
+		want      string
+	}{
+		{"equal weights", []BackendConf{{Addr: "a:1"}, {Addr: "b:1"}, {Addr: "c:1"}}, nil, "abcabc"},
+		{"smooth weights", []BackendConf{{Addr: "a:1", Weight: 5}, {Addr: "b:1"}, {Addr: "c:1"}}, nil, "aabacaa"},
+		{"unhealthy skipped", []BackendConf{{Addr: "a:1"}, {Addr: "b:1"}, {Addr: "c:1"}}, []string{"b:1"}, "acac"},
+		{"all unhealthy", []BackendConf{{Addr: "a:1"}, {Addr: "b:1"}}, []string{"a:1", "b:1"}, "abab"},
+	}
+	for _, tt := range tests {
+		b := newTestBalancer(t, RoundRobin, tt.backends...)
+		for _, v := range tt.unhealthy {
+			setHealthy(b, v, false)
+		}
+		var picks strings.Builder
+		for i := 0; i < len(tt.want); i++ {
+			picks.WriteString(b.order(nil)[0].addr[:1])
+		}
+		if got := picks.String(); got != tt.want {
+			t.Errorf("%s: picks = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		weight []int
+		active []int64
+		want   []string
+	}{
+		{"fewest first", []int{1, 1, 1}, []int64{3, 1, 2}, []string{"b:1", "c:1", "a:1"}},
+		{"ties keep order", []int{1, 1, 1}, []int64{1, 1, 0}, []string{"c:1", "a:1", "b:1"}},
+		{"weighted", []int{4, 1, 1}, []int64{4, 2, 3}, []string{"a:1", "b:1", "c:1"}},
+	}
+	for _, tt := range tests {
+		var confs []BackendConf
+		for i, w := range tt.weight {
+			confs = append(confs, BackendConf{Addr: string(rune('a'+i)) + ":1", Weight: w})
+		}
+		b := newTestBalancer(t, LeastConn, confs...)
+		for i, v := range tt.active {
+			b.backends[i].active = v
+		}
+		if got := addrs(b.order(nil)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: order = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	b := newTestBalancer(t, Hash, BackendConf{Addr: "a:1"}, BackendConf{Addr: "b:1"}, BackendConf{Addr: "c:1"})
+	clients := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+		nil,
+	}
+	for _, client := range clients {
+		order := addrs(b.order(client))
+		if len(order) != 3 {
+			t.Fatalf("order(%v) = %v, want every backend", client, order)
+		}
+		// port of client does not move it
+		if tcpAddr, ok := client.(*net.TCPAddr); ok {
+			moved := &net.TCPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port + 1}
+			if got := addrs(b.order(moved)); !reflect.DeepEqual(got, order) {
+				t.Errorf("order(%v) = %v, want %v", moved, got, order)
+			}
+		}
+		// unhealthy pick fails over to the next backend on ring, others keep their order
+		setHealthy(b, order[0], false)
+		if got := addrs(b.order(client)); !reflect.DeepEqual(got, order[1:]) {
+			t.Errorf("order(%v) with %s unhealthy = %v, want %v", client, order[0], got, order[1:])
+		}
+		setHealthy(b, order[0], true)
+	}
+}
+
+// failDialer fails for addrs in fail
+type failDialer map[string]bool
+
+func (d failDialer) Dial(network, addr string) (net.Conn, error) {
+	if d[addr] {
+		return nil, errors.New("refused")
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestDial(t *testing.T) {
+	tests := []struct {
+		name string
+		fail []string
+		addr string
+		ok   bool
+	}{
+		{"first", nil, "a:1", true},
+		{"next on failure", []string{"a:1"}, "b:1", true},
+		{"all failed", []string{"a:1", "b:1"}, "", false},
+	}
+	for _, tt := range tests {
+		b := newTestBalancer(t, LeastConn, BackendConf{Addr: "a:1"}, BackendConf{Addr: "b:1"})
+		d := failDialer{}
+		for _, v := range tt.fail {
+			d[v] = true
+		}
+		conn, addr, err := b.Dial(d, nil)
+		if (err == nil) != tt.ok || addr != tt.addr {
+			t.Errorf("%s: Dial = %s, %v, want %s, ok %v", tt.name, addr, err, tt.addr, tt.ok)
+		}
+		if err != nil {
+			continue
+		}
+		be := b.order(nil)[1]
+		if be.addr != tt.addr || atomic.LoadInt64(&be.active) != 1 {
+			t.Errorf("%s: active conn of %s is not counted", tt.name, tt.addr)
+		}
+		conn.Close()
+		conn.Close()
+		if n := atomic.LoadInt64(&be.active); n != 0 {
+			t.Errorf("%s: active = %d after close, want 0", tt.name, n)
+		}
+	}
+}
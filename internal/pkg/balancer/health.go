@@ -0,0 +1,161 @@
+package balancer
+
+import (
+	"bufio"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInterval = 10
+	defaultTimeout  = 3
+	defaultFall     = 3
+	defaultRise     = 2
+)
+
+// HealthCheckConf defines periodic checks ejecting dead backends
+type HealthCheckConf struct {
+	// Type is tcp (default) or http
+	Type string `json:"type"`
+	// Path and Host of http check, a 2xx or 3xx status is healthy
+	Path string `json:"path"`
+	Host string `json:"host"`
+	// Interval and Timeout of http response in seconds
+	Interval int `json:"interval"`
+	Timeout  int `json:"timeout"`
+	// Fall consecutive failures eject a backend, Rise consecutive successes bring it back
+	Fall int `json:"fall"`
+	Rise int `json:"rise"`
+}
+
+type checker struct {
+	name     string
+	backends []*backend
+	conf     HealthCheckConf
+	interval time.Duration
+	timeout  time.Duration
+	dialer   outbound.Dialer
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newChecker(name string, backends []*backend, hc *HealthCheckConf, dialer outbound.Dialer) (*checker, error) {
+	c := &checker{name: name, backends: backends, conf: *hc, dialer: dialer, done: make(chan struct{})}
+	switch c.conf.Type {
+	case "":
+		c.conf.Type = "tcp"
+	case "tcp", "http":
+	default:
+		return nil, errors.Errorf("invalid health check type: %s", c.conf.Type)
+	}
+	if len(c.conf.Path) == 0 {
+		c.conf.Path = "/"
+	}
+	if c.conf.Interval <= 0 {
+		c.conf.Interval = defaultInterval
+	}
+	if c.conf.Timeout <= 0 {
+		c.conf.Timeout = defaultTimeout
+	}
+	if c.conf.Fall <= 0 {
+		c.conf.Fall = defaultFall
+	}
+	if c.conf.Rise <= 0 {
+		c.conf.Rise = defaultRise
+	}
+	c.interval = time.Duration(c.conf.Interval) * time.Second
+	c.timeout = time.Duration(c.conf.Timeout) * time.Second
+	if c.dialer == nil {
+		c.dialer = outbound.Direct
+	}
+	return c, nil
+}
+
+func (c *checker) stop() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// run checks every backend each interval until stopped
+func (c *checker) run() {
+	fails := make([]int, len(c.backends))
+	passes := make([]int, len(c.backends))
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		errs := make([]error, len(c.backends))
+		for i, be := range c.backends {
+			wg.Add(1)
+			go func(i int, be *backend) {
+				defer wg.Done()
+				errs[i] = c.check(be.addr)
+			}(i, be)
+		}
+		wg.Wait()
+		for i, be := range c.backends {
+			logEntry := log.WithFields(log.Fields{"Route": c.name, "DST": be.addr})
+			if errs[i] != nil {
+				passes[i] = 0
+				fails[i]++
+				logEntry.Debugf("health check: %s", errs[i])
+				if fails[i] >= c.conf.Fall && be.isHealthy() {
+					atomic.StoreInt32(&be.healthy, 0)
+					logEntry.Warnf("backend down: %s", errs[i])
+				}
+				continue
+			}
+			fails[i] = 0
+			passes[i]++
+			if passes[i] >= c.conf.Rise && !be.isHealthy() {
+				atomic.StoreInt32(&be.healthy, 1)
+				logEntry.Info("backend up")
+			}
+		}
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *checker) check(addr string) error {
+	conn, err := c.dialer.Dial("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "dialer.Dial")
+	}
+	defer conn.Close()
+	if c.conf.Type == "tcp" {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+c.conf.Path, nil)
+	if err != nil {
+		return errors.Wrap(err, "http.NewRequest")
+	}
+	if len(c.conf.Host) != 0 {
+		req.Host = c.conf.Host
+	}
+	req.Close = true
+	req.Header.Set("User-Agent", "akari-health-check")
+	if err := req.Write(conn); err != nil {
+		return errors.Wrap(err, "req.Write")
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return errors.Wrap(err, "http.ReadResponse")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return errors.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// expiryWarning is how long before expiry a cert is logged as expiring
+var expiryWarning = 7 * 24 * time.Hour
+
+// Cert is a loaded cert pair
+type Cert struct {
+	Name string
+	TLS  *tls.Certificate
+	Leaf *x509.Certificate
+}
+
+// Store holds certs and selects one for each handshake
+type Store struct {
+	mu       sync.RWMutex
+	pairs    []config.TLSCertPair
+	certs    []*Cert
+	declared map[string]struct{}
+}
+
+// NewStore method
+func NewStore(pairs []config.TLSCertPair) (*Store, error) {
+	s := &Store{
+		pairs:    pairs,
+		declared: make(map[string]struct{}),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads all cert pairs from disk, the running certs are kept on any error
+func (s *Store) Reload() error {
+	certs := make([]*Cert, 0, len(s.pairs))
+	names := make(map[string]struct{})
+	for _, v := range s.pairs {
+		c, err := loadCert(v)
+		if err != nil {
+			return errors.Wrapf(err, "loadCert: %s", v.Cert)
+		}
+		if _, ok := names[c.Name]; ok {
+			return errors.Errorf("duplicate cert name: %s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+		certs = append(certs, c)
+	}
+	s.mu.Lock()
+	// keep certs set by Set
+	for _, v := range s.certs {
+		if _, ok := names[v.Name]; !ok {
+			certs = append(certs, v)
+		}
+	}
+	s.certs = certs
+	s.mu.Unlock()
+	for _, c := range certs {
+		logCert(c)
+	}
+	return nil
+}
+
+// Set adds or replaces a cert by name
+func (s *Store) Set(name string, kp tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "x509.ParseCertificate")
+	}
+	kp.Leaf = leaf
+	c := &Cert{Name: name, TLS: &kp, Leaf: leaf}
+	s.mu.Lock()
+	replaced := false
+	for i, v := range s.certs {
+		if v.Name == name {
+			s.certs[i] = c
+			replaced = true
+		}
+	}
+	if !replaced {
+		s.certs = append(s.certs, c)
+	}
+	s.mu.Unlock()
+	logCert(c)
+	return nil
+}
+
+// Declare reserves name for a cert set later by Set
+func (s *Store) Declare(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.declared[name] = struct{}{}
+}
+
+// Has reports whether a cert named name exists or is declared
+func (s *Store) Has(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.declared[name]; ok {
+		return true
+	}
+	for _, v := range s.certs {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns cert by name, or the first cert valid for serverName when name is empty,
+// or the first cert when none is valid
+func (s *Store) Get(name, serverName string) (*Cert, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.certs) == 0 {
+		return nil, errors.New("empty certs")
+	}
+	if len(name) != 0 {
+		for _, v := range s.certs {
+			if v.Name == name {
+				return v, nil
+			}
+		}
+		return nil, errors.Errorf("cert not found: %s", name)
+	}
+	if len(serverName) != 0 {
+		for _, v := range s.certs {
+			if v.Leaf.VerifyHostname(serverName) == nil {
+				return v, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// Watch reloads certs after files change
+func (s *Store) Watch(delay time.Duration, done <-chan struct{}) error {
+	dirs := make(map[string]struct{})
+	for _, v := range s.pairs {
+		dirs[filepath.Dir(v.Cert)] = struct{}{}
+		dirs[filepath.Dir(v.Key)] = struct{}{}
+	}
+	for dir := range dirs {
+		err := utils.WatchDir(dir, delay, done, func() {
+			if err := s.Reload(); err != nil {
+				log.Errorf("cert: reload: %s", err)
+				return
+			}
+			log.Info("cert: reload success")
+		})
+		if err != nil {
+			return errors.Wrapf(err, "utils.WatchDir: %s", dir)
+		}
+	}
+	return nil
+}
+
+func loadCert(v config.TLSCertPair) (*Cert, error) {
+	kp, err := tls.LoadX509KeyPair(v.Cert, v.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "tls.LoadX509KeyPair")
+	}
+	leaf, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "x509.ParseCertificate")
+	}
+	kp.Leaf = leaf
+	name := v.Name
+	if len(name) == 0 {
+		name = v.Cert
+	}
+	return &Cert{Name: name, TLS: &kp, Leaf: leaf}, nil
+}
+
+func logCert(c *Cert) {
+	logger := log.WithFields(log.Fields{
+		"Cert":     c.Name,
+		"DNSNames": c.Leaf.DNSNames,
+		"NotAfter": c.Leaf.NotAfter.Format(time.RFC3339),
+	})
+	if time.Until(c.Leaf.NotAfter) < expiryWarning {
+		logger.Warn("cert: expiring")
+		return
+	}
+	logger.Debug("cert: loaded")
+}
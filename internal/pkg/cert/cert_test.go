@@ -0,0 +1,210 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+)
+
+// writeCert writes a self signed cert pair of names to dir, serial tells versions of the same files apart
+func writeCert(t *testing.T, dir, base string, serial int64, names ...string) config.TLSCertPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := config.TLSCertPair{Cert: filepath.Join(dir, base+".crt"), Key: filepath.Join(dir, base+".key")}
+	if err := ioutil.WriteFile(pair.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func serialOf(t *testing.T, s *Store, name, serverName string) int64 {
+	c, err := s.Get(name, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Leaf.SerialNumber.Int64()
+}
+
+func TestGet(t *testing.T) {
+	dir := t.TempDir()
+	a := writeCert(t, dir, "a", 1, "a.test", "*.a.test")
+	b := writeCert(t, dir, "b", 2, "b.test")
+	b.Name = "b"
+	s, err := NewStore([]config.TLSCertPair{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		cert       string
+		serverName string
+		want       int64
+		err        bool
+	}{
+		{"server name", "", "b.test", 2, false},
+		{"wildcard", "", "x.a.test", 1, false},
+		{"no match falls back to first", "", "c.test", 1, false},
+		{"empty server name", "", "", 1, false},
+		{"named", "b", "a.test", 2, false},
+		{"named by cert path", a.Cert, "b.test", 1, false},
+		{"missing name", "c", "c.test", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := s.Get(tt.cert, tt.serverName)
+			if (err != nil) != tt.err {
+				t.Fatalf("Get() error = %v, want error %v", err, tt.err)
+			}
+			if err == nil && c.Leaf.SerialNumber.Int64() != tt.want {
+				t.Errorf("Get() = cert %d, want %d", c.Leaf.SerialNumber.Int64(), tt.want)
+			}
+		})
+	}
+	empty, err := NewStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.Get("", "a.test"); err == nil {
+		t.Error("Get() of empty store succeeded")
+	}
+}
+
+func TestNewStoreInvalid(t *testing.T) {
+	dir := t.TempDir()
+	a := writeCert(t, dir, "a", 1, "a.test")
+	b := writeCert(t, dir, "b", 2, "b.test")
+	a.Name, b.Name = "same", "same"
+	tests := []struct {
+		name  string
+		pairs []config.TLSCertPair
+	}{
+		{"duplicate name", []config.TLSCertPair{a, b}},
+		{"missing file", []config.TLSCertPair{{Cert: filepath.Join(dir, "c.crt"), Key: filepath.Join(dir, "c.key")}}},
+		{"mismatched key", []config.TLSCertPair{{Cert: a.Cert, Key: b.Key}}},
+	}
+	for _, tt := range tests {
+		if _, err := NewStore(tt.pairs); err == nil {
+			t.Errorf("%s: NewStore() succeeded", tt.name)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	a := writeCert(t, dir, "a", 1, "a.test")
+	s, err := NewStore([]config.TLSCertPair{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, dir, "a", 2, "a.test")
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serialOf(t, s, "", "a.test"); got != 2 {
+		t.Errorf("cert after reload = %d, want 2", got)
+	}
+	// running certs are kept when files are broken
+	if err := ioutil.WriteFile(a.Cert, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() of broken cert succeeded")
+	}
+	if got := serialOf(t, s, "", "a.test"); got != 2 {
+		t.Errorf("cert after failed reload = %d, want 2", got)
+	}
+}
+
+func TestSet(t *testing.T) {
+	dir := t.TempDir()
+	a := writeCert(t, dir, "a", 1, "a.test")
+	s, err := NewStore([]config.TLSCertPair{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("acme") {
+		t.Error("Has() of unknown name = true")
+	}
+	s.Declare("acme")
+	if !s.Has("acme") || !s.Has(a.Cert) {
+		t.Error("Has() of declared or loaded name = false")
+	}
+	for _, serial := range []int64{2, 3} {
+		p := writeCert(t, dir, "acme", serial, "b.test")
+		kp, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set("acme", kp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := serialOf(t, s, "acme", ""); got != 3 {
+		t.Errorf("cert set = %d, want 3", got)
+	}
+	if got := serialOf(t, s, "", "b.test"); got != 3 {
+		t.Errorf("cert of b.test = %d, want 3", got)
+	}
+	// certs set by Set are kept by Reload
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serialOf(t, s, "acme", ""); got != 3 {
+		t.Errorf("cert set after reload = %d, want 3", got)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	a := writeCert(t, dir, "a", 1, "a.test")
+	s, err := NewStore([]config.TLSCertPair{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	if err := s.Watch(10*time.Millisecond, done); err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, dir, "a", 2, "a.test")
+	deadline := time.Now().Add(5 * time.Second)
+	for serialOf(t, s, "", "a.test") != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("cert is not reloaded after files change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
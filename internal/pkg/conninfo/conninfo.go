@@ -0,0 +1,53 @@
+package conninfo
+
+import "sync"
+
+// Info holds client conn info shared by handlers
+type Info struct {
+	// SNI is the server name sent by client, empty if not sent
+	SNI string
+	// Route is the sni of matched ServerConf
+	Route string
+	// Limit is set by server to check quotas of route and user, nil means no limit
+	Limit func(info *Info) error
+	// Routed is set by server to report whether host is routed to Route, e.g. Host of http requests
+	Routed func(host string) bool
+
+	mu sync.RWMutex
+	// user is the authenticated user, from client cert or proxy auth,
+	// it is set by handlers while wrapped conns read it
+	user string
+}
+
+// User returns the authenticated user, empty if none
+func (i *Info) User() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.user
+}
+
+// SetUser sets the authenticated user
+func (i *Info) SetUser(user string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.user = user
+}
+
+// Clone returns a copy for a stream of multiplexing conn
+func (i *Info) Clone() *Info {
+	return &Info{
+		SNI:    i.SNI,
+		Route:  i.Route,
+		Limit:  i.Limit,
+		Routed: i.Routed,
+		user:   i.User(),
+	}
+}
+
+// Allow is called by handlers before dialing dst, conns are rejected on error
+func (i *Info) Allow() error {
+	if i.Limit == nil {
+		return nil
+	}
+	return i.Limit(i)
+}
@@ -0,0 +1,270 @@
+package https
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+	"github.com/mikumaycry/akari/internal/pkg/transport"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// hopHeaders are hop-by-hop headers of RFC 7230, they are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardTransport returns pool of origin conns of user, conns are dialed through policy, rules and outbound of route,
+// and reused by later requests of the client conn
+func (h *handler) forwardTransport(user string) *http.Transport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.forward[user]; ok {
+		return t
+	}
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return h.cfg.Dial(user, network, addr)
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		// pass Accept-Encoding and bodies as is
+		DisableCompression: true,
+	}
+	h.forward[user] = t
+	return t
+}
+
+// proxyUser authenticates req, the user of client conn is used without proxy auth
+func (h *handler) proxyUser(w http.ResponseWriter, req *http.Request) (*conninfo.Info, bool) {
+	info := h.info.Clone()
+	user, ok := h.authenticate(w, req)
+	if !ok {
+		h.logEntry.WithField("DST", req.Host).Errorf("invalid auth: %s", user)
+		return nil, false
+	}
+	if len(user) != 0 {
+		info.SetUser(user)
+		// traffic of client conn is counted for its latest user
+		h.info.SetUser(user)
+	}
+	return info, true
+}
+
+func (h *handler) serveForward(w http.ResponseWriter, req *http.Request) {
+	dstAddr := req.URL.Host
+	if len(dstAddr) == 0 {
+		dstAddr = req.Host
+	}
+	if len(dstAddr) == 0 {
+		h.logEntry.Error("empty dstAddr")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	httpSNI := stripPort(dstAddr)
+	if dstAddr == httpSNI {
+		dstAddr = net.JoinHostPort(dstAddr, "80")
+	}
+	info, ok := h.proxyUser(w, req)
+	if !ok {
+		return
+	}
+	logEntry := h.logEntry.WithField("DST", httpSNI)
+	user := info.User()
+	if len(user) != 0 {
+		logEntry = logEntry.WithField("User", user)
+	}
+	if err := info.Allow(); err != nil {
+		logEntry.Errorf("info.Allow: %s", err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if req.Method == http.MethodConnect {
+		defer logEntry.Info("Close DST")
+		logEntry.Info("Open DST")
+		if req.ProtoMajor == 2 {
+			h.serveStreamConnect(w, req, user, dstAddr, logEntry)
+			return
+		}
+		h.serveConnect(w, user, dstAddr, logEntry)
+		return
+	}
+	logEntry.Infof("%s %s", req.Method, req.URL.Path)
+	outReq := req.Clone(req.Context())
+	outReq.RequestURI = ""
+	outReq.URL.Scheme = "http"
+	outReq.URL.Host = dstAddr
+	if req.ContentLength == 0 {
+		outReq.Body = nil
+	}
+	outReq.Close = false
+	removeHopHeaders(outReq.Header)
+	removeProxyHeaders(outReq.Header)
+	outReq.Header.Add("Via", via(req))
+	resp, err := h.forwardTransport(user).RoundTrip(outReq)
+	if err != nil {
+		logEntry.Errorf("RoundTrip: %s", err)
+		w.WriteHeader(dialErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	header.Add("Via", via(req))
+	if _, ok := resp.Header["Content-Type"]; !ok {
+		// keep ResponseWriter from sniffing one
+		header["Content-Type"] = nil
+	}
+	// trailers are announced before body and sent after it
+	for k := range resp.Trailer {
+		header.Add("Trailer", k)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(flushWriter{w}, resp.Body); err != nil {
+		logEntry.Debugf("io.Copy: %s", err)
+		return
+	}
+	for k, v := range resp.Trailer {
+		header[k] = v
+	}
+}
+
+// removeHopHeaders removes hop-by-hop headers and those listed in Connection
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); len(name) != 0 {
+				header.Del(name)
+			}
+		}
+	}
+	for _, v := range hopHeaders {
+		header.Del(v)
+	}
+}
+
+// removeProxyHeaders removes headers for this proxy, e.g. Proxy-Authorization
+func removeProxyHeaders(header http.Header) {
+	for k := range header {
+		if strings.HasPrefix(k, "Proxy-") {
+			delete(header, k)
+		}
+	}
+}
+
+// via returns Via header value of this hop
+func via(req *http.Request) string {
+	if req.ProtoMajor == 2 {
+		return "2 akari"
+	}
+	return fmt.Sprintf("%d.%d akari", req.ProtoMajor, req.ProtoMinor)
+}
+
+// serveConnect tunnels the hijacked client conn to dstAddr
+func (h *handler) serveConnect(w http.ResponseWriter, user, dstAddr string, logEntry *log.Entry) {
+	dstConn, err := h.cfg.Dial(user, "tcp", dstAddr)
+	if err != nil {
+		logEntry.Errorf("cfg.Dial: %s", err)
+		w.WriteHeader(dialErrorStatus(err))
+		return
+	}
+	defer dstConn.Close()
+	srcConn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		logEntry.Errorf("Hijack: %s", err)
+		return
+	}
+	defer srcConn.Close()
+	b := []byte("HTTP/1.1 200 Connection established\r\n" +
+		"Proxy-Agent: Akari" + "\r\n\r\n")
+	if _, err := srcConn.Write(b); err != nil {
+		logEntry.Errorf("srcConn.Write: %s", err)
+		return
+	}
+	// bytes sent by client right after CONNECT may be buffered already
+	transport.Transport(&bufferedConn{Conn: srcConn, r: rw.Reader}, dstConn)
+}
+
+// serveStreamConnect tunnels an h2 stream to dstAddr, the stream is full duplex so no hijacking is needed
+func (h *handler) serveStreamConnect(w http.ResponseWriter, req *http.Request, user, dstAddr string, logEntry *log.Entry) {
+	dstConn, err := h.cfg.Dial(user, "tcp", dstAddr)
+	if err != nil {
+		logEntry.Errorf("cfg.Dial: %s", err)
+		w.WriteHeader(dialErrorStatus(err))
+		return
+	}
+	defer dstConn.Close()
+	w.WriteHeader(http.StatusOK)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logEntry.Error("stream is not flushable")
+		return
+	}
+	flusher.Flush()
+	transport.Transport(&streamConn{r: req.Body, w: w, flusher: flusher}, dstConn)
+}
+
+// dialErrorStatus maps acl denial to 403
+func dialErrorStatus(err error) int {
+	if errors.Cause(err) == acl.ErrDenied {
+		return http.StatusForbidden
+	}
+	return http.StatusServiceUnavailable
+}
+
+// flushWriter flushes every write, so streamed responses are not held in buffer
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// streamConn is a ReadWriter of request body and flushed response of an h2 stream
+type streamConn struct {
+	r       io.Reader
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.flusher.Flush()
+	return n, err
+}
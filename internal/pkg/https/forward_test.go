@@ -0,0 +1,185 @@
+package https
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/auth"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"X-Hop, keep-alive", "Upgrade"},
+		"X-Hop":             {"1"},
+		"Keep-Alive":        {"timeout=5"},
+		"Proxy-Connection":  {"keep-alive"},
+		"Te":                {"trailers"},
+		"Trailer":           {"X-Sum"},
+		"Transfer-Encoding": {"chunked"},
+		"Upgrade":           {"websocket"},
+		"X-End":             {"1"},
+	}
+	removeHopHeaders(header)
+	if want := (http.Header{"X-End": {"1"}}); !reflect.DeepEqual(header, want) {
+		t.Errorf("removeHopHeaders() = %v, want %v", header, want)
+	}
+	header = http.Header{"Proxy-Authorization": {"Basic x"}, "Proxy-Foo": {"1"}, "X-End": {"1"}}
+	removeProxyHeaders(header)
+	if want := (http.Header{"X-End": {"1"}}); !reflect.DeepEqual(header, want) {
+		t.Errorf("removeProxyHeaders() = %v, want %v", header, want)
+	}
+}
+
+func TestForward(t *testing.T) {
+	origin := backend(t, "origin")
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test", Policy: allowPrivate(t)}, "a.test")
+	for _, h2 := range []bool{false, true} {
+		client := proxyClient(t, addr, nil)
+		via := "1.1 akari"
+		if h2 {
+			client, via = h2Client(t, addr), "2 akari"
+		}
+		req := newRequest(t, http.MethodGet, originURL(origin, "origin.test", "/path?q=1"))
+		// h2 has no hop-by-hop headers
+		if !h2 {
+			req.Header.Set("Connection", "X-Hop")
+			req.Header.Set("X-Hop", "1")
+		}
+		req.Header.Set("X-End", "1")
+		resp, got := get(t, client, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("h2 %v: status = %d", h2, resp.StatusCode)
+		}
+		if got.Name != "origin" || got.Path != "/path?q=1" || got.Host != originHost(origin, "origin.test") {
+			t.Errorf("h2 %v: origin got %s host %s path %s", h2, got.Name, got.Host, got.Path)
+		}
+		if got.Header.Get("X-Hop") != "" || got.Header.Get("X-End") != "1" {
+			t.Errorf("h2 %v: origin got header %v", h2, got.Header)
+		}
+		if got := got.Header.Get("Via"); got != via {
+			t.Errorf("h2 %v: Via of request = %q, want %q", h2, got, via)
+		}
+		if got := resp.Header.Get("Via"); got != via {
+			t.Errorf("h2 %v: Via of response = %q, want %q", h2, got, via)
+		}
+	}
+}
+
+func TestForwardHosts(t *testing.T) {
+	a := backend(t, "a")
+	b := backend(t, "b")
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test", Policy: allowPrivate(t)}, "a.test")
+	client := proxyClient(t, addr, nil)
+	// each request of a kept alive client conn goes to its own origin
+	for i, v := range []struct {
+		url  string
+		name string
+	}{
+		{originURL(a, "origin.test", "/1"), "a"},
+		{originURL(b, "other.test", "/2"), "b"},
+		{originURL(a, "origin.test", "/3"), "a"},
+	} {
+		reused := true
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		req := newRequest(t, http.MethodGet, v.url)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, got := get(t, client, req)
+		if resp.StatusCode != http.StatusOK || got.Name != v.name {
+			t.Errorf("%s: status = %d, origin %s, want %s", v.url, resp.StatusCode, got.Name, v.name)
+		}
+		if i != 0 && !reused {
+			t.Errorf("%s: client conn is not reused", v.url)
+		}
+	}
+}
+
+func TestForwardAuth(t *testing.T) {
+	origin := backend(t, "origin")
+	users, err := auth.New([]string{"alice:apass"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test", Policy: allowPrivate(t), Credentials: users}, "a.test")
+	tests := []struct {
+		name   string
+		user   *url.Userinfo
+		status int
+	}{
+		{"no auth", nil, http.StatusProxyAuthRequired},
+		{"wrong password", url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired},
+		{"auth", url.UserPassword("alice", "apass"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, got := get(t, proxyClient(t, addr, tt.user), newRequest(t, http.MethodGet, originURL(origin, "origin.test", "/")))
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("%s: no Proxy-Authenticate", tt.name)
+		}
+		if tt.status == http.StatusOK && got.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("%s: Proxy-Authorization is forwarded", tt.name)
+		}
+	}
+}
+
+func TestForwardDenied(t *testing.T) {
+	// private networks are denied by default policy
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test"}, "a.test")
+	resp, _ := get(t, proxyClient(t, addr, nil), newRequest(t, http.MethodGet, "http://127.0.0.2:8080/"))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestDisableForwardProxy(t *testing.T) {
+	web := backend(t, "web")
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test", Addr: hostOf(web), DisableForwardProxy: true}, "a.test")
+	// absolute form of other hosts is reverse proxied
+	resp, got := get(t, proxyClient(t, addr, nil), newRequest(t, http.MethodGet, "http://other.test/x"))
+	if resp.StatusCode != http.StatusOK || got.Name != "web" || got.Host != "other.test" {
+		t.Errorf("status = %d, backend got %s host %s", resp.StatusCode, got.Name, got.Host)
+	}
+	req := newRequest(t, http.MethodConnect, "http://other.test:443")
+	req.Host = "other.test:443"
+	resp, _ = get(t, h2Client(t, addr), req)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("CONNECT status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	echo := tcpEcho(t)
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test", Policy: allowPrivate(t)}, "a.test")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// bytes right after CONNECT are tunneled too
+	if _, err := conn.Write([]byte("CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\nping")); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Fatalf("echo = %q %v", b, err)
+	}
+}
@@ -0,0 +1,20 @@
+package https
+
+import (
+	"net/http"
+)
+
+// enableHTTP2 serves h2 on decrypted client conns, which start with the client preface after ALPN h2
+func enableHTTP2(srv *http.Server) {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv.Protocols = protocols
+}
+
+// enableH2C makes transport talk h2c with prior knowledge
+func enableH2C(transport *http.Transport) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport.Protocols = protocols
+}
@@ -0,0 +1,127 @@
+package https
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mikumaycry/akari/internal/config"
+)
+
+// h2Client sends every request to addr in h2 with prior knowledge, like a client after ALPN h2,
+// the authority of request is its url host
+func h2Client(t *testing.T, addr string) *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		Protocols: protocols,
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+// h2cBackend accepts http/1 and h2 with prior knowledge
+func h2cBackend(t *testing.T, name string) *httptest.Server {
+	srv := httptest.NewUnstartedServer(echoHandler(name))
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv.Config.Protocols = protocols
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReverseProxyH2(t *testing.T) {
+	web := backend(t, "web")
+	grpc := h2cBackend(t, "grpc")
+	addr := serveProxy(t, &config.ServerConf{
+		SNI:          "a.test",
+		Addr:         hostOf(web),
+		ReverseProxy: map[string]config.ReverseProxyConf{"/grpc": {Addr: hostOf(grpc), H2C: true}},
+	}, "a.test")
+	client := h2Client(t, addr)
+	tests := []struct {
+		name    string
+		path    string
+		backend string
+		proto   int
+	}{
+		{"http/1 backend", "/index.html", "web", 1},
+		{"h2c backend", "/grpc/svc/Method", "grpc", 2},
+	}
+	for _, tt := range tests {
+		resp, got := get(t, client, newRequest(t, http.MethodGet, "http://a.test"+tt.path))
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+			t.Fatalf("%s: status = %d proto %d", tt.name, resp.StatusCode, resp.ProtoMajor)
+		}
+		if got.Name != tt.backend || got.Proto != tt.proto || got.Host != "a.test" || got.Path != tt.path {
+			t.Errorf("%s: backend got %s proto %d host %s path %s", tt.name, got.Name, got.Proto, got.Host, got.Path)
+		}
+		if got := got.Header.Get("X-Forwarded-Host"); got != "a.test" {
+			t.Errorf("%s: X-Forwarded-Host = %q", tt.name, got)
+		}
+	}
+}
+
+func TestStreamConnect(t *testing.T) {
+	echo := tcpEcho(t)
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test", Policy: allowPrivate(t)}, "a.test")
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "http", Host: echo},
+		Host:   echo,
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	resp, err := h2Client(t, addr).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("status = %d proto %d", resp.StatusCode, resp.ProtoMajor)
+	}
+	// the stream is full duplex
+	for _, v := range []string{"ping", "pong"} {
+		if _, err := pw.Write([]byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(v))
+		if _, err := io.ReadFull(resp.Body, b); err != nil || string(b) != v {
+			t.Fatalf("echo = %q %v", b, err)
+		}
+	}
+}
+
+// tcpEcho echoes conns of a local listener
+func tcpEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
@@ -1,134 +1,178 @@
 package https
 
 import (
-	"bufio"
+	"crypto/subtle"
 	"encoding/base64"
+	stdlog "log"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mikumaycry/akari/internal/config"
-	"github.com/mikumaycry/akari/internal/pkg/transport"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
 	log "github.com/sirupsen/logrus"
 )
 
-// HandleConn handle http connect
-func HandleConn(srcConn net.Conn, cfg *config.ServerConf, origLogEntry *log.Entry) {
-	req, err := http.ReadRequest(bufio.NewReader(srcConn))
-	if err != nil {
-		origLogEntry.Errorf("http.ReadRequest: %s", err)
-		return
-	}
-	defer req.Body.Close()
-	resp := &http.Response{
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     http.Header{},
+var idleTimeout = 5 * time.Minute
+
+// handler serves requests of one client conn, requests to the route itself are reverse proxied,
+// others are forward proxied unless DisableForwardProxy is set
+type handler struct {
+	cfg          *config.ServerConf
+	info         *conninfo.Info
+	logEntry     *log.Entry
+	conn         net.Conn
+	routes       []reverseRoute
+	reverseProxy *httputil.ReverseProxy
+	transport    *http.Transport
+	h2cProxy     *httputil.ReverseProxy
+	h2cTransport *http.Transport
+	// forward pools origin conns of each user
+	forward map[string]*http.Transport
+	// authHeader is the last verified Proxy-Authorization of authUser, failedAuth the last rejected one of failedUser,
+	// so requests of a kept alive conn do not hash passwords again
+	authHeader string
+	authUser   string
+	failedAuth string
+	failedUser string
+	// mu guards forward and auth cache, h2 streams are served concurrently
+	mu sync.Mutex
+}
+
+// HandleConn serves http requests of srcConn until it's closed or idle, h2 is served if client sends its preface
+func HandleConn(srcConn net.Conn, cfg *config.ServerConf, info *conninfo.Info, logEntry *log.Entry) {
+	ln := newConnListener(srcConn)
+	h := &handler{
+		cfg:      cfg,
+		info:     info,
+		logEntry: logEntry,
+		conn:     ln.conn,
+		routes:   reverseRoutes(cfg),
+		forward:  make(map[string]*http.Transport),
+	}
+	h.reverseProxy, h.transport = h.newReverseProxy(false)
+	for _, v := range h.routes {
+		if v.conf.H2C {
+			h.h2cProxy, h.h2cTransport = h.newReverseProxy(true)
+			break
+		}
 	}
-	dstAddr := req.URL.Host
-	if len(dstAddr) == 0 {
-		dstAddr = req.Host
+	errorLog := logEntry.WriterLevel(log.DebugLevel)
+	defer errorLog.Close()
+	srv := &http.Server{
+		Handler:     h,
+		IdleTimeout: idleTimeout,
+		ErrorLog:    stdlog.New(errorLog, "", 0),
 	}
-	if len(dstAddr) == 0 {
-		origLogEntry.Error("empty dstAddr")
-		resp.StatusCode = http.StatusBadRequest
-		resp.Write(srcConn)
-		return
+	enableHTTP2(srv)
+	srv.Serve(ln)
+	h.transport.CloseIdleConnections()
+	if h.h2cTransport != nil {
+		h.h2cTransport.CloseIdleConnections()
 	}
-	httpSNI := stripPort(dstAddr)
-	if dstAddr == httpSNI {
-		dstAddr = net.JoinHostPort(dstAddr, "80")
-	}
-	logEntry := origLogEntry.WithField("DST", httpSNI)
-	if httpSNI == cfg.SNI {
-		reverseProxyDst, ok := cfg.ReverseProxy[req.URL.Path]
-		if !ok {
-			if len(cfg.Addr) == 0 {
-				logEntry.Errorf("empty path: %s", req.URL.Path)
-				resp.StatusCode = http.StatusBadRequest
-				resp.Write(srcConn)
-				return
-			}
-			reverseProxyDst = cfg.Addr
-		}
-		remoteIP := stripPort(srcConn.RemoteAddr().String())
-		localIP := stripPort(srcConn.LocalAddr().String())
-		req.Header.Set("X-Real-IP", remoteIP)
-		req.Header.Set("X-Forwarded-For", remoteIP)
-		req.Header.Add("X-Forwarded-For", localIP)
-		dstConn, err := net.Dial("tcp", reverseProxyDst)
-		if err != nil {
-			logEntry.Errorf("net.Dial: %s", err)
-			resp.StatusCode = http.StatusServiceUnavailable
-			resp.Write(srcConn)
-			return
-		}
-		defer dstConn.Close()
-		if err = req.Write(dstConn); err != nil {
-			logEntry.Errorf("req.Write: %s", err)
-			return
-		}
-		transport.Transport(srcConn, dstConn)
+	for _, t := range h.forward {
+		t.CloseIdleConnections()
 	}
-	if cfg.DisableForwardProxy {
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect && (h.cfg.DisableForwardProxy || h.isLocal(req)) {
+		h.serveReverse(w, req)
 		return
 	}
-	if ok := authenticate(srcConn, cfg, req, resp); !ok {
-		origLogEntry.Error("invalid auth")
+	if h.cfg.DisableForwardProxy {
+		h.logEntry.WithField("DST", req.Host).Errorf("forward proxy is disabled: %s", req.Host)
+		http.NotFound(w, req)
 		return
 	}
-	defer logEntry.Info("Close DST")
-	logEntry.Info("Open DST")
-	req.Header.Del("Proxy-Authorization")
-	dstConn, err := net.Dial("tcp", dstAddr)
-	if err != nil {
-		logEntry.Errorf("net.Dial: %s", err)
-		resp.StatusCode = http.StatusServiceUnavailable
-		resp.Write(srcConn)
-		return
+	h.serveForward(w, req)
+}
+
+// isLocal reports whether req is sent to the route itself instead of through it,
+// that is its host is routed to the route by server, or it's the sni or ip of client conn
+func (h *handler) isLocal(req *http.Request) bool {
+	// http/1 proxy requests are in absolute form, origin form is sent to the server itself
+	if req.ProtoMajor == 1 && len(req.URL.Host) == 0 {
+		return true
 	}
-	defer dstConn.Close()
-	if req.Method == http.MethodConnect {
-		b := []byte("HTTP/1.1 200 Connection established\r\n" +
-			"Proxy-Agent: Akari" + "\r\n\r\n")
-		srcConn.Write(b)
-	} else {
-		req.Header.Del("Proxy-Connection")
-		if err = req.Write(dstConn); err != nil {
-			logEntry.Errorf("req.Write: %s", err)
-			return
+	host := req.URL.Host
+	if len(host) == 0 {
+		host = req.Host
+	}
+	host = strings.ToLower(strings.Trim(stripPort(host), "[]"))
+	if len(host) == 0 || host == h.info.SNI {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if addr, ok := h.conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.Equal(ip) {
+			return true
 		}
 	}
-	transport.Transport(srcConn, dstConn)
+	if h.info.Routed != nil {
+		return h.info.Routed(host)
+	}
+	return host == strings.ToLower(h.cfg.SNI)
 }
 
-func authenticate(conn net.Conn, cfg *config.ServerConf, req *http.Request, resp *http.Response) bool {
-	if cfg.Auth == "" {
-		return true
+func (h *handler) authenticate(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if h.cfg.Credentials == nil {
+		return "", true
+	}
+	proxyAuth := req.Header.Get("Proxy-Authorization")
+	user, ok, cached := h.cachedAuth(proxyAuth)
+	if !cached {
+		user, ok = basicProxyAuth(proxyAuth, h.cfg)
+		h.cacheAuth(proxyAuth, user, ok)
 	}
-	ok := basicProxyAuth(req.Header.Get("Proxy-Authorization"), cfg)
 	if ok {
-		return true
+		return user, true
+	}
+	w.Header().Set("Proxy-Authenticate", "Basic realm=\"Akari\"")
+	w.WriteHeader(http.StatusProxyAuthRequired)
+	return user, false
+}
+
+// cachedAuth returns the result of proxyAuth if it's the last verified or rejected header of client conn
+func (h *handler) cachedAuth(proxyAuth string) (user string, ok bool, cached bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.authHeader) != 0 && subtle.ConstantTimeCompare([]byte(proxyAuth), []byte(h.authHeader)) == 1 {
+		return h.authUser, true, true
+	}
+	if len(h.failedAuth) != 0 && subtle.ConstantTimeCompare([]byte(proxyAuth), []byte(h.failedAuth)) == 1 {
+		return h.failedUser, false, true
+	}
+	return "", false, false
+}
+
+func (h *handler) cacheAuth(proxyAuth, user string, ok bool) {
+	if len(proxyAuth) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ok {
+		h.authHeader, h.authUser = proxyAuth, user
+		return
 	}
-	resp.StatusCode = http.StatusProxyAuthRequired
-	resp.Header.Add("Proxy-Authenticate", "Basic realm=\"Akari\"")
-	resp.Write(conn)
-	return false
+	h.failedAuth, h.failedUser = proxyAuth, user
 }
 
-func basicProxyAuth(proxyAuth string, cfg *config.ServerConf) bool {
+func basicProxyAuth(proxyAuth string, cfg *config.ServerConf) (string, bool) {
 	if proxyAuth == "" {
-		return false
+		return "", false
 	}
 	if !strings.HasPrefix(proxyAuth, "Basic ") {
-		return false
+		return "", false
 	}
 	c, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(proxyAuth, "Basic "))
 	if err != nil {
-		return false
+		return "", false
 	}
-	cs := string(c)
-	return cs == cfg.Auth
+	return cfg.Credentials.VerifyPair(string(c))
 }
 
 // borrowed from `proxy` plugin
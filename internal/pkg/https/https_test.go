@@ -0,0 +1,111 @@
+package https
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/auth"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+)
+
+func basic(pair string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(pair))
+}
+
+func TestAuthenticateCache(t *testing.T) {
+	users, err := auth.New([]string{"alice:apass", "bob:bpass"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nobody is verified by changed credentials, so only cached headers pass
+	nobody, err := auth.New([]string{"carol:cpass"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{cfg: &config.ServerConf{Credentials: users}}
+	tests := []struct {
+		name   string
+		header string
+		change bool
+		user   string
+		ok     bool
+	}{
+		{"verified", basic("alice:apass"), false, "alice", true},
+		{"cached", basic("alice:apass"), true, "alice", true},
+		{"changed header is verified", basic("bob:bpass"), false, "bob", true},
+		{"previous header is verified again", basic("alice:apass"), true, "alice", false},
+		{"rejected", basic("bob:wrong"), false, "bob", false},
+		{"rejected is cached", basic("bob:wrong"), false, "bob", false},
+		{"empty", "", false, "", false},
+	}
+	for _, tt := range tests {
+		h.cfg.Credentials = users
+		if tt.change {
+			h.cfg.Credentials = nobody
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if len(tt.header) != 0 {
+			req.Header.Set("Proxy-Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		user, ok := h.authenticate(w, req)
+		if user != tt.user || ok != tt.ok {
+			t.Errorf("%s: authenticate = %q, %v, want %q, %v", tt.name, user, ok, tt.user, tt.ok)
+		}
+		if !ok && w.Code != http.StatusProxyAuthRequired {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, http.StatusProxyAuthRequired)
+		}
+	}
+}
+
+// addrConn is a conn of fixed local addr, only LocalAddr is used
+type addrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func TestIsLocal(t *testing.T) {
+	h := &handler{
+		cfg: &config.ServerConf{SNI: "*"},
+		info: &conninfo.Info{
+			SNI:    "a.example.com",
+			Routed: func(host string) bool { return host == "b.example.com" },
+		},
+		conn: &addrConn{local: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}},
+	}
+	tests := []struct {
+		name   string
+		proto  int
+		target string
+		host   string
+		want   bool
+	}{
+		{"origin form", 1, "/index.html", "other.example.org", true},
+		{"absolute form of other host", 1, "http://other.example.org/", "other.example.org", false},
+		{"absolute form of sni", 1, "http://A.example.com:8080/", "a.example.com", true},
+		{"absolute form of routed host", 1, "http://b.example.com/", "b.example.com", true},
+		{"absolute form of conn ip", 1, "http://192.0.2.1/", "192.0.2.1", true},
+		{"absolute form of other ip", 1, "http://[2001:db8::1]:80/", "[2001:db8::1]:80", false},
+		{"h2 authority of sni", 2, "/", "a.example.com", true},
+		{"h2 authority of other host", 2, "/", "other.example.org", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		req.Host = tt.host
+		req.ProtoMajor = tt.proto
+		if tt.proto == 2 {
+			req.URL.Host = ""
+		}
+		if got := h.isLocal(req); got != tt.want {
+			t.Errorf("%s: isLocal = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package https
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// connListener serves one conn to http.Server, Accept blocks after it until the conn is closed,
+// so Serve returns only when the conn is done, including hijacked ones
+type connListener struct {
+	conn *closeNotifyConn
+	ch   chan net.Conn
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{
+		conn: &closeNotifyConn{Conn: conn, done: make(chan struct{})},
+		ch:   make(chan net.Conn, 1),
+	}
+	l.ch <- l.conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.conn.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,147 @@
+package https
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/proxyproto"
+	"github.com/pkg/errors"
+)
+
+var dialTimeout = 10 * time.Second
+
+// reverseRoute is backend of a path prefix
+type reverseRoute struct {
+	prefix string
+	conf   config.ReverseProxyConf
+}
+
+// reverseRoutes sorts reverse proxy paths by length, so the longest prefix matches first,
+// Addr of route serves paths not matched by others
+func reverseRoutes(cfg *config.ServerConf) []reverseRoute {
+	routes := make([]reverseRoute, 0, len(cfg.ReverseProxy)+1)
+	for prefix, v := range cfg.ReverseProxy {
+		routes = append(routes, reverseRoute{prefix: prefix, conf: v})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if len(routes[i].prefix) != len(routes[j].prefix) {
+			return len(routes[i].prefix) > len(routes[j].prefix)
+		}
+		return routes[i].prefix < routes[j].prefix
+	})
+	if len(cfg.Addr) != 0 {
+		routes = append(routes, reverseRoute{prefix: "/", conf: config.ReverseProxyConf{Addr: cfg.Addr}})
+	}
+	return routes
+}
+
+// matchPrefix reports whether path is prefix or under it, e.g. /api matches /api and /api/v1 but not /apix
+func matchPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func stripPrefix(path, prefix string) string {
+	path = strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/"))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// newReverseProxy proxies requests to backends of routes, backend conns are kept alive for reuse by the client conn,
+// and start with a PROXY protocol header of the client conn if it's enabled, h2c backends are talked to by a separate proxy
+func (h *handler) newReverseProxy(h2c bool) (*httputil.ReverseProxy, *http.Transport) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if h.cfg.ProxyProtocol != 0 {
+				if err := proxyproto.WriteHeader(conn, h.cfg.ProxyProtocol, h.conn.RemoteAddr(), h.conn.LocalAddr(), h.info.SNI); err != nil {
+					conn.Close()
+					return nil, errors.Wrap(err, "proxyproto.WriteHeader")
+				}
+			}
+			return conn, nil
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if h2c {
+		enableH2C(transport)
+	}
+	return &httputil.ReverseProxy{
+		Director:  h.direct,
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			h.logEntry.WithField("DST", req.URL.Host).Errorf("reverse proxy %s: %s", req.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		// stream responses like server-sent events and gRPC without buffering
+		FlushInterval: -1,
+	}, transport
+}
+
+// direct rewrites request to backend of route matched by serveReverse
+func (h *handler) direct(req *http.Request) {
+	route := req.Context().Value(routeKey{}).(*reverseRoute)
+	req.URL.Scheme = "http"
+	req.URL.Host = route.conf.Addr
+	if route.conf.StripPrefix {
+		req.URL.Path = stripPrefix(req.URL.Path, route.prefix)
+		if len(req.URL.RawPath) != 0 {
+			req.URL.RawPath = stripPrefix(req.URL.RawPath, route.prefix)
+		}
+	}
+	remoteIP := stripPort(h.conn.RemoteAddr().String())
+	req.Header.Set("X-Real-IP", remoteIP)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	if len(route.conf.Host) != 0 {
+		req.Host = route.conf.Host
+	}
+	// client ip is appended by ReverseProxy, so values sent by client are dropped
+	req.Header.Del("X-Forwarded-For")
+}
+
+type routeKey struct{}
+
+// serveReverse proxies req to backend of the longest matched path prefix
+func (h *handler) serveReverse(w http.ResponseWriter, req *http.Request) {
+	var route *reverseRoute
+	for i := range h.routes {
+		if matchPrefix(req.URL.Path, h.routes[i].prefix) {
+			route = &h.routes[i]
+			break
+		}
+	}
+	logEntry := h.logEntry.WithField("DST", req.Host)
+	if route == nil {
+		logEntry.Errorf("no reverse proxy path: %s", req.URL.Path)
+		http.NotFound(w, req)
+		return
+	}
+	if err := h.info.Clone().Allow(); err != nil {
+		logEntry.Errorf("info.Allow: %s", err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	logEntry.WithField("DST", route.conf.Addr).Debugf("reverse proxy %s %s", req.Method, req.URL.Path)
+	ctx := context.WithValue(req.Context(), routeKey{}, route)
+	if route.conf.H2C {
+		h.h2cProxy.ServeHTTP(w, req.WithContext(ctx))
+		return
+	}
+	h.reverseProxy.ServeHTTP(w, req.WithContext(ctx))
+}
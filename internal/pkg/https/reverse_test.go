@@ -0,0 +1,194 @@
+package https
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+)
+
+func TestMatchPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+	}{
+		{"/api", "/api", true},
+		{"/api/v1", "/api", true},
+		{"/apix", "/api", false},
+		{"/api/v1", "/api/", true},
+		{"/", "/", true},
+		{"/web", "/", true},
+	}
+	for _, tt := range tests {
+		if got := matchPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("matchPrefix(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   string
+	}{
+		{"/api", "/api", "/"},
+		{"/api/v1", "/api", "/v1"},
+		{"/api/v1", "/api/", "/v1"},
+	}
+	for _, tt := range tests {
+		if got := stripPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("stripPrefix(%q, %q) = %q, want %q", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	web := backend(t, "web")
+	api := backend(t, "api")
+	v2 := backend(t, "v2")
+	cfg := &config.ServerConf{
+		SNI:  "a.test",
+		Addr: hostOf(web),
+		ReverseProxy: map[string]config.ReverseProxyConf{
+			"/api":    {Addr: hostOf(api), StripPrefix: true, Host: "api.internal"},
+			"/api/v2": {Addr: hostOf(v2)},
+		},
+	}
+	addr := serveProxy(t, cfg, "a.test")
+	client := dialClient(t, addr)
+	tests := []struct {
+		name    string
+		path    string
+		backend string
+		host    string
+		target  string
+	}{
+		{"default", "/index.html?a=1", "web", "a.test", "/index.html?a=1"},
+		{"prefix", "/api/users?id=1", "api", "api.internal", "/users?id=1"},
+		{"longest prefix", "/api/v2/users", "v2", "a.test", "/api/v2/users"},
+		{"not a prefix", "/apix", "web", "a.test", "/apix"},
+	}
+	for i, tt := range tests {
+		// requests of every path are served on one client conn
+		reused := true
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		req := newRequest(t, http.MethodGet, "http://a.test"+tt.path)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		req.Header.Set("X-Forwarded-For", "203.0.113.1")
+		resp, got := get(t, client, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d", tt.name, resp.StatusCode)
+		}
+		if i != 0 && !reused {
+			t.Errorf("%s: client conn is not reused", tt.name)
+		}
+		if got.Name != tt.backend || got.Host != tt.host || got.Path != tt.target {
+			t.Errorf("%s: backend got %s host %s path %s", tt.name, got.Name, got.Host, got.Path)
+		}
+		// forwarded headers are set by proxy, values sent by client are dropped
+		for k, v := range map[string]string{
+			"X-Forwarded-For":   "127.0.0.1",
+			"X-Real-Ip":         "127.0.0.1",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "a.test",
+		} {
+			if got := got.Header.Get(k); got != v {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, got, v)
+			}
+		}
+	}
+}
+
+func TestReverseProxyChunked(t *testing.T) {
+	web := backend(t, "web")
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test", Addr: hostOf(web)}, "a.test")
+	body := strings.Repeat("chunk", 1000)
+	// unknown length is sent chunked
+	req, err := http.NewRequest(http.MethodPost, "http://a.test/upload", io.MultiReader(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, got := get(t, dialClient(t, addr), req)
+	if resp.StatusCode != http.StatusOK || got.Body != body {
+		t.Errorf("status = %d, backend got %d bytes", resp.StatusCode, len(got.Body))
+	}
+}
+
+func TestReverseProxyUpgrade(t *testing.T) {
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	t.Cleanup(ws.Close)
+	addr := serveProxy(t, &config.ServerConf{SNI: "a.test", ReverseProxy: map[string]config.ReverseProxyConf{"/ws": {Addr: hostOf(ws)}}}, "a.test")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: a.test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Fatalf("echo = %q %v", b, err)
+	}
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	web := backend(t, "web")
+	addr := serveProxy(t, &config.ServerConf{
+		SNI: "a.test",
+		ReverseProxy: map[string]config.ReverseProxyConf{
+			"/web":  {Addr: hostOf(web)},
+			"/down": {Addr: "127.0.0.1:1"},
+		},
+	}, "a.test")
+	client := dialClient(t, addr)
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/web", http.StatusOK},
+		// no Addr serves other paths
+		{"/other", http.StatusNotFound},
+		{"/down", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		resp, _ := get(t, client, newRequest(t, http.MethodGet, "http://a.test"+tt.path))
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package https
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+	"github.com/mikumaycry/akari/internal/pkg/resolver"
+	log "github.com/sirupsen/logrus"
+)
+
+// serveProxy serves conns of a local listener by HandleConn as decrypted conns of route sni
+func serveProxy(t *testing.T, cfg *config.ServerConf, sni string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	logEntry := log.NewEntry(log.StandardLogger())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				HandleConn(conn, cfg, &conninfo.Info{SNI: sni, Route: cfg.SNI}, logEntry)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialClient sends every request in origin form to addr, so they are served by the route itself
+func dialClient(t *testing.T, addr string) *http.Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+// echoRequest is a request seen by backend
+type echoRequest struct {
+	Name   string
+	Proto  int
+	Host   string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+// echoHandler replies requests as echoRequest in json
+func echoHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(echoRequest{
+			Name:   name,
+			Proto:  req.ProtoMajor,
+			Host:   req.Host,
+			Path:   req.URL.RequestURI(),
+			Header: req.Header,
+			Body:   string(body),
+		})
+	})
+}
+
+func backend(t *testing.T, name string) *httptest.Server {
+	srv := httptest.NewServer(echoHandler(name))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func hostOf(srv *httptest.Server) string {
+	return srv.Listener.Addr().String()
+}
+
+// get sends req by client and decodes echoRequest of backend
+func get(t *testing.T, client *http.Client, req *http.Request) (*http.Response, echoRequest) {
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got echoRequest
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp, got
+}
+
+func newRequest(t *testing.T, method, target string) *http.Request {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// proxyClient sends requests in absolute form to http/1 proxy addr
+func proxyClient(t *testing.T, addr string, user *url.Userinfo) *http.Client {
+	transport := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr, User: user})}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+// allowPrivate returns a policy allowing private networks, origin.test and other.test are resolved to 127.0.0.1,
+// so forwarded requests are not sent to the ip of client conn
+func allowPrivate(t *testing.T) *acl.Policy {
+	res, err := resolver.New(&resolver.Conf{Hosts: []string{"127.0.0.1 origin.test other.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := acl.New(&acl.Conf{AllowPrivate: true}, res, resolver.PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// originURL returns url of srv by name
+func originURL(srv *httptest.Server, name, path string) string {
+	return "http://" + originHost(srv, name) + path
+}
+
+func originHost(srv *httptest.Server, name string) string {
+	return name + ":" + strconv.Itoa(srv.Listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestHandleConnClose(t *testing.T) {
+	web := backend(t, "web")
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConn(c2, &config.ServerConf{SNI: "a.test", Addr: hostOf(web)}, &conninfo.Info{SNI: "a.test"}, log.NewEntry(log.StandardLogger()))
+	}()
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c1.Write([]byte("GET / HTTP/1.1\r\nHost: a.test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d", resp.StatusCode)
+	}
+	// kept alive conn is served until client closes it
+	select {
+	case <-done:
+		t.Fatal("HandleConn returned before conn is closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c1.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleConn blocked after conn is closed")
+	}
+}
@@ -47,6 +47,16 @@ func (conn *Conn) NumStreams() int {
 	return 0
 }
 
+// Close closes the underlying session and all streams on it
+func (conn *Conn) Close() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.session != nil {
+		return conn.session.Close()
+	}
+	return nil
+}
+
 // OpenStream warps session's openStream with retry
 func (conn *Conn) OpenStream() (*smux.Stream, error) {
 	conn.mu.Lock()
@@ -103,3 +113,11 @@ func (p *Pool) GetStream() (*smux.Stream, error) {
 	}
 	return nil, errors.New("mux conns run out")
 }
+
+// Close closes all conns in pool
+func (p *Pool) Close() error {
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	return nil
+}
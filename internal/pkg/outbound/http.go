@@ -0,0 +1,74 @@
+package outbound
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpDialer connects through upstream http proxy with CONNECT
+type httpDialer struct {
+	addr     string
+	auth     string
+	forward  func(network, addr string) (net.Conn, error)
+	localDNS bool
+}
+
+func (d *httpDialer) remote() bool {
+	return !d.localDNS
+}
+
+func (d *httpDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.Errorf("unsupported network: %s", network)
+	}
+	conn, err := d.forward("tcp", d.addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "forward")
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	br, err := d.connect(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "connect")
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func (d *httpDialer) connect(conn net.Conn, addr string) (*bufio.Reader, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if len(d.auth) != 0 {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(d.auth)) + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, errors.Wrap(err, "write request")
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, errors.Wrap(err, "http.ReadResponse")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status: %s", resp.Status)
+	}
+	return br, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,166 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/pkg/resolver"
+	"github.com/mikumaycry/akari/internal/utils"
+	"github.com/pkg/errors"
+)
+
+var (
+	dialTimeout      = 10 * time.Second
+	handshakeTimeout = 10 * time.Second
+)
+
+// Dialer dials dst addr for client conns
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// Conf defines a named outbound dialer
+type Conf struct {
+	Name string `mapstructure:"name"`
+	// Type is direct, socks5, http or akari
+	Type string `mapstructure:"type"`
+	// Addr is address of upstream proxy
+	Addr string `mapstructure:"addr"`
+	// Auth is user:password of upstream proxy
+	Auth string `mapstructure:"auth"`
+	// TLS dials http upstream over TLS, akari upstream always uses TLS
+	TLS        bool   `mapstructure:"tls"`
+	SNI        string `mapstructure:"sni"`
+	CACert     string `mapstructure:"caCert"`
+	ClientCert string `mapstructure:"clientCert"`
+	ClientKey  string `mapstructure:"clientKey"`
+	// LocalDNS resolves dst on this host and sends ips to upstream, names are resolved by upstream by default
+	LocalDNS bool `mapstructure:"localDNS"`
+}
+
+// Remote reports whether d sends names of dst to an upstream proxy instead of resolving them on this host
+func Remote(d Dialer) bool {
+	r, ok := d.(interface{ remote() bool })
+	return ok && r.remote()
+}
+
+// IsDirect reports whether d dials from this host, nil dialer dials directly
+func IsDirect(d Dialer) bool {
+	if d == nil {
+		return true
+	}
+	_, ok := d.(*direct)
+	return ok
+}
+
+// Direct dials dst addr from this host, names are looked up by the system resolver
+var Direct Dialer = &direct{dialer: net.Dialer{Timeout: dialTimeout}}
+
+type direct struct {
+	dialer   net.Dialer
+	resolver *resolver.Resolver
+	prefer   resolver.Preference
+}
+
+func (d *direct) Dial(network, addr string) (net.Conn, error) {
+	if d.resolver == nil {
+		return d.dialer.Dial(network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.SplitHostPort")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	ips, err := d.resolver.LookupIP(ctx, host, d.prefer)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolver.LookupIP")
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = d.dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// New builds dialers keyed by name, direct is always available, names of dst and upstreams are looked up by res
+func New(confs []Conf, res *resolver.Resolver) (map[string]Dialer, error) {
+	direct := &direct{dialer: net.Dialer{Timeout: dialTimeout}, resolver: res, prefer: resolver.PreferIPv4}
+	dialers := map[string]Dialer{"direct": direct}
+	for _, v := range confs {
+		if len(v.Name) == 0 {
+			return nil, errors.New("empty outbound name")
+		}
+		if _, ok := dialers[v.Name]; ok {
+			return nil, errors.Errorf("duplicate outbound: %s", v.Name)
+		}
+		d, err := newDialer(v, direct)
+		if err != nil {
+			return nil, errors.Wrapf(err, "outbound %s", v.Name)
+		}
+		dialers[v.Name] = d
+	}
+	return dialers, nil
+}
+
+// WithPreference returns dialers whose direct dialer orders ips of dst by prefer, upstream proxies are kept as is
+func WithPreference(dialers map[string]Dialer, prefer resolver.Preference) map[string]Dialer {
+	m := make(map[string]Dialer, len(dialers))
+	for k, v := range dialers {
+		if d, ok := v.(*direct); ok && d.prefer != prefer {
+			c := *d
+			c.prefer = prefer
+			v = &c
+		}
+		m[k] = v
+	}
+	return m
+}
+
+func newDialer(v Conf, direct Dialer) (Dialer, error) {
+	if v.Type == "direct" {
+		return direct, nil
+	}
+	if len(v.Addr) == 0 {
+		return nil, errors.New("empty addr")
+	}
+	forward := direct.Dial
+	if v.TLS || v.Type == "akari" {
+		tlsConfig, err := utils.NewTLSConfig(v.CACert, v.ClientCert, v.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "utils.NewTLSConfig")
+		}
+		tlsConfig.ServerName = v.SNI
+		if len(tlsConfig.ServerName) == 0 {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(v.Addr)
+		}
+		tlsConfig.MinVersion = tls.VersionTLS12
+		forward = func(network, addr string) (net.Conn, error) {
+			conn, err := direct.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, errors.Wrap(err, "tlsConn.Handshake")
+			}
+			tlsConn.SetDeadline(time.Time{})
+			return tlsConn, nil
+		}
+	}
+	switch v.Type {
+	case "socks5", "akari":
+		// akari upstream is a socks5 route of another server
+		return &socks5Dialer{addr: v.Addr, auth: v.Auth, forward: forward, localDNS: v.LocalDNS}, nil
+	case "http":
+		return &httpDialer{addr: v.Addr, auth: v.Auth, forward: forward, localDNS: v.LocalDNS}, nil
+	}
+	return nil, errors.Errorf("invalid type: %s", v.Type)
+}
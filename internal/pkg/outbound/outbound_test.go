@@ -0,0 +1,350 @@
+package outbound
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// upstream is a fake proxy, dst of each request is sent to reqs and conns are echoed after handshake
+type upstream struct {
+	addr string
+	reqs chan string
+}
+
+func listenUpstream(t *testing.T, tlsConfig *tls.Config, serve func(conn net.Conn) (string, bool)) *upstream {
+	var ln net.Listener
+	var err error
+	if tlsConfig != nil {
+		ln, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	u := &upstream{addr: ln.Addr().String(), reqs: make(chan string, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				dst, ok := serve(conn)
+				u.reqs <- dst
+				if ok {
+					io.Copy(conn, conn)
+				}
+			}()
+		}
+	}()
+	return u
+}
+
+// serveSocks5 replies rep to connect of dst, auth is user:password required from client if not empty
+func serveSocks5(auth string, rep byte) func(conn net.Conn) (string, bool) {
+	return func(conn net.Conn) (string, bool) {
+		b := make([]byte, 262)
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return "", false
+		}
+		methods := make([]byte, b[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return "", false
+		}
+		method := byte(0x00)
+		if len(auth) != 0 {
+			method = 0x02
+		}
+		if methods[0] != method {
+			conn.Write([]byte{0x05, 0xff})
+			return "", false
+		}
+		conn.Write([]byte{0x05, method})
+		if method == 0x02 {
+			io.ReadFull(conn, b[:2])
+			user := make([]byte, b[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, b[:1])
+			password := make([]byte, b[0])
+			io.ReadFull(conn, password)
+			if string(user)+":"+string(password) != auth {
+				conn.Write([]byte{0x01, 0x01})
+				return "auth failed", false
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+		if _, err := io.ReadFull(conn, b[:4]); err != nil {
+			return "", false
+		}
+		var host string
+		switch b[3] {
+		case 0x01:
+			io.ReadFull(conn, b[:net.IPv4len])
+			host = "ipv4 " + net.IP(b[:net.IPv4len]).String()
+		case 0x03:
+			io.ReadFull(conn, b[:1])
+			name := make([]byte, b[0])
+			io.ReadFull(conn, name)
+			host = "domain " + string(name)
+		case 0x04:
+			io.ReadFull(conn, b[:net.IPv6len])
+			host = "ipv6 " + net.IP(b[:net.IPv6len]).String()
+		}
+		io.ReadFull(conn, b[:2])
+		dst := host + " " + strconv.Itoa(int(binary.BigEndian.Uint16(b[:2])))
+		// bnd is a domain, which is skipped by client
+		conn.Write([]byte{0x05, rep, 0x00, 0x03, 3, 'b', 'n', 'd', 0, 1})
+		return dst, rep == 0x00
+	}
+}
+
+// serveHTTP replies status to CONNECT, auth is user:password required from client if not empty,
+// early is written after response in the same packet
+func serveHTTP(auth string, status int, early string) func(conn net.Conn) (string, bool) {
+	return func(conn net.Conn) (string, bool) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return "", false
+		}
+		if len(auth) != 0 && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			status = http.StatusProxyAuthRequired
+		}
+		conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n\r\n" + early))
+		return req.Method + " " + req.Host, status == http.StatusOK
+	}
+}
+
+func echo(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("echo = %q %v", b, err)
+	}
+}
+
+func TestSocks5Dialer(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   string
+		server string
+		rep    byte
+		addr   string
+		dst    string
+		err    bool
+	}{
+		{"domain", "", "", 0x00, "a.test:80", "domain a.test 80", false},
+		{"ipv4", "", "", 0x00, "1.2.3.4:443", "ipv4 1.2.3.4 443", false},
+		{"ipv6", "", "", 0x00, "[2001:db8::1]:8080", "ipv6 2001:db8::1 8080", false},
+		{"auth", "u:p", "u:p", 0x00, "a.test:80", "domain a.test 80", false},
+		{"auth failed", "u:x", "u:p", 0x00, "a.test:80", "auth failed", true},
+		{"no auth", "", "u:p", 0x00, "a.test:80", "", true},
+		{"refused", "", "", 0x05, "a.test:80", "domain a.test 80", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := listenUpstream(t, nil, serveSocks5(tt.server, tt.rep))
+			dialers, err := New([]Conf{{Name: "up", Type: "socks5", Addr: u.addr, Auth: tt.auth}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialers["up"].Dial("tcp", tt.addr)
+			if dst := <-u.reqs; dst != tt.dst {
+				t.Errorf("upstream got %q, want %q", dst, tt.dst)
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("Dial() error = %v, want error %v", err, tt.err)
+			}
+			if err == nil {
+				defer conn.Close()
+				echo(t, conn)
+			}
+		})
+	}
+}
+
+func TestHTTPDialer(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   string
+		server string
+		status int
+		early  string
+		dst    string
+		err    bool
+	}{
+		{"connect", "", "", http.StatusOK, "", "CONNECT a.test:443", false},
+		{"auth", "u:p", "u:p", http.StatusOK, "", "CONNECT a.test:443", false},
+		{"auth failed", "u:x", "u:p", http.StatusOK, "", "CONNECT a.test:443", true},
+		{"forbidden", "", "", http.StatusForbidden, "", "CONNECT a.test:443", true},
+		// bytes of dst sent right after response are kept
+		{"early data", "", "", http.StatusOK, "hi", "CONNECT a.test:443", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := listenUpstream(t, nil, serveHTTP(tt.server, tt.status, tt.early))
+			dialers, err := New([]Conf{{Name: "up", Type: "http", Addr: u.addr, Auth: tt.auth}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialers["up"].Dial("tcp", "a.test:443")
+			if dst := <-u.reqs; dst != tt.dst {
+				t.Errorf("upstream got %q, want %q", dst, tt.dst)
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("Dial() error = %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if len(tt.early) != 0 {
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				b := make([]byte, len(tt.early))
+				if _, err := io.ReadFull(conn, b); err != nil || string(b) != tt.early {
+					t.Fatalf("early data = %q %v", b, err)
+				}
+			}
+			echo(t, conn)
+		})
+	}
+}
+
+// selfSigned returns a tls cert of 127.0.0.1 and the path of its pem
+func selfSigned(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "akari.test"},
+		DNSNames:              []string{"akari.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, name
+}
+
+func TestAkariDialer(t *testing.T) {
+	cert, ca := selfSigned(t)
+	var sni string
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = h.ServerName
+			return nil, nil
+		},
+	}
+	u := listenUpstream(t, tlsConfig, serveSocks5("u:p", 0x00))
+	dialers, err := New([]Conf{
+		{Name: "akari", Type: "akari", Addr: u.addr, Auth: "u:p", SNI: "akari.test", CACert: ca},
+		{Name: "untrusted", Type: "akari", Addr: u.addr, SNI: "akari.test"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialers["akari"].Dial("tcp", "a.test:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if dst := <-u.reqs; dst != "domain a.test 22" {
+		t.Errorf("upstream got %q", dst)
+	}
+	if sni != "akari.test" {
+		t.Errorf("sni = %q, want akari.test", sni)
+	}
+	echo(t, conn)
+	if _, err := dialers["untrusted"].Dial("tcp", "a.test:22"); err == nil {
+		t.Error("Dial() of untrusted upstream succeeded")
+	}
+}
+
+func TestRemote(t *testing.T) {
+	dialers, err := New([]Conf{
+		{Name: "socks5", Type: "socks5", Addr: "127.0.0.1:1080"},
+		{Name: "socks5-local", Type: "socks5", Addr: "127.0.0.1:1080", LocalDNS: true},
+		{Name: "http", Type: "http", Addr: "127.0.0.1:8080"},
+		{Name: "http-local", Type: "http", Addr: "127.0.0.1:8080", LocalDNS: true},
+		{Name: "akari", Type: "akari", Addr: "127.0.0.1:443"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"direct":       false,
+		"socks5":       true,
+		"socks5-local": false,
+		"http":         true,
+		"http-local":   false,
+		"akari":        true,
+	} {
+		if got := Remote(dialers[name]); got != want {
+			t.Errorf("Remote(%s) = %v, want %v", name, got, want)
+		}
+		if got := IsDirect(dialers[name]); got != (name == "direct") {
+			t.Errorf("IsDirect(%s) = %v", name, got)
+		}
+	}
+	if !IsDirect(nil) || Remote(nil) {
+		t.Error("nil dialer is not direct")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		confs []Conf
+	}{
+		{"empty name", []Conf{{Type: "socks5", Addr: "127.0.0.1:1080"}}},
+		{"duplicate", []Conf{{Name: "a", Type: "socks5", Addr: "127.0.0.1:1080"}, {Name: "a", Type: "http", Addr: "127.0.0.1:8080"}}},
+		{"direct name", []Conf{{Name: "direct", Type: "socks5", Addr: "127.0.0.1:1080"}}},
+		{"empty addr", []Conf{{Name: "a", Type: "socks5"}}},
+		{"type", []Conf{{Name: "a", Type: "ftp", Addr: "127.0.0.1:21"}}},
+		{"client cert", []Conf{{Name: "a", Type: "akari", Addr: "127.0.0.1:443", ClientCert: "missing.pem", ClientKey: "missing.key"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.confs, nil); err == nil {
+				t.Error("New() succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package outbound
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// socks5Dialer connects through upstream socks5 proxy
+type socks5Dialer struct {
+	addr     string
+	auth     string
+	forward  func(network, addr string) (net.Conn, error)
+	localDNS bool
+}
+
+func (d *socks5Dialer) remote() bool {
+	return !d.localDNS
+}
+
+func (d *socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.Errorf("unsupported network: %s", network)
+	}
+	conn, err := d.forward("tcp", d.addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "forward")
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := d.handshake(conn, addr); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "handshake")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "net.SplitHostPort")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.Wrap(err, "strconv.Atoi port")
+	}
+	method := byte(0x00)
+	if len(d.auth) != 0 {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return errors.Wrap(err, "write method")
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return errors.Wrap(err, "read method")
+	}
+	if buf[0] != 0x05 || buf[1] != method {
+		return errors.Errorf("unexpected method: %0x", buf[1])
+	}
+	if method == 0x02 {
+		idx := strings.IndexByte(d.auth, ':')
+		if idx < 0 {
+			return errors.New("invalid auth, user:password format is required")
+		}
+		user, password := d.auth[:idx], d.auth[idx+1:]
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("auth too long")
+		}
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return errors.Wrap(err, "write auth")
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return errors.Wrap(err, "read auth status")
+		}
+		if buf[1] != 0x00 {
+			return errors.New("auth failed")
+		}
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host too long")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ipv4 := ip.To4(); ipv4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ipv4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return errors.Wrap(err, "write cmd")
+	}
+	rep := make([]byte, 4)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		return errors.Wrap(err, "read cmd reply")
+	}
+	if rep[1] != 0x00 {
+		return errors.Errorf("connect failed: reply %0x", rep[1])
+	}
+	var n int
+	switch rep[3] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x03:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return errors.Wrap(err, "read bnd length")
+		}
+		n = int(buf[0])
+	case 0x04:
+		n = net.IPv6len
+	default:
+		return errors.Errorf("unsupported address type: %0x", rep[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, n+2)); err != nil {
+		return errors.Wrap(err, "read bnd")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxV1Len      = 107
+	verCmdV2Local = 0x20
+)
+
+// Conn replaces addresses of the underlying conn with addresses in PROXY protocol header
+type Conn struct {
+	net.Conn
+	r     io.Reader
+	src   net.Addr
+	dst   net.Addr
+	proxy net.Addr
+}
+
+// NewConn reads PROXY protocol header of version 1 or 2 from conn within timeout
+func NewConn(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, errors.Wrap(err, "conn.SetReadDeadline")
+	}
+	br := bufio.NewReaderSize(conn, 256)
+	src, dst, err := readHeader(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "readHeader")
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, errors.Wrap(err, "conn.SetReadDeadline")
+	}
+	c := &Conn{
+		Conn:  conn,
+		r:     br,
+		src:   conn.RemoteAddr(),
+		dst:   conn.LocalAddr(),
+		proxy: conn.RemoteAddr(),
+	}
+	if src != nil && dst != nil {
+		c.src, c.dst = src, dst
+	}
+	return c, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns client address in header
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.src
+}
+
+// LocalAddr returns destination address in header
+func (c *Conn) LocalAddr() net.Addr {
+	return c.dst
+}
+
+// ProxyAddr returns address of the proxy sending header
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.proxy
+}
+
+// readHeader returns nil addresses for LOCAL command, UNKNOWN and non-TCP families
+func readHeader(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	b, err := br.Peek(len(sigV2))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "br.Peek")
+	}
+	if bytes.Equal(b, sigV2) {
+		return readHeaderV2(br)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readHeaderV1(br)
+	}
+	return nil, nil, errors.New("invalid header")
+}
+
+func readHeaderV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Len {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "br.ReadByte")
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.Errorf("invalid v1 header: %q", line)
+	}
+	src, err := parseTCPAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse src")
+	}
+	dst, err := parseTCPAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse dst")
+	}
+	return src, dst, nil
+}
+
+func parseTCPAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.Errorf("invalid ip: %s", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Wrap(err, "strconv.ParseUint")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readHeaderV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(sigV2)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, errors.Wrap(err, "read v2 header")
+	}
+	verCmd, fam := header[len(sigV2)], header[len(sigV2)+1]
+	body := make([]byte, binary.BigEndian.Uint16(header[len(sigV2)+2:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, errors.Wrap(err, "read v2 body")
+	}
+	switch verCmd {
+	case verCmdV2Local:
+		return nil, nil, nil
+	case verCmdV2Proxy:
+	default:
+		return nil, nil, errors.Errorf("invalid v2 version and command: %0x", verCmd)
+	}
+	var ipLen int
+	switch fam {
+	case famTCP4:
+		ipLen = net.IPv4len
+	case famTCP6:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < ipLen*2+4 {
+		return nil, nil, errors.New("v2 body too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[ipLen*2:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(body[ipLen : ipLen*2]),
+		Port: int(binary.BigEndian.Uint16(body[ipLen*2+2:])),
+	}
+	return src, dst, nil
+}
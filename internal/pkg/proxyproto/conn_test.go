@@ -0,0 +1,89 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestConn(t *testing.T, data []byte) (*Conn, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	return NewConn(server, time.Second)
+}
+
+func TestNewConn(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.2").To4(), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	header := func(version int, src, dst net.Addr, authority string) []byte {
+		var buf bytes.Buffer
+		if err := WriteHeader(&buf, version, src, dst, authority); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	v2 := func(verCmd, fam byte, body ...byte) []byte {
+		b := append(append([]byte{}, sigV2...), verCmd, fam, byte(len(body)>>8), byte(len(body)))
+		return append(b, body...)
+	}
+	tests := []struct {
+		name     string
+		header   []byte
+		src, dst string
+		ok       bool
+	}{
+		{"v1 tcp4", header(1, src, dst, ""), "192.0.2.1:1234", "198.51.100.2:443", true},
+		{"v1 tcp6", header(1, src6, dst6, ""), "[2001:db8::1]:1234", "[2001:db8::2]:443", true},
+		{"v1 mixed families", header(1, src, dst6, ""), "192.0.2.1:1234", "[2001:db8::2]:443", true},
+		{"v1 unknown", []byte("PROXY UNKNOWN ff::1 ff::2 1 2\r\n"), "pipe", "pipe", true},
+		{"v2 tcp4", header(2, src, dst, ""), "192.0.2.1:1234", "198.51.100.2:443", true},
+		{"v2 tcp6 with authority", header(2, src6, dst6, "a.example.com"), "[2001:db8::1]:1234", "[2001:db8::2]:443", true},
+		{"v2 local", v2(verCmdV2Local, famTCP4, make([]byte, 12)...), "pipe", "pipe", true},
+		{"v2 unspec", v2(verCmdV2Proxy, famUnspec), "pipe", "pipe", true},
+		{"v1 bad ip", []byte("PROXY TCP4 192.0.2 198.51.100.2 1234 443\r\n"), "", "", false},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n"), "", "", false},
+		{"v1 bad proto", []byte("PROXY UDP4 192.0.2.1 198.51.100.2 1234 443\r\n"), "", "", false},
+		{"v1 missing field", []byte("PROXY TCP4 192.0.2.1 198.51.100.2 1234\r\n"), "", "", false},
+		{"v1 missing crlf", []byte("PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\n"), "", "", false},
+		{"v1 too long", append([]byte("PROXY "), bytes.Repeat([]byte("x"), maxV1Len)...), "", "", false},
+		{"v2 bad command", v2(0x22, famTCP4, make([]byte, 12)...), "", "", false},
+		{"v2 short body", v2(verCmdV2Proxy, famTCP4, make([]byte, 11)...), "", "", false},
+		{"v2 truncated", header(2, src, dst, "")[:20], "", "", false},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newTestConn(t, append(tt.header, "payload"...))
+			if (err == nil) != tt.ok {
+				t.Fatalf("NewConn error = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			if got := c.RemoteAddr().String(); got != tt.src {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.src)
+			}
+			if got := c.LocalAddr().String(); got != tt.dst {
+				t.Errorf("LocalAddr = %s, want %s", got, tt.dst)
+			}
+			if got := c.ProxyAddr().String(); got != "pipe" {
+				t.Errorf("ProxyAddr = %s, want pipe", got)
+			}
+			payload, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != "payload" {
+				t.Errorf("payload = %q, want %q", payload, "payload")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+var sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	verCmdV2Proxy = 0x21
+	famTCP4       = 0x11
+	famTCP6       = 0x21
+	famUnspec     = 0x00
+	// tlvTypeAuthority carries host name sent by client, e.g. SNI
+	tlvTypeAuthority = 0x02
+)
+
+// WriteHeader writes PROXY protocol header of version 1 or 2 to w,
+// authority is sent as a TLV in version 2 when not empty
+func WriteHeader(w io.Writer, version int, src, dst net.Addr, authority string) error {
+	var header []byte
+	switch version {
+	case 1:
+		header = headerV1(src, dst)
+	case 2:
+		b, err := headerV2(src, dst, authority)
+		if err != nil {
+			return errors.Wrap(err, "headerV2")
+		}
+		header = b
+	default:
+		return errors.Errorf("invalid version: %d", version)
+	}
+	if _, err := w.Write(header); err != nil {
+		return errors.Wrap(err, "write")
+	}
+	return nil
+}
+
+func tcpAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, nil, false
+	}
+	return s, d, true
+}
+
+func headerV1(src, dst net.Addr) []byte {
+	s, d, ok := tcpAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if srcIP, dstIP := s.IP.To4(), d.IP.To4(); srcIP != nil && dstIP != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, s.Port, d.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(s.IP), ipv6String(d.IP), s.Port, d.Port))
+}
+
+// ipv6String formats ipv4 as ipv4-mapped ipv6 address, TCP6 requires ipv6 syntax
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
+
+func headerV2(src, dst net.Addr, authority string) ([]byte, error) {
+	var body bytes.Buffer
+	fam := byte(famUnspec)
+	if s, d, ok := tcpAddrs(src, dst); ok {
+		srcIP, dstIP := s.IP.To4(), d.IP.To4()
+		fam = famTCP4
+		if srcIP == nil || dstIP == nil {
+			fam = famTCP6
+			srcIP, dstIP = s.IP.To16(), d.IP.To16()
+		}
+		body.Write(srcIP)
+		body.Write(dstIP)
+		binary.Write(&body, binary.BigEndian, uint16(s.Port))
+		binary.Write(&body, binary.BigEndian, uint16(d.Port))
+	}
+	if len(authority) != 0 {
+		if len(authority) > 0xffff {
+			return nil, errors.New("authority too large")
+		}
+		body.WriteByte(tlvTypeAuthority)
+		binary.Write(&body, binary.BigEndian, uint16(len(authority)))
+		body.WriteString(authority)
+	}
+	header := make([]byte, 0, len(sigV2)+4+body.Len())
+	header = append(header, sigV2...)
+	header = append(header, verCmdV2Proxy, fam, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(body.Len()))
+	return append(header, body.Bytes()...), nil
+}
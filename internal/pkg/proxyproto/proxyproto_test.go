@@ -0,0 +1,63 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWriteHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	unix := &net.UnixAddr{Name: "/tmp/akari.sock", Net: "unix"}
+	v2 := func(fam byte, body ...byte) []byte {
+		b := append(append([]byte{}, sigV2...), verCmdV2Proxy, fam, byte(len(body)>>8), byte(len(body)))
+		return append(b, body...)
+	}
+	addrs4 := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0x04, 0xd2, 0x01, 0xbb}
+	addrs6 := append(append(append([]byte{}, src6.IP...), dst6.IP...), 0x04, 0xd2, 0x01, 0xbb)
+	tests := []struct {
+		name      string
+		version   int
+		src, dst  net.Addr
+		authority string
+		want      []byte
+	}{
+		{"v1 tcp4", 1, src4, dst4, "a.example.com", []byte("PROXY TCP4 192.0.2.1 198.51.100.2 1234 443\r\n")},
+		{"v1 tcp6", 1, src6, dst6, "", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n")},
+		{"v1 mixed families", 1, src4, dst6, "", []byte("PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 1234 443\r\n")},
+		{"v1 unknown", 1, unix, dst4, "", []byte("PROXY UNKNOWN\r\n")},
+		{"v2 tcp4", 2, src4, dst4, "", v2(famTCP4, addrs4...)},
+		{"v2 tcp6", 2, src6, dst6, "", v2(famTCP6, addrs6...)},
+		{"v2 authority", 2, src4, dst4, "a.example.com", v2(famTCP4, append(addrs4, append([]byte{tlvTypeAuthority, 0, 13}, "a.example.com"...)...)...)},
+		{"v2 unspec", 2, unix, dst4, "", v2(famUnspec)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, tt.version, tt.src, tt.dst, tt.authority); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Fatalf("WriteHeader = %q, want %q", buf.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteHeaderInvalid(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443}
+	var buf bytes.Buffer
+	if err := WriteHeader(&buf, 3, src, dst, ""); err == nil {
+		t.Error("version 3 should fail")
+	}
+	if err := WriteHeader(&buf, 2, src, dst, string(make([]byte, 0x10000))); err == nil {
+		t.Error("too large authority should fail")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("nothing should be written, got %q", buf.Bytes())
+	}
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at rate tokens per second up to burst tokens
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket
+func NewBucket(rate, burst float64) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow takes one token if available
+func (b *Bucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reserve takes n tokens and returns the time to wait until they are refilled
+func (b *Bucket) Reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait takes n tokens of every bucket and sleeps for the longest wait
+func Wait(buckets []*Bucket, n int) {
+	var d time.Duration
+	for _, b := range buckets {
+		if w := b.Reserve(n); w > d {
+			d = w
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// refund gives back n tokens taken before
+func (b *Bucket) refund(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// AllowAll takes one token of every bucket, false is returned if any is empty,
+// then tokens taken from the others are refunded, so a denied user does not drain shared route buckets
+func AllowAll(buckets []*Bucket) bool {
+	for i, b := range buckets {
+		if !b.Allow() {
+			for _, v := range buckets[:i] {
+				v.refund(1)
+			}
+			return false
+		}
+	}
+	return true
+}
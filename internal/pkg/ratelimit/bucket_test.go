@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   float64
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"no time", 10, 20, 5, 0, 5},
+		{"partial", 10, 20, 5, 500 * time.Millisecond, 10},
+		{"capped by burst", 10, 20, 5, 10 * time.Second, 20},
+		{"debt is repaid", 10, 20, -15, time.Second, -5},
+		{"slow rate", 0.5, 1, 0, time.Second, 0.5},
+	}
+	for _, tt := range tests {
+		last := time.Now()
+		b := &Bucket{rate: tt.rate, burst: tt.burst, tokens: tt.tokens, last: last}
+		b.refill(last.Add(tt.elapsed))
+		if math.Abs(b.tokens-tt.want) > 1e-9 {
+			t.Errorf("%s: tokens = %g, want %g", tt.name, b.tokens, tt.want)
+		}
+	}
+}
+
+func TestBucketAllow(t *testing.T) {
+	tests := []struct {
+		name   string
+		burst  float64
+		allows int
+	}{
+		{"burst of one", 1, 1},
+		{"burst of three", 3, 3},
+		{"fraction", 2.5, 2},
+	}
+	for _, tt := range tests {
+		// refill is negligible at this rate
+		b := NewBucket(1e-6, tt.burst)
+		n := 0
+		for b.Allow() {
+			n++
+		}
+		if n != tt.allows {
+			t.Errorf("%s: allowed %d, want %d", tt.name, n, tt.allows)
+		}
+	}
+}
+
+func TestBucketReserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		n     []int
+		want  time.Duration
+	}{
+		{"within burst", 100, 100, []int{60, 40}, 0},
+		{"over burst", 100, 100, []int{150}, 500 * time.Millisecond},
+		{"debt accumulates", 100, 100, []int{150, 100}, 1500 * time.Millisecond},
+		{"small rate", 1, 1, []int{1, 1}, time.Second},
+	}
+	for _, tt := range tests {
+		b := NewBucket(tt.rate, tt.burst)
+		var got time.Duration
+		for _, n := range tt.n {
+			got = b.Reserve(n)
+		}
+		// refill between calls shortens the wait slightly
+		if got > tt.want || got < tt.want-50*time.Millisecond {
+			t.Errorf("%s: Reserve = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []float64
+		want   bool
+		left   []float64
+	}{
+		{"no buckets", nil, true, nil},
+		{"full", []float64{2}, true, []float64{1}},
+		{"all have tokens", []float64{2, 1}, true, []float64{1, 0}},
+		{"last is empty", []float64{2, 0.5}, false, []float64{2, 0.5}},
+		{"middle is empty", []float64{2, 0, 3}, false, []float64{2, 0, 3}},
+		{"first is empty", []float64{0, 3}, false, []float64{0, 3}},
+	}
+	for _, tt := range tests {
+		var buckets []*Bucket
+		for _, v := range tt.tokens {
+			// refill is negligible at this rate
+			b := NewBucket(1e-9, 3)
+			b.tokens = v
+			buckets = append(buckets, b)
+		}
+		if got := AllowAll(buckets); got != tt.want {
+			t.Errorf("%s: AllowAll = %v, want %v", tt.name, got, tt.want)
+		}
+		for i, b := range buckets {
+			if math.Abs(b.tokens-tt.left[i]) > 1e-6 {
+				t.Errorf("%s: bucket %d has %g tokens, want %g", tt.name, i, b.tokens, tt.left[i])
+			}
+		}
+	}
+}
+
+func TestRegistryGet(t *testing.T) {
+	r := NewRegistry()
+	tests := []struct {
+		name  string
+		key   string
+		rate  float64
+		burst float64
+	}{
+		{"rate", "route|a", 100, 100},
+		{"small rate gets burst of one", "route|b", 0.5, 1},
+	}
+	for _, tt := range tests {
+		b := r.Get(tt.key, tt.rate)
+		if b == nil || b.rate != tt.rate || b.burst != tt.burst {
+			t.Fatalf("%s: Get(%q, %g) = %+v", tt.name, tt.key, tt.rate, b)
+		}
+		if r.Get(tt.key, tt.rate) != b {
+			t.Errorf("%s: bucket of the same key and rate should be shared", tt.name)
+		}
+		if r.Get(tt.key, tt.rate*2) == b {
+			t.Errorf("%s: changed rate should get a new bucket", tt.name)
+		}
+	}
+	for _, rate := range []float64{0, -1} {
+		if b := r.Get("route|c", rate); b != nil {
+			t.Errorf("Get(%g) = %+v, want nil", rate, b)
+		}
+	}
+}
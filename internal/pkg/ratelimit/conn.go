@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+)
+
+// maxChunk splits large writes, so download is shaped smoothly
+const maxChunk = 16 * 1024
+
+// Buckets returns upload and download buckets of user
+type Buckets func(user string) (upload, download []*Bucket)
+
+// Conn limits bytes read from client by upload buckets and written to client by download buckets,
+// buckets are looked up again once handler sets user in info
+type Conn struct {
+	net.Conn
+	info     *conninfo.Info
+	buckets  Buckets
+	mu       sync.Mutex
+	resolved bool
+	user     string
+	upload   []*Bucket
+	download []*Bucket
+}
+
+// NewConn method
+func NewConn(conn net.Conn, info *conninfo.Info, buckets Buckets) net.Conn {
+	return &Conn{
+		Conn:    conn,
+		info:    info,
+		buckets: buckets,
+	}
+}
+
+func (c *Conn) get() (upload, download []*Bucket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if user := c.info.User(); !c.resolved || c.user != user {
+		c.resolved = true
+		c.user = user
+		c.upload, c.download = c.buckets(c.user)
+	}
+	return c.upload, c.download
+}
+
+// Read method
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		upload, _ := c.get()
+		Wait(upload, n)
+	}
+	return n, err
+}
+
+// Write method
+func (c *Conn) Write(b []byte) (int, error) {
+	_, download := c.get()
+	if len(download) == 0 {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		Wait(download, len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
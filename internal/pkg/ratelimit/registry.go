@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Registry keeps buckets shared by conns, buckets are keyed with their rate, so changed rates get new buckets
+type Registry struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// NewRegistry method
+func NewRegistry() *Registry {
+	return &Registry{buckets: make(map[string]*Bucket)}
+}
+
+// Get returns bucket of key, burst is one second of rate and at least one, nil is returned if rate is not positive
+func (r *Registry) Get(key string, rate float64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	k := fmt.Sprintf("%s|%g", key, rate)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[k]
+	if !ok {
+		burst := rate
+		if burst < 1 {
+			burst = 1
+		}
+		b = NewBucket(rate, burst)
+		r.buckets[k] = b
+	}
+	return b
+}
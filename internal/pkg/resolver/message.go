@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	typeA    = 1
+	typeAAAA = 28
+	typeOPT  = 41
+
+	rcodeNameError = 3
+
+	// udpSize is advertised by EDNS0 to avoid fragmentation
+	udpSize = 1232
+)
+
+// buildQuery builds a recursive query of name and qtype with an EDNS0 OPT record
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 12+len(name)+2+4+11)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// RD
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[10:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.Errorf("invalid name: %s", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, 1)
+	// OPT: root name, type, udp size as class, ttl and rdlength of zero
+	msg = append(msg, 0, 0, typeOPT, udpSize>>8, udpSize&0xff, 0, 0, 0, 0, 0, 0)
+	return msg, nil
+}
+
+// response is answer of a query
+type response struct {
+	id        uint16
+	truncated bool
+	rcode     int
+	ips       []net.IP
+	// ttl is the minimum ttl of ips
+	ttl uint32
+}
+
+// parseResponse extracts ips of qtype from answer section
+func parseResponse(msg []byte, qtype uint16) (*response, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("message too short")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, errors.New("not a response")
+	}
+	resp := &response{
+		id:        binary.BigEndian.Uint16(msg[0:]),
+		truncated: flags&0x0200 != 0,
+		rcode:     int(flags & 0x000f),
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		n, err := skipName(msg, off)
+		if err != nil {
+			return nil, errors.Wrap(err, "question")
+		}
+		off = n + 4
+	}
+	for i := 0; i < ancount; i++ {
+		n, err := skipName(msg, off)
+		if err != nil {
+			return nil, errors.Wrap(err, "answer")
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, errors.New("answer too short")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errors.New("rdata too short")
+		}
+		// CNAME and other records are skipped, their targets follow in the same answer section
+		if rtype == qtype && (rtype == typeA && rdlen == net.IPv4len || rtype == typeAAAA && rdlen == net.IPv6len) {
+			ip := make(net.IP, rdlen)
+			copy(ip, msg[off:off+rdlen])
+			resp.ips = append(resp.ips, ip)
+			if len(resp.ips) == 1 || ttl < resp.ttl {
+				resp.ttl = ttl
+			}
+		}
+		off += rdlen
+	}
+	return resp, nil
+}
+
+// skipName returns offset after the name starts at off
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("name too short")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			// compression pointer ends the name
+			return off + 2, nil
+		case n&0xc0 != 0:
+			return 0, errors.Errorf("invalid label: %0x", n)
+		}
+		off += 1 + n
+	}
+}
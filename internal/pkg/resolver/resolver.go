@@ -0,0 +1,337 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTimeout   = 5
+	defaultCacheSize = 4096
+	// ttl of cached answers is clamped into this range, negative answers use minTTL
+	minTTL = 30 * time.Second
+	maxTTL = time.Hour
+	// prefetchRatio of ttl left triggers a background refresh on hit
+	prefetchRatio = 10
+)
+
+// Conf defines upstreams and cache of resolver, system resolver is used without servers
+type Conf struct {
+	// Servers are tried in order, e.g. 1.1.1.1, tcp://1.1.1.1, tls://1.1.1.1#cloudflare-dns.com, https://dns.google/dns-query
+	Servers []string `mapstructure:"servers"`
+	// Hosts overrides names with static ips, each entry is in hosts file format, e.g. "10.0.0.1 db.internal db"
+	Hosts []string `mapstructure:"hosts"`
+	// Timeout of each query in seconds
+	Timeout int `mapstructure:"timeout"`
+	// CacheSize is max cached names, negative disables cache
+	CacheSize int `mapstructure:"cacheSize"`
+	// Prefetch refreshes cached names close to expiry when they are hit
+	Prefetch bool `mapstructure:"prefetch"`
+}
+
+// Preference orders or filters ips of both families
+type Preference string
+
+const (
+	PreferIPv4 Preference = "ipv4"
+	PreferIPv6 Preference = "ipv6"
+	OnlyIPv4   Preference = "ipv4only"
+	OnlyIPv6   Preference = "ipv6only"
+)
+
+// ParsePreference validates s, empty s prefers ipv4
+func ParsePreference(s string) (Preference, error) {
+	switch p := Preference(s); p {
+	case "":
+		return PreferIPv4, nil
+	case PreferIPv4, PreferIPv6, OnlyIPv4, OnlyIPv6:
+		return p, nil
+	}
+	return "", errors.Errorf("invalid ip preference: %s", s)
+}
+
+type entry struct {
+	ips         []net.IP
+	expire      time.Time
+	ttl         time.Duration
+	prefetching bool
+}
+
+// Resolver looks up ips of names with static hosts, cache and upstreams
+type Resolver struct {
+	upstreams []upstream
+	hosts     map[string][]net.IP
+	timeout   time.Duration
+	cacheSize int
+	prefetch  bool
+	mu        sync.Mutex
+	cache     map[string]*entry
+}
+
+// New builds resolver from cfg, nil cfg gives a resolver of the system resolver without cache
+func New(cfg *Conf) (*Resolver, error) {
+	r := &Resolver{
+		hosts:     make(map[string][]net.IP),
+		timeout:   defaultTimeout * time.Second,
+		cacheSize: defaultCacheSize,
+		cache:     make(map[string]*entry),
+	}
+	if cfg == nil {
+		return r, nil
+	}
+	if cfg.Timeout > 0 {
+		r.timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	if cfg.CacheSize != 0 {
+		r.cacheSize = cfg.CacheSize
+	}
+	r.prefetch = cfg.Prefetch
+	for _, v := range cfg.Hosts {
+		fields := strings.Fields(v)
+		if len(fields) < 2 {
+			return nil, errors.Errorf("invalid host: %s", v)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, errors.Errorf("invalid ip of host: %s", v)
+		}
+		for _, name := range fields[1:] {
+			name = normalize(name)
+			r.hosts[name] = append(r.hosts[name], ip)
+		}
+	}
+	for _, v := range cfg.Servers {
+		u, err := newUpstream(v, r.timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "newUpstream")
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+// LookupIP returns ips of host ordered or filtered by prefer, nil resolver uses the system resolver
+func (r *Resolver) LookupIP(ctx context.Context, host string, prefer Preference) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return filter([]net.IP{ip}, prefer, host)
+	}
+	name := normalize(host)
+	if r != nil {
+		if ips, ok := r.hosts[name]; ok {
+			return filter(ips, prefer, host)
+		}
+	}
+	if r == nil || len(r.upstreams) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, errors.Wrap(err, "net.DefaultResolver.LookupIPAddr")
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, v := range addrs {
+			ips = append(ips, v.IP)
+		}
+		return filter(ips, prefer, host)
+	}
+	var qtypes []uint16
+	switch prefer {
+	case OnlyIPv4:
+		qtypes = []uint16{typeA}
+	case OnlyIPv6:
+		qtypes = []uint16{typeAAAA}
+	case PreferIPv6:
+		qtypes = []uint16{typeAAAA, typeA}
+	default:
+		qtypes = []uint16{typeA, typeAAAA}
+	}
+	results := make([][]net.IP, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			results[i], errs[i] = r.lookup(ctx, name, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+	var ips []net.IP
+	for _, v := range results {
+		ips = append(ips, v...)
+	}
+	if len(ips) != 0 {
+		return ips, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookup answers name of qtype from cache or upstreams, a not found name gives empty ips
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) ([]net.IP, error) {
+	key := name + "|" + strconv.Itoa(int(qtype))
+	now := time.Now()
+	r.mu.Lock()
+	if e, ok := r.cache[key]; ok && now.Before(e.expire) {
+		ips := e.ips
+		if r.prefetch && !e.prefetching && e.expire.Sub(now) < e.ttl/prefetchRatio {
+			e.prefetching = true
+			go r.refresh(key, name, qtype)
+		}
+		r.mu.Unlock()
+		return ips, nil
+	}
+	r.mu.Unlock()
+	ips, ttl, err := r.query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	r.store(key, ips, ttl)
+	return ips, nil
+}
+
+func (r *Resolver) refresh(key, name string, qtype uint16) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout*time.Duration(len(r.upstreams)))
+	defer cancel()
+	ips, ttl, err := r.query(ctx, name, qtype)
+	if err != nil {
+		log.Debugf("resolver: prefetch %s: %s", name, err)
+		r.mu.Lock()
+		if e, ok := r.cache[key]; ok {
+			e.prefetching = false
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.store(key, ips, ttl)
+}
+
+func (r *Resolver) store(key string, ips []net.IP, ttl time.Duration) {
+	if r.cacheSize < 0 {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= r.cacheSize {
+		// drop expired entries, or an arbitrary one if none expired
+		for k, e := range r.cache {
+			if now.After(e.expire) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= r.cacheSize {
+			for k := range r.cache {
+				delete(r.cache, k)
+				break
+			}
+		}
+	}
+	r.cache[key] = &entry{ips: ips, expire: now.Add(ttl), ttl: ttl}
+}
+
+// query asks upstreams in order until one answers, name error is an answer of no ips
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	var err error
+	for _, u := range r.upstreams {
+		var resp *response
+		resp, err = r.exchange(ctx, u, name, qtype)
+		if err != nil {
+			err = errors.Wrap(err, u.String())
+			continue
+		}
+		switch resp.rcode {
+		case 0:
+			ttl := time.Duration(resp.ttl) * time.Second
+			if len(resp.ips) == 0 || ttl < minTTL {
+				ttl = minTTL
+			} else if ttl > maxTTL {
+				ttl = maxTTL
+			}
+			return resp.ips, ttl, nil
+		case rcodeNameError:
+			return nil, minTTL, nil
+		}
+		err = errors.Errorf("%s: rcode %d", u, resp.rcode)
+	}
+	return nil, 0, err
+}
+
+func (r *Resolver) exchange(ctx context.Context, u upstream, name string, qtype uint16) (*response, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, errors.Wrap(err, "rand.Read")
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	if _, ok := u.(*httpsUpstream); ok {
+		// RFC 8484 uses id 0 for cache friendliness
+		id = 0
+	}
+	query, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, errors.Wrap(err, "buildQuery")
+	}
+	msg, err := u.exchange(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "exchange")
+	}
+	resp, err := parseResponse(msg, qtype)
+	if err != nil {
+		return nil, errors.Wrap(err, "parseResponse")
+	}
+	if resp.id != id {
+		return nil, errors.Errorf("unexpected id: %d", resp.id)
+	}
+	if resp.truncated {
+		// retry truncated udp answer over tcp of the same server
+		if udp, ok := u.(*udpUpstream); ok {
+			return r.exchange(ctx, &tcpUpstream{addr: udp.addr, dial: udp.dialer.DialContext}, name, qtype)
+		}
+		return nil, errors.New("truncated response")
+	}
+	return resp, nil
+}
+
+// filter orders or filters ips by prefer
+func filter(ips []net.IP, prefer Preference, host string) ([]net.IP, error) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	var sorted []net.IP
+	switch prefer {
+	case OnlyIPv4:
+		sorted = v4
+	case OnlyIPv6:
+		sorted = v6
+	case PreferIPv6:
+		sorted = append(v6, v4...)
+	default:
+		sorted = append(v4, v6...)
+	}
+	if len(sorted) == 0 {
+		return nil, &net.DNSError{Err: "no address of preferred family", Name: host, IsNotFound: true}
+	}
+	return sorted, nil
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
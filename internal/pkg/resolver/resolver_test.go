@@ -0,0 +1,463 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// answer is a reply of stub server to a name and type
+type answer struct {
+	rcode int
+	ttl   uint32
+	ips   []string
+	// cname is put before ips in answer section
+	cname bool
+	// truncated replies over udp set TC without answers
+	truncated bool
+}
+
+// stubServer answers queries over udp and tcp on the same port from a table
+type stubServer struct {
+	addr    string
+	udp     net.PacketConn
+	tcp     net.Listener
+	mu      sync.Mutex
+	answers map[string]answer
+	queries map[string]int
+}
+
+func newStubServer(t *testing.T, answers map[string]answer) *stubServer {
+	s := &stubServer{answers: answers, queries: make(map[string]int)}
+	var err error
+	for i := 0; i < 10; i++ {
+		if s.udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String()); err == nil {
+			break
+		}
+		s.udp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = s.udp.LocalAddr().String()
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *stubServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.reply(buf[:n], "udp"); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *stubServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var n uint16
+			if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+				return
+			}
+			query := make([]byte, n)
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			resp := s.reply(query, "tcp")
+			if resp == nil {
+				return
+			}
+			binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+			conn.Write(resp)
+		}()
+	}
+}
+
+// count returns number of queries of network, name and type, e.g. "udp a.test A"
+func (s *stubServer) count(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[key]
+}
+
+func (s *stubServer) reply(query []byte, network string) []byte {
+	name, qtype, end, ok := parseQuestion(query)
+	if !ok {
+		return nil
+	}
+	qtypeName := "A"
+	if qtype == typeAAAA {
+		qtypeName = "AAAA"
+	}
+	s.mu.Lock()
+	s.queries[network+" "+name+" "+qtypeName]++
+	a, found := s.answers[name+" "+qtypeName]
+	s.mu.Unlock()
+	if !found {
+		// NOERROR without records, e.g. no AAAA of name
+		a = answer{}
+	}
+	flags := uint16(0x8180) | uint16(a.rcode)
+	if a.truncated && network == "udp" {
+		flags |= 0x0200
+		a.ips, a.cname = nil, false
+	}
+	var records [][]byte
+	if a.cname {
+		// CNAME to the question name itself, rdata is a pointer
+		records = append(records, record(5, a.ttl, []byte{0xc0, 12}))
+	}
+	for _, v := range a.ips {
+		ip := net.ParseIP(v)
+		if qtype == typeA {
+			records = append(records, record(typeA, a.ttl, ip.To4()))
+		} else {
+			records = append(records, record(typeAAAA, a.ttl, ip.To16()))
+		}
+	}
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(records)))
+	resp = append(resp, query[12:end]...)
+	for _, v := range records {
+		resp = append(resp, v...)
+	}
+	return resp
+}
+
+// record builds a resource record named by pointer to question
+func record(rtype uint16, ttl uint32, rdata []byte) []byte {
+	b := make([]byte, 12, 12+len(rdata))
+	b[0], b[1] = 0xc0, 12
+	binary.BigEndian.PutUint16(b[2:], rtype)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint32(b[6:], ttl)
+	binary.BigEndian.PutUint16(b[10:], uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+func parseQuestion(msg []byte) (string, uint16, int, bool) {
+	if len(msg) < 12 {
+		return "", 0, 0, false
+	}
+	var labels []string
+	off := 12
+	for off < len(msg) && msg[off] != 0 {
+		n := int(msg[off])
+		if off+1+n > len(msg) {
+			return "", 0, 0, false
+		}
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += 1 + n
+	}
+	if off+5 > len(msg) {
+		return "", 0, 0, false
+	}
+	return strings.Join(labels, "."), binary.BigEndian.Uint16(msg[off+1:]), off + 5, true
+}
+
+func newTestResolver(t *testing.T, server string) *Resolver {
+	r, err := New(&Conf{Servers: []string{server}, Timeout: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func cachedTTL(r *Resolver, name string, qtype uint16) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cache[name+"|"+strconv.Itoa(int(qtype))]
+	if !ok {
+		return 0, false
+	}
+	return e.ttl, true
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, 0, len(ips))
+	for _, v := range ips {
+		s = append(s, v.String())
+	}
+	return s
+}
+
+func TestTTLClamp(t *testing.T) {
+	s := newStubServer(t, map[string]answer{
+		"short.test A":  {ttl: 5, ips: []string{"10.0.0.1"}},
+		"long.test A":   {ttl: 86400, ips: []string{"10.0.0.2"}},
+		"normal.test A": {ttl: 300, ips: []string{"10.0.0.3", "10.0.0.4"}},
+		"cname.test A":  {ttl: 120, ips: []string{"10.0.0.6"}, cname: true},
+	})
+	r := newTestResolver(t, s.addr)
+	tests := []struct {
+		name string
+		want time.Duration
+	}{
+		// NOERROR without records is cached as negative
+		{"empty.test", minTTL},
+		{"short.test", minTTL},
+		{"long.test", maxTTL},
+		{"normal.test", 300 * time.Second},
+		{"cname.test", 120 * time.Second},
+	}
+	for _, tt := range tests {
+		if _, err := r.LookupIP(context.Background(), tt.name, OnlyIPv4); err != nil && tt.name != "empty.test" {
+			t.Fatalf("LookupIP(%s): %s", tt.name, err)
+		}
+		ttl, ok := cachedTTL(r, tt.name, typeA)
+		if !ok || ttl != tt.want {
+			t.Errorf("ttl of %s = %s, %v, want %s", tt.name, ttl, ok, tt.want)
+		}
+	}
+	// cached answers are not queried again
+	for _, tt := range tests {
+		r.LookupIP(context.Background(), tt.name, OnlyIPv4)
+		if n := s.count("udp " + tt.name + " A"); n != 1 {
+			t.Errorf("queries of %s = %d, want 1", tt.name, n)
+		}
+	}
+}
+
+func TestNXDOMAINCache(t *testing.T) {
+	s := newStubServer(t, map[string]answer{
+		"missing.test A":    {rcode: rcodeNameError},
+		"missing.test AAAA": {rcode: rcodeNameError},
+		"fail.test A":       {rcode: 2},
+	})
+	r := newTestResolver(t, s.addr)
+	for i := 0; i < 3; i++ {
+		_, err := r.LookupIP(context.Background(), "missing.test", PreferIPv4)
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok || !dnsErr.IsNotFound {
+			t.Fatalf("LookupIP(missing.test) error = %v, want not found", err)
+		}
+	}
+	for _, key := range []string{"udp missing.test A", "udp missing.test AAAA"} {
+		if n := s.count(key); n != 1 {
+			t.Errorf("queries of %s = %d, want 1", key, n)
+		}
+	}
+	if ttl, ok := cachedTTL(r, "missing.test", typeA); !ok || ttl != minTTL {
+		t.Errorf("ttl of missing.test = %s, %v, want %s", ttl, ok, minTTL)
+	}
+	// server failure is not cached
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupIP(context.Background(), "fail.test", OnlyIPv4)
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok || !dnsErr.IsTemporary {
+			t.Fatalf("LookupIP(fail.test) error = %v, want temporary", err)
+		}
+	}
+	if n := s.count("udp fail.test A"); n != 2 {
+		t.Errorf("queries of fail.test = %d, want 2", n)
+	}
+}
+
+func TestTruncatedFallback(t *testing.T) {
+	s := newStubServer(t, map[string]answer{
+		"big.test A": {ttl: 300, ips: []string{"10.0.0.1", "10.0.0.2"}, truncated: true},
+	})
+	r := newTestResolver(t, s.addr)
+	ips, err := r.LookupIP(context.Background(), "big.test", OnlyIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ipStrings(ips), []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ips = %v, want %v", got, want)
+	}
+	if n := s.count("udp big.test A"); n != 1 {
+		t.Errorf("udp queries = %d, want 1", n)
+	}
+	if n := s.count("tcp big.test A"); n != 1 {
+		t.Errorf("tcp queries = %d, want 1", n)
+	}
+	// tcp upstream never falls back
+	r = newTestResolver(t, "tcp://"+s.addr)
+	if _, err := r.LookupIP(context.Background(), "big.test", OnlyIPv4); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count("udp big.test A"); n != 1 {
+		t.Errorf("udp queries = %d, want 1", n)
+	}
+}
+
+func TestPreference(t *testing.T) {
+	s := newStubServer(t, map[string]answer{
+		"dual.test A":    {ttl: 300, ips: []string{"10.0.0.1"}},
+		"dual.test AAAA": {ttl: 300, ips: []string{"fd00::1", "fd00::2"}},
+		"v4.test A":      {ttl: 300, ips: []string{"10.0.0.2"}},
+	})
+	r, err := New(&Conf{
+		Servers: []string{s.addr},
+		Hosts:   []string{"10.0.0.9 static.test", "fd00::9 static.test"},
+		Timeout: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host   string
+		prefer Preference
+		want   []string
+	}{
+		{"dual.test", PreferIPv4, []string{"10.0.0.1", "fd00::1", "fd00::2"}},
+		{"dual.test", PreferIPv6, []string{"fd00::1", "fd00::2", "10.0.0.1"}},
+		{"dual.test", OnlyIPv4, []string{"10.0.0.1"}},
+		{"DUAL.test.", OnlyIPv6, []string{"fd00::1", "fd00::2"}},
+		{"v4.test", PreferIPv6, []string{"10.0.0.2"}},
+		{"v4.test", OnlyIPv6, nil},
+		{"static.test", PreferIPv6, []string{"fd00::9", "10.0.0.9"}},
+		{"static.test", OnlyIPv4, []string{"10.0.0.9"}},
+		{"10.1.1.1", PreferIPv6, []string{"10.1.1.1"}},
+		{"10.1.1.1", OnlyIPv6, nil},
+		{"::1", PreferIPv4, []string{"::1"}},
+	}
+	for _, tt := range tests {
+		ips, err := r.LookupIP(context.Background(), tt.host, tt.prefer)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("LookupIP(%s, %s) = %v, want error", tt.host, tt.prefer, ips)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LookupIP(%s, %s): %s", tt.host, tt.prefer, err)
+			continue
+		}
+		if got := ipStrings(ips); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LookupIP(%s, %s) = %v, want %v", tt.host, tt.prefer, got, tt.want)
+		}
+	}
+	if n := s.count("udp static.test A"); n != 0 {
+		t.Errorf("static host queried %d times", n)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	query, err := buildQuery(0x1234, "a.test", typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, end, _ := parseQuestion(query)
+	header := func(flags uint16, qd, an int) []byte {
+		b := make([]byte, 12)
+		binary.BigEndian.PutUint16(b, 0x1234)
+		binary.BigEndian.PutUint16(b[2:], flags)
+		binary.BigEndian.PutUint16(b[4:], uint16(qd))
+		binary.BigEndian.PutUint16(b[6:], uint16(an))
+		return b
+	}
+	join := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, v := range parts {
+			b = append(b, v...)
+		}
+		return b
+	}
+	question := query[12:end]
+	a := record(typeA, 60, []byte{10, 0, 0, 1})
+	tests := []struct {
+		name    string
+		msg     []byte
+		ok      bool
+		ips     []string
+		ttl     uint32
+		rcode   int
+		trunc   bool
+		wantErr string
+	}{
+		{name: "empty", msg: nil, wantErr: "too short"},
+		{name: "short header", msg: header(0x8180, 0, 0)[:11], wantErr: "too short"},
+		{name: "query", msg: join(header(0x0100, 1, 0), question), wantErr: "not a response"},
+		{name: "truncated question", msg: join(header(0x8180, 1, 0), question[:3]), wantErr: "question"},
+		{name: "missing answer", msg: join(header(0x8180, 1, 1), question), wantErr: "answer"},
+		{name: "short answer", msg: join(header(0x8180, 1, 1), question, a[:8]), wantErr: "answer too short"},
+		{name: "short rdata", msg: join(header(0x8180, 1, 1), question, a[:14]), wantErr: "rdata too short"},
+		{name: "invalid label", msg: join(header(0x8180, 1, 0), []byte{0x80, 0, 0, 1, 0, 1}), wantErr: "invalid label"},
+		{name: "answer", msg: join(header(0x8180, 1, 1), question, a), ok: true, ips: []string{"10.0.0.1"}, ttl: 60},
+		{
+			name: "min ttl after cname",
+			msg: join(header(0x8180, 1, 4), question, record(5, 10, []byte{0xc0, 12}), a,
+				record(typeA, 30, []byte{10, 0, 0, 2}), record(typeAAAA, 5, net.ParseIP("fd00::1"))),
+			ok: true, ips: []string{"10.0.0.1", "10.0.0.2"}, ttl: 30,
+		},
+		{name: "wrong rdata length", msg: join(header(0x8180, 1, 1), question, record(typeA, 60, []byte{10, 0, 0})), ok: true},
+		{name: "name error", msg: join(header(0x8183, 1, 0), question), ok: true, rcode: rcodeNameError},
+		{name: "truncated", msg: join(header(0x8380, 1, 0), question), ok: true, trunc: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := parseResponse(tt.msg, typeA)
+			if !tt.ok {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseResponse error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ipStrings(resp.ips); len(got) != len(tt.ips) || len(got) != 0 && !reflect.DeepEqual(got, tt.ips) {
+				t.Errorf("ips = %v, want %v", got, tt.ips)
+			}
+			if resp.id != 0x1234 || resp.ttl != tt.ttl || resp.rcode != tt.rcode || resp.truncated != tt.trunc {
+				t.Errorf("resp = %+v, want ttl %d rcode %d truncated %v", resp, tt.ttl, tt.rcode, tt.trunc)
+			}
+		})
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"example.com", true},
+		{"example.com.", true},
+		{"a..b", false},
+		{"", false},
+		{strings.Repeat("a", 64) + ".com", false},
+	}
+	for _, tt := range tests {
+		msg, err := buildQuery(1, tt.name, typeAAAA)
+		if (err == nil) != tt.ok {
+			t.Errorf("buildQuery(%q) error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		name, qtype, _, ok := parseQuestion(msg)
+		if !ok || name != strings.TrimSuffix(tt.name, ".") || qtype != typeAAAA {
+			t.Errorf("buildQuery(%q) question = %q, %d", tt.name, name, qtype)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// upstream exchanges a query message for a response message
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// newUpstream parses server in `[udp|tcp|tls|https]://host[:port]` format, udp is used without scheme,
+// sni of tls and https defaults to host and can be set by url fragment, e.g. tls://1.1.1.1#cloudflare-dns.com
+func newUpstream(server string, timeout time.Duration) (upstream, error) {
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, errors.Wrap(err, "url.Parse")
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, errors.Errorf("empty host: %s", server)
+	}
+	addr := func(port string) string {
+		if len(u.Port()) != 0 {
+			port = u.Port()
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: addr("53"), dialer: dialer}, nil
+	case "tcp":
+		return &tcpUpstream{addr: addr("53"), dial: dialer.DialContext}, nil
+	case "tls":
+		sni := u.Fragment
+		if len(sni) == 0 {
+			sni = u.Hostname()
+		}
+		tlsConfig := &tls.Config{ServerName: sni, MinVersion: tls.VersionTLS12}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		return &tcpUpstream{addr: addr("853"), dial: tlsDialer.DialContext, scheme: "tls"}, nil
+	case "https":
+		sni := u.Fragment
+		u.Fragment = ""
+		client := &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSClientConfig:     &tls.Config{ServerName: sni, MinVersion: tls.VersionTLS12},
+				TLSHandshakeTimeout: timeout,
+				ForceAttemptHTTP2:   true,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+		return &httpsUpstream{url: u.String(), client: client}, nil
+	}
+	return nil, errors.Errorf("invalid scheme: %s", u.Scheme)
+}
+
+type udpUpstream struct {
+	addr   string
+	dialer *net.Dialer
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+func (u *udpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dialer.DialContext")
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, errors.Wrap(err, "conn.Write")
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.Wrap(err, "conn.Read")
+		}
+		// drop stray datagrams not answering this query
+		if n >= 12 && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// tcpUpstream sends length prefixed messages over tcp or tls
+type tcpUpstream struct {
+	addr   string
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	scheme string
+}
+
+func (u *tcpUpstream) String() string {
+	if len(u.scheme) != 0 {
+		return u.scheme + "://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+func (u *tcpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dial(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, errors.Wrap(err, "conn.Write")
+	}
+	var n uint16
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return nil, errors.Wrap(err, "read length")
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, errors.Wrap(err, "read message")
+	}
+	return resp, nil
+}
+
+// httpsUpstream posts wire format messages of RFC 8484
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func (u *httpsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, errors.Wrap(err, "http.NewRequest")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "client.Do")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadAll")
+	}
+	return body, nil
+}
@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/pkg/errors"
+)
+
+var resolveTimeout = 10 * time.Second
+
+// Router dials destinations of forward proxy through outbound picked by rules
+type Router struct {
+	list    *List
+	dialers map[string]outbound.Dialer
+}
+
+// NewRouter checks outbounds named by list exist
+func NewRouter(list *List, dialers map[string]outbound.Dialer) (*Router, error) {
+	for _, r := range list.Rules {
+		if _, ok := dialers[r.Outbound]; !ok && r.Outbound != Block {
+			return nil, errors.Errorf("outbound not found: %s", r.Outbound)
+		}
+	}
+	return &Router{list: list, dialers: dialers}, nil
+}
+
+// List returns rules of router
+func (r *Router) List() *List {
+	return r.list
+}
+
+// Dial checks addr with policy, then connects to allowed ips through outbound of the matched rule,
+// or through dialer if no rule matches, blocked destinations return acl.ErrDenied.
+// Upstreams resolving names remotely get addr as is
+func (r *Router) Dial(policy *acl.Policy, dialer outbound.Dialer, user, network, addr string) (net.Conn, error) {
+	if r == nil {
+		return policy.Dial(dialer, network, addr)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.SplitHostPort")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "strconv.Atoi port")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	// resolve once, lazily for cidr rules or before dialing
+	var (
+		ips      []net.IP
+		resolved bool
+		dnsErr   error
+	)
+	resolve := func() []net.IP {
+		if !resolved {
+			resolved = true
+			ips, _, dnsErr = policy.Resolve(ctx, addr)
+		}
+		return ips
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if rule, ok := r.list.Match(host, resolve, port, user); ok {
+		if rule.Outbound == Block {
+			return nil, errors.Wrapf(acl.ErrDenied, "blocked by rule %s,%s", rule.Kind, rule.Value)
+		}
+		dialer = r.dialers[rule.Outbound]
+	}
+	if outbound.Remote(dialer) {
+		return policy.Dial(dialer, network, addr)
+	}
+	if resolve(); dnsErr != nil {
+		return nil, dnsErr
+	}
+	return acl.DialIPs(dialer, network, ips, port)
+}
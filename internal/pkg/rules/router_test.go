@@ -0,0 +1,79 @@
+package rules
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/pkg/errors"
+)
+
+// recordDialer records dialed addrs
+type recordDialer struct {
+	dialed []string
+}
+
+func (d *recordDialer) Dial(network, addr string) (net.Conn, error) {
+	d.dialed = append(d.dialed, addr)
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestNewRouter(t *testing.T) {
+	list := &List{Rules: []*Rule{{Kind: kindMatch, Outbound: "proxy"}, {Kind: kindMatch, Outbound: Block}}}
+	if _, err := NewRouter(list, map[string]outbound.Dialer{"direct": &recordDialer{}}); err == nil {
+		t.Error("missing outbound should fail")
+	}
+	if _, err := NewRouter(list, map[string]outbound.Dialer{"proxy": &recordDialer{}}); err != nil {
+		t.Errorf("NewRouter: %s", err)
+	}
+}
+
+func TestRouterDial(t *testing.T) {
+	list := &List{}
+	for _, line := range []string{"domain,blocked.test,block", "port,8443,proxy", "cidr,192.0.2.0/24,proxy"} {
+		r, err := parseRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list.Rules = append(list.Rules, r)
+	}
+	tests := []struct {
+		name    string
+		addr    string
+		proxied bool
+		err     error
+	}{
+		{"blocked", "a.blocked.test:443", false, acl.ErrDenied},
+		{"port rule", "198.51.100.1:8443", true, nil},
+		{"cidr rule", "192.0.2.1:443", true, nil},
+		{"no match uses route dialer", "198.51.100.1:443", false, nil},
+		{"acl is checked for matched outbound", "127.0.0.1:8443", false, acl.ErrDenied},
+	}
+	for _, tt := range tests {
+		proxy, def := &recordDialer{}, &recordDialer{}
+		r, err := NewRouter(list, map[string]outbound.Dialer{"proxy": proxy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := r.Dial(nil, def, "", "tcp", tt.addr)
+		if conn != nil {
+			conn.Close()
+		}
+		if errors.Cause(err) != tt.err {
+			t.Errorf("%s: Dial error = %v, want %v", tt.name, err, tt.err)
+		}
+		want := []string{tt.addr}
+		if tt.err != nil {
+			want = nil
+		}
+		got := def.dialed
+		if tt.proxied {
+			got = proxy.dialed
+		}
+		if len(proxy.dialed)+len(def.dialed) != len(want) || (len(want) != 0 && got[0] != want[0]) {
+			t.Errorf("%s: dialed %v by proxy and %v by route dialer, want %v by proxy %v", tt.name, proxy.dialed, def.dialed, want, tt.proxied)
+		}
+	}
+}
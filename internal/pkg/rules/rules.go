@@ -0,0 +1,145 @@
+package rules
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/pkg/errors"
+)
+
+// Block is the outbound name rejecting matched destinations
+const Block = "block"
+
+const (
+	kindDomain  = "domain"
+	kindKeyword = "keyword"
+	kindCIDR    = "cidr"
+	kindPort    = "port"
+	kindUser    = "user"
+	kindMatch   = "match"
+)
+
+// Rule matches one criterion of destination or user and names an outbound
+type Rule struct {
+	Kind     string
+	Value    string
+	Outbound string
+	hits     uint64
+	ipNet    *net.IPNet
+	ports    acl.PortRange
+}
+
+// Hits returns times this rule matched
+func (r *Rule) Hits() uint64 {
+	return atomic.LoadUint64(&r.hits)
+}
+
+func (r *Rule) match(host string, ips func() []net.IP, port int, user string) bool {
+	switch r.Kind {
+	case kindDomain:
+		return host == r.Value || strings.HasSuffix(host, "."+r.Value)
+	case kindKeyword:
+		return strings.Contains(host, r.Value)
+	case kindCIDR:
+		for _, ip := range ips() {
+			if r.ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case kindPort:
+		return r.ports.Contains(port)
+	case kindUser:
+		return user == r.Value
+	case kindMatch:
+		return true
+	}
+	return false
+}
+
+// List is rules of one file, evaluated in order and the first match wins
+type List struct {
+	Name  string
+	Rules []*Rule
+}
+
+// Load parses rule file of lines in `kind,value,outbound` format, kind is domain, keyword, cidr, port or user,
+// a final `match,outbound` line matches everything, empty lines and lines start with # are skipped
+func Load(name string) (*List, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "os.Open")
+	}
+	defer f.Close()
+	l := &List{Name: name}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+		l.Rules = append(l.Rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner.Err")
+	}
+	return l, nil
+}
+
+func parseRule(line string) (*Rule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	kind := strings.ToLower(fields[0])
+	if kind == kindMatch {
+		if len(fields) != 2 || len(fields[1]) == 0 {
+			return nil, errors.New("match,outbound format is required")
+		}
+		return &Rule{Kind: kind, Outbound: fields[1]}, nil
+	}
+	if len(fields) != 3 || len(fields[1]) == 0 || len(fields[2]) == 0 {
+		return nil, errors.New("kind,value,outbound format is required")
+	}
+	r := &Rule{Kind: kind, Value: fields[1], Outbound: fields[2]}
+	switch kind {
+	case kindDomain, kindKeyword:
+		r.Value = strings.ToLower(strings.Trim(r.Value, "."))
+	case kindCIDR:
+		_, ipNet, err := net.ParseCIDR(r.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, "net.ParseCIDR")
+		}
+		r.ipNet = ipNet
+	case kindPort:
+		ports, err := acl.ParsePortRange(r.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid port: %s", r.Value)
+		}
+		r.ports = ports
+	case kindUser:
+	default:
+		return nil, errors.Errorf("invalid kind: %s", fields[0])
+	}
+	return r, nil
+}
+
+// Match returns the first rule matching destination and user, host is lower case,
+// ips resolves host and is only called when a cidr rule is reached
+func (l *List) Match(host string, ips func() []net.IP, port int, user string) (*Rule, bool) {
+	for _, r := range l.Rules {
+		if r.match(host, ips, port, user) {
+			atomic.AddUint64(&r.hits, 1)
+			return r, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,144 @@
+package rules
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line     string
+		kind     string
+		value    string
+		outbound string
+		ok       bool
+	}{
+		{"domain,.Example.COM.,proxy", kindDomain, "example.com", "proxy", true},
+		{" keyword , Google , direct ", kindKeyword, "google", "direct", true},
+		{"CIDR,10.0.0.0/8,block", kindCIDR, "10.0.0.0/8", "block", true},
+		{"port,8000-9000,proxy", kindPort, "8000-9000", "proxy", true},
+		{"port, 25 ,block", kindPort, "25", "block", true},
+		{"user,alice,proxy", kindUser, "alice", "proxy", true},
+		{"match,direct", kindMatch, "", "direct", true},
+		{"match,", "", "", "", false},
+		{"match,a,b", "", "", "", false},
+		{"domain,example.com", "", "", "", false},
+		{"domain,,proxy", "", "", "", false},
+		{"domain,example.com,", "", "", "", false},
+		{"cidr,10.0.0.1,proxy", "", "", "", false},
+		{"port,9000-8000,proxy", "", "", "", false},
+		{"port,http,proxy", "", "", "", false},
+		{"geoip,cn,direct", "", "", "", false},
+	}
+	for _, tt := range tests {
+		r, err := parseRule(tt.line)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRule(%q) error = %v, want ok %v", tt.line, err, tt.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.Kind != tt.kind || r.Value != tt.value || r.Outbound != tt.outbound {
+			t.Errorf("parseRule(%q) = %s,%s,%s, want %s,%s,%s", tt.line, r.Kind, r.Value, r.Outbound, tt.kind, tt.value, tt.outbound)
+		}
+	}
+}
+
+func TestListMatch(t *testing.T) {
+	l := &List{}
+	for _, line := range []string{
+		"user,alice,a",
+		"domain,example.com,b",
+		"keyword,tracker,block",
+		"cidr,10.0.0.0/8,c",
+		"port,25,block",
+		"match,d",
+	} {
+		r, err := parseRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Rules = append(l.Rules, r)
+	}
+	tests := []struct {
+		name     string
+		host     string
+		ips      []string
+		port     int
+		user     string
+		outbound string
+		resolved bool
+	}{
+		{"user first", "www.example.com", nil, 443, "alice", "a", false},
+		{"domain", "www.example.com", nil, 443, "bob", "b", false},
+		{"domain exact", "example.com", nil, 443, "", "b", false},
+		{"domain label boundary", "notexample.com", nil, 443, "", "d", true},
+		{"keyword", "a.tracker.net", nil, 443, "", "block", false},
+		{"cidr", "db.internal", []string{"192.0.2.1", "10.0.0.1"}, 443, "", "c", true},
+		{"port", "mail.example.net", []string{"192.0.2.1"}, 25, "", "block", true},
+		{"match", "www.example.net", []string{"192.0.2.1"}, 443, "", "d", true},
+	}
+	for _, tt := range tests {
+		resolved := false
+		ips := func() []net.IP {
+			resolved = true
+			var ips []net.IP
+			for _, v := range tt.ips {
+				ips = append(ips, net.ParseIP(v))
+			}
+			return ips
+		}
+		r, ok := l.Match(tt.host, ips, tt.port, tt.user)
+		if !ok || r.Outbound != tt.outbound {
+			t.Errorf("%s: Match = %v, %v, want outbound %s", tt.name, r, ok, tt.outbound)
+		}
+		if resolved != tt.resolved {
+			t.Errorf("%s: resolved = %v, want %v", tt.name, resolved, tt.resolved)
+		}
+	}
+	if hits := l.Rules[len(l.Rules)-1].Hits(); hits != 2 {
+		t.Errorf("match rule hits = %d, want 2", hits)
+	}
+	if _, ok := (&List{}).Match("a", nil, 443, ""); ok {
+		t.Error("empty list should not match")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akari-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name  string
+		data  string
+		rules int
+		ok    bool
+	}{
+		{"rules", "# comment\n\ndomain,example.com,proxy\n  # indented comment\nmatch,direct\n", 2, true},
+		{"empty", "", 0, true},
+		{"invalid line", "domain,example.com,proxy\ncidr,x,proxy\n", 0, false},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.name+".rules")
+		if err := ioutil.WriteFile(name, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		l, err := Load(name)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Load error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err == nil && (len(l.Rules) != tt.rules || l.Name != name) {
+			t.Errorf("%s: Load = %d rules of %s, want %d of %s", tt.name, len(l.Rules), l.Name, tt.rules, name)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "missing.rules")); err == nil {
+		t.Error("missing file should fail")
+	}
+}
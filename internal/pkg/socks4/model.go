@@ -0,0 +1,128 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const verSocks4 = 0x04
+
+const (
+	socks4CmdConnect = 0x01
+	socks4CmdBind    = 0x02
+)
+
+const (
+	// reply version is 0 instead of 4
+	verSocks4Rep           = 0x00
+	socks4RepGranted       = 0x5a
+	socks4RepRejected      = 0x5b
+	socks4RepIdentdFailed  = 0x5c
+	socks4RepUserIDInvalid = 0x5d
+)
+
+// maxFieldLen limits null terminated userid and domain
+const maxFieldLen = 255
+
+type cmdReq struct {
+	ver     byte
+	cmd     byte
+	dstPort uint16
+	dstIP   net.IP
+	userID  string
+	domain  string
+	dst     string
+}
+
+// read parses socks4 request, socks4a domain is read when dst ip is 0.0.0.x
+func (r *cmdReq) read(srcConn net.Conn) error {
+	if err := binary.Read(srcConn, binary.BigEndian, &r.ver); err != nil {
+		return errors.Wrap(err, "read version")
+	}
+	if r.ver != verSocks4 {
+		return errors.Errorf("unsupported protocol version: %0x", r.ver)
+	}
+	if err := binary.Read(srcConn, binary.BigEndian, &r.cmd); err != nil {
+		return errors.Wrap(err, "read cmd")
+	}
+	if err := binary.Read(srcConn, binary.BigEndian, &r.dstPort); err != nil {
+		return errors.Wrap(err, "read dst port")
+	}
+	r.dstIP = make(net.IP, net.IPv4len)
+	if _, err := io.ReadFull(srcConn, r.dstIP); err != nil {
+		return errors.Wrap(err, "read dst ip")
+	}
+	userID, err := readString(srcConn)
+	if err != nil {
+		return errors.Wrap(err, "read userid")
+	}
+	r.userID = userID
+	host := r.dstIP.String()
+	if r.dstIP[0] == 0 && r.dstIP[1] == 0 && r.dstIP[2] == 0 && r.dstIP[3] != 0 {
+		domain, err := readString(srcConn)
+		if err != nil {
+			return errors.Wrap(err, "read domain")
+		}
+		r.domain = domain
+		host = domain
+	}
+	r.dst = net.JoinHostPort(host, strconv.Itoa(int(r.dstPort)))
+	if r.cmd != socks4CmdConnect {
+		rep := newCmdRep()
+		rep.rep = socks4RepRejected
+		rep.write(srcConn)
+		return errors.Errorf("unsupported cmd: %0x", r.cmd)
+	}
+	return nil
+}
+
+// readString reads a null terminated string
+func readString(srcConn net.Conn) (string, error) {
+	var buf []byte
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(srcConn, c); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == maxFieldLen {
+			return "", errors.New("field too long")
+		}
+		buf = append(buf, c[0])
+	}
+}
+
+type cmdRep struct {
+	ver     byte
+	rep     byte
+	dstPort uint16
+	dstIP   net.IP
+}
+
+func newCmdRep() *cmdRep {
+	return &cmdRep{
+		ver:   verSocks4Rep,
+		rep:   socks4RepGranted,
+		dstIP: net.IPv4zero.To4(),
+	}
+}
+
+func (p *cmdRep) write(srcConn net.Conn) error {
+	buf := make([]byte, 8)
+	buf[0] = p.ver
+	buf[1] = p.rep
+	binary.BigEndian.PutUint16(buf[2:], p.dstPort)
+	if ipv4 := p.dstIP.To4(); ipv4 != nil {
+		copy(buf[4:], ipv4)
+	}
+	if _, err := srcConn.Write(buf); err != nil {
+		return errors.Wrap(err, "write")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package socks4
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testConn reads from r and records writes, the other methods of net.Conn are not used
+type testConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *testConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func TestCmdReqRead(t *testing.T) {
+	req := func(cmd byte, ip string, fields ...string) []byte {
+		b := append([]byte{verSocks4, cmd, 0x01, 0xbb}, net.ParseIP(ip).To4()...)
+		for _, v := range fields {
+			b = append(append(b, v...), 0)
+		}
+		return b
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		userID string
+		domain string
+		dst    string
+		reply  []byte
+		ok     bool
+	}{
+		{"socks4", req(socks4CmdConnect, "192.0.2.1", ""), "", "", "192.0.2.1:443", nil, true},
+		{"socks4 userid", req(socks4CmdConnect, "192.0.2.1", "u:p"), "u:p", "", "192.0.2.1:443", nil, true},
+		{"socks4a", req(socks4CmdConnect, "0.0.0.1", "u:p", "example.com"), "u:p", "example.com", "example.com:443", nil, true},
+		{"socks4a empty userid", req(socks4CmdConnect, "0.0.0.255", "", "example.com"), "", "example.com", "example.com:443", nil, true},
+		{"zero ip is not socks4a", req(socks4CmdConnect, "0.0.0.0", ""), "", "", "0.0.0.0:443", nil, true},
+		{"bind", req(socks4CmdBind, "192.0.2.1", ""), "", "", "192.0.2.1:443", []byte{verSocks4Rep, socks4RepRejected, 0, 0, 0, 0, 0, 0}, false},
+		{"socks5 version", []byte{0x05, 0x01, 0x00}, "", "", "", nil, false},
+		{"truncated ip", []byte{verSocks4, socks4CmdConnect, 0x01, 0xbb, 192, 0}, "", "", "", nil, false},
+		{"missing userid terminator", req(socks4CmdConnect, "192.0.2.1")[:8], "", "", "", nil, false},
+		{"missing domain", req(socks4CmdConnect, "0.0.0.1", "u:p"), "u:p", "", "", nil, false},
+		{"long userid", req(socks4CmdConnect, "192.0.2.1", strings.Repeat("u", maxFieldLen+1)), "", "", "", nil, false},
+		{"long domain", req(socks4CmdConnect, "0.0.0.1", "", strings.Repeat("d", maxFieldLen+1)), "", "", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req cmdReq
+			conn := &testConn{r: bytes.NewReader(tt.data)}
+			err := req.read(conn)
+			if (err == nil) != tt.ok {
+				t.Fatalf("read error = %v, want ok %v", err, tt.ok)
+			}
+			if req.userID != tt.userID || req.domain != tt.domain || req.dst != tt.dst {
+				t.Errorf("read = userid %q, domain %q, dst %q, want %q, %q, %q",
+					req.userID, req.domain, req.dst, tt.userID, tt.domain, tt.dst)
+			}
+			if reply := conn.w.Bytes(); !bytes.Equal(reply, tt.reply) {
+				t.Errorf("reply = %v, want %v", reply, tt.reply)
+			}
+		})
+	}
+}
+
+func TestCmdRepWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   net.IP
+		want []byte
+	}{
+		{"ipv4", net.ParseIP("192.0.2.1"), []byte{verSocks4Rep, socks4RepGranted, 0x01, 0xbb, 192, 0, 2, 1}},
+		{"ipv6 does not fit", net.ParseIP("2001:db8::1"), []byte{verSocks4Rep, socks4RepGranted, 0x01, 0xbb, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		rep := newCmdRep()
+		rep.dstIP = tt.ip
+		rep.dstPort = 443
+		conn := &testConn{}
+		if err := rep.write(conn); err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.w.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: write = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
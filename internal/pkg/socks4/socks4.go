@@ -0,0 +1,78 @@
+package socks4
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+	"github.com/mikumaycry/akari/internal/pkg/transport"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// HandleConn handle socks4 and socks4a, userid is checked against credentials of cfg in user:password format
+func HandleConn(srcConn net.Conn, cfg *config.ServerConf, info *conninfo.Info, origLogEntry *log.Entry) {
+	var req cmdReq
+	if err := req.read(srcConn); err != nil {
+		origLogEntry.Errorf("req.read: %s", err)
+		return
+	}
+	if cfg.Credentials != nil {
+		user, ok := cfg.Credentials.VerifyPair(req.userID)
+		if !ok {
+			rep := newCmdRep()
+			rep.rep = socks4RepUserIDInvalid
+			rep.write(srcConn)
+			origLogEntry.Errorf("invalid auth: %s", user)
+			return
+		}
+		info.SetUser(user)
+		origLogEntry = origLogEntry.WithField("User", user)
+	}
+	logEntry := origLogEntry.WithField("DST", req.dst)
+	if err := info.Allow(); err != nil {
+		rep := newCmdRep()
+		rep.rep = socks4RepRejected
+		rep.write(srcConn)
+		logEntry.Errorf("info.Allow: %s", err)
+		return
+	}
+	defer logEntry.Info("Close DST")
+	logEntry.Info("Open DST")
+	dstConn, err := handleConnectDial(req.dst, cfg, info.User(), srcConn)
+	if err != nil {
+		logEntry.Errorf("handleConnectDial: %s", err)
+		return
+	}
+	defer dstConn.Close()
+	transport.Transport(srcConn, dstConn)
+}
+
+func handleConnectDial(dstAddr string, cfg *config.ServerConf, user string, srcConn net.Conn) (net.Conn, error) {
+	rep := newCmdRep()
+	defer func() {
+		rep.write(srcConn)
+	}()
+	dstConn, err := cfg.Dial(user, "tcp", dstAddr)
+	if err != nil {
+		rep.rep = socks4RepRejected
+		return nil, errors.Wrap(err, "cfg.Dial")
+	}
+	host, port, err := net.SplitHostPort(dstConn.LocalAddr().String())
+	if err != nil {
+		rep.rep = socks4RepRejected
+		return nil, errors.Wrap(err, "net.SplitHostPort")
+	}
+	prt, err := strconv.Atoi(port)
+	if err != nil {
+		rep.rep = socks4RepRejected
+		return nil, errors.Wrap(err, "strconv.Atoi port")
+	}
+	// only ipv4 fits in reply
+	if ipv4 := net.ParseIP(host).To4(); ipv4 != nil {
+		rep.dstIP = ipv4
+	}
+	rep.dstPort = uint16(prt)
+	return dstConn, nil
+}
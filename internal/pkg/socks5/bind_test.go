@@ -0,0 +1,144 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+	log "github.com/sirupsen/logrus"
+)
+
+// socks5Server serves socks5 conns of a local tcp listener by HandleConn
+func socks5Server(t *testing.T, cfg *config.ServerConf) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	logEntry := log.NewEntry(log.StandardLogger())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				HandleConn(conn, cfg, &conninfo.Info{}, logEntry)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func bindCmd(ip net.IP) []byte {
+	return append([]byte{verSocks5, socks5CmdBind, 0, socks5AddrTypeIPv4}, append(ip.To4(), 0, 0)...)
+}
+
+// dialFrom connects to addr from local ip
+func dialFrom(t *testing.T, ip net.IP, addr string) net.Conn {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestBind(t *testing.T) {
+	policy, err := acl.New(&acl.Conf{AllowPrivate: true}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := socks5Server(t, &config.ServerConf{EnableBind: true, Policy: policy})
+	peerIP := net.IPv4(127, 0, 0, 2)
+	conn, rep := dialSocks5(t, addr, bindCmd(peerIP))
+	if rep[1] != socks5RepSuccesss || rep[3] != socks5AddrTypeIPv4 {
+		t.Fatalf("first reply = %v", rep)
+	}
+	// listened on the ip client connected to
+	bnd := &net.TCPAddr{IP: net.IP(rep[4:8]), Port: int(rep[8])<<8 | int(rep[9])}
+	if !bnd.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("bnd = %s, want 127.0.0.1", bnd)
+	}
+
+	// other peers are closed
+	other := dialFrom(t, net.IPv4(127, 0, 0, 1), bnd.String())
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, other); err != nil {
+		t.Errorf("conn of other peer not closed: %s", err)
+	}
+
+	peer := dialFrom(t, peerIP, bnd.String())
+	rep, err = readBytes(conn, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := readAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep[1] != socks5RepSuccesss || !net.IP(second[1:5]).Equal(peerIP) {
+		t.Fatalf("second reply = %v %v", rep, second)
+	}
+	peer.Write([]byte("ping"))
+	b, err := readBytes(conn, 4)
+	if err != nil || string(b) != "ping" {
+		t.Fatalf("read from peer = %q %v", b, err)
+	}
+	conn.Write([]byte("pong"))
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err = readBytes(peer, 4)
+	if err != nil || string(b) != "pong" {
+		t.Fatalf("read from client = %q %v", b, err)
+	}
+}
+
+func TestBindRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *config.ServerConf
+		rep  byte
+	}{
+		{"disabled", &config.ServerConf{}, socks5RepNotAllowed},
+		{"private", &config.ServerConf{EnableBind: true}, socks5RepNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := socks5Server(t, tt.cfg)
+			_, rep := dialSocks5(t, addr, bindCmd(net.IPv4(127, 0, 0, 2)))
+			if rep[1] != tt.rep {
+				t.Errorf("reply = %v, want %d", rep, tt.rep)
+			}
+		})
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	old := bindTimeout
+	bindTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { bindTimeout = old })
+
+	policy, err := acl.New(&acl.Conf{AllowPrivate: true}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := socks5Server(t, &config.ServerConf{EnableBind: true, Policy: policy})
+	conn, rep := dialSocks5(t, addr, bindCmd(net.IPv4(127, 0, 0, 2)))
+	if rep[1] != socks5RepSuccesss {
+		t.Fatalf("first reply = %v", rep)
+	}
+	rep, err = readBytes(conn, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep[1] != socks5RepTLLExpired {
+		t.Errorf("second reply = %v, want ttl expired", rep)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"strconv"
 
+	"github.com/mikumaycry/akari/internal/pkg/auth"
 	"github.com/pkg/errors"
 )
 
@@ -93,8 +94,8 @@ type authReq struct {
 	passwd []byte
 }
 
-func (r *authReq) read(srcConn net.Conn, auth string) error {
-	if len(auth) == 0 {
+func (r *authReq) read(srcConn net.Conn, users *auth.Users) error {
+	if users == nil {
 		if _, err := srcConn.Write([]byte{verSocks5, socks5AuthMethodNone}); err != nil {
 			return errors.Wrap(err, "write noauth status")
 		}
@@ -123,10 +124,9 @@ func (r *authReq) read(srcConn net.Conn, auth string) error {
 	if _, err := io.ReadFull(srcConn, r.passwd); err != nil {
 		return errors.Wrap(err, "read password")
 	}
-	authStr := string(r.uname) + ":" + string(r.passwd)
-	if auth != authStr {
+	if !users.Verify(string(r.uname), string(r.passwd)) {
 		srcConn.Write([]byte{verAuthMethodUserPasswd, socks5AuthMethodUserPasswdFailed})
-		return errors.Errorf("invalid auth: %s", authStr)
+		return errors.Errorf("invalid auth: %s", r.uname)
 	}
 	if _, err := srcConn.Write([]byte{verAuthMethodUserPasswd, socks5AuthMethodUserPasswdSuccess}); err != nil {
 		return errors.Wrap(err, "write username/password auth status")
@@ -144,7 +144,7 @@ type cmdReq struct {
 	dst     string
 }
 
-func (r *cmdReq) read(srcConn net.Conn) error {
+func (r *cmdReq) read(srcConn net.Conn, enableBind bool) error {
 	if err := binary.Read(srcConn, binary.BigEndian, &r.ver); err != nil {
 		return errors.Wrap(err, "read cmd version")
 	}
@@ -157,7 +157,16 @@ func (r *cmdReq) read(srcConn net.Conn) error {
 		return errors.Wrap(err, "read cmd")
 	}
 
-	if r.cmd != socks5CmdConnect {
+	switch r.cmd {
+	case socks5CmdConnect, socks5CmdUDP:
+	case socks5CmdBind:
+		if !enableBind {
+			rep := newCmdRep()
+			rep.rep = socks5RepNotAllowed
+			rep.write(srcConn)
+			return errors.New("bind is not enabled")
+		}
+	default:
 		rep := newCmdRep()
 		rep.rep = socks5RepCmdUnsupported
 		rep.write(srcConn)
@@ -227,6 +236,18 @@ func newCmdRep() *cmdRep {
 	}
 }
 
+// setBnd sets bnd addr and port
+func (p *cmdRep) setBnd(ip net.IP, port int) {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		p.atyp = socks5AddrTypeIPv4
+		p.bndAddr = ipv4
+	} else {
+		p.atyp = socks5AddrTypeIPv6
+		p.bndAddr = ip.To16()
+	}
+	p.bndPort = uint16(port)
+}
+
 func (p *cmdRep) write(srcConn net.Conn) error {
 	var buf []byte
 	if p.rep != socks5RepSuccesss {
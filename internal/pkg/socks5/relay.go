@@ -0,0 +1,248 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/mikumaycry/akari/internal/pkg/transport"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RelayConn relays socks5 negotiation between local srcConn and server dstConn,
+// a succeeded UDP ASSOCIATE is served by a local UDP relay whose datagrams are carried over dstConn,
+// conns of other commands are transported as is
+func RelayConn(srcConn net.Conn, dstConn io.ReadWriter, logEntry *log.Entry) error {
+	ver, err := readBytes(srcConn, 1)
+	if err != nil {
+		return errors.Wrap(err, "read version")
+	}
+	if _, err := dstConn.Write(ver); err != nil {
+		return errors.Wrap(err, "write version")
+	}
+	if ver[0] != verSocks5 {
+		// other protocols like socks4 are transported as is
+		transport.Transport(srcConn, dstConn)
+		return nil
+	}
+	cmd, rep, err := relayNegotiation(srcConn, dstConn)
+	if err != nil {
+		return errors.Wrap(err, "relayNegotiation")
+	}
+	if cmd != socks5CmdUDP || rep[1] != socks5RepSuccesss {
+		if _, err := srcConn.Write(rep); err != nil {
+			return errors.Wrap(err, "write cmd reply")
+		}
+		transport.Transport(srcConn, dstConn)
+		return nil
+	}
+	return relayUDP(srcConn, dstConn, logEntry)
+}
+
+// relayNegotiation forwards method, auth and cmd request after version to dstConn, the cmd reply is returned unsent
+func relayNegotiation(srcConn net.Conn, dstConn io.ReadWriter) (byte, []byte, error) {
+	req, err := readBytes(srcConn, 1)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read num of methods")
+	}
+	methods, err := readBytes(srcConn, int(req[0]))
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read methods")
+	}
+	if _, err := dstConn.Write(append(req, methods...)); err != nil {
+		return 0, nil, errors.Wrap(err, "write methods")
+	}
+	method, err := relayBytes(srcConn, dstConn, 2)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "relay method")
+	}
+	switch method[1] {
+	case socks5AuthMethodNone:
+	case socks5AuthMethodUserPasswd:
+		if err := relayAuth(srcConn, dstConn); err != nil {
+			return 0, nil, errors.Wrap(err, "relayAuth")
+		}
+	default:
+		return 0, nil, errors.Errorf("unsupported method: %0x", method[1])
+	}
+	hdr, err := readBytes(srcConn, 3)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read cmd")
+	}
+	addr, err := readAddr(srcConn)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read dst")
+	}
+	if _, err := dstConn.Write(append(hdr, addr...)); err != nil {
+		return 0, nil, errors.Wrap(err, "write cmd")
+	}
+	rep, err := readBytes(dstConn, 3)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read cmd reply")
+	}
+	bnd, err := readAddr(dstConn)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read bnd")
+	}
+	return hdr[1], append(rep, bnd...), nil
+}
+
+// relayAuth forwards username/password auth to dstConn and its status back to srcConn
+func relayAuth(srcConn net.Conn, dstConn io.ReadWriter) error {
+	req, err := readBytes(srcConn, 2)
+	if err != nil {
+		return errors.Wrap(err, "read username length")
+	}
+	uname, err := readBytes(srcConn, int(req[1])+1)
+	if err != nil {
+		return errors.Wrap(err, "read username")
+	}
+	passwd, err := readBytes(srcConn, int(uname[len(uname)-1]))
+	if err != nil {
+		return errors.Wrap(err, "read password")
+	}
+	req = append(append(req, uname...), passwd...)
+	if _, err := dstConn.Write(req); err != nil {
+		return errors.Wrap(err, "write auth")
+	}
+	status, err := relayBytes(srcConn, dstConn, 2)
+	if err != nil {
+		return errors.Wrap(err, "relay auth status")
+	}
+	if status[1] != socks5AuthMethodUserPasswdSuccess {
+		return errors.New("auth failed")
+	}
+	return nil
+}
+
+// relayUDP serves datagrams from the local client over dstConn until srcConn closes
+func relayUDP(srcConn net.Conn, dstConn io.ReadWriter, logEntry *log.Entry) error {
+	local := srcConn.LocalAddr().(*net.TCPAddr)
+	remote := srcConn.RemoteAddr().(*net.TCPAddr)
+	rep := newCmdRep()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		rep.rep = socks5RepServerFailure
+		rep.write(srcConn)
+		return errors.Wrap(err, "net.ListenUDP")
+	}
+	defer udpConn.Close()
+	bnd := udpConn.LocalAddr().(*net.UDPAddr)
+	rep.setBnd(bnd.IP, bnd.Port)
+	if err := rep.write(srcConn); err != nil {
+		return errors.Wrap(err, "rep.write")
+	}
+	logEntry.Infof("Open UDP relay %s", udpConn.LocalAddr())
+	var (
+		mu         sync.Mutex
+		clientAddr *net.UDPAddr
+	)
+	errc := make(chan error, 3)
+	go func() {
+		buf := make([]byte, maxUDPFrameSize)
+		for {
+			packet, err := readUDPFrame(dstConn, buf)
+			if err != nil {
+				errc <- errors.Wrap(err, "readUDPFrame")
+				return
+			}
+			mu.Lock()
+			addr := clientAddr
+			mu.Unlock()
+			if addr == nil {
+				continue
+			}
+			if _, err := udpConn.WriteToUDP(packet, addr); err != nil {
+				logEntry.Debugf("udpConn.WriteToUDP: %s", err)
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxUDPFrameSize)
+		for {
+			n, addr, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				errc <- errors.Wrap(err, "udpConn.ReadFromUDP")
+				return
+			}
+			// only the client of the control conn may use this relay
+			if !addr.IP.Equal(remote.IP) {
+				logEntry.Debugf("drop datagram from %s", addr)
+				continue
+			}
+			if n < 4 || buf[2] != 0 {
+				logEntry.Debugf("drop invalid or fragmented datagram from %s", addr)
+				continue
+			}
+			mu.Lock()
+			clientAddr = addr
+			mu.Unlock()
+			if err := writeUDPFrame(dstConn, buf[:n]); err != nil {
+				errc <- errors.Wrap(err, "writeUDPFrame")
+				return
+			}
+		}
+	}()
+	go func() {
+		// the association terminates when the control conn closes
+		_, err := io.Copy(ioutil.Discard, srcConn)
+		errc <- errors.Wrap(err, "read control conn")
+	}()
+	err = <-errc
+	logEntry.Infof("Close UDP relay %s", udpConn.LocalAddr())
+	if err != nil && errors.Cause(err) != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// relayBytes reads n bytes from dstConn and writes them to srcConn
+func relayBytes(srcConn net.Conn, dstConn io.Reader, n int) ([]byte, error) {
+	b, err := readBytes(dstConn, n)
+	if err != nil {
+		return nil, errors.Wrap(err, "readBytes")
+	}
+	if _, err := srcConn.Write(b); err != nil {
+		return nil, errors.Wrap(err, "write")
+	}
+	return b, nil
+}
+
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readAddr reads ATYP, ADDR and PORT fields as is
+func readAddr(r io.Reader) ([]byte, error) {
+	atyp, err := readBytes(r, 1)
+	if err != nil {
+		return nil, errors.Wrap(err, "read address type")
+	}
+	var n int
+	switch atyp[0] {
+	case socks5AddrTypeIPv4:
+		n = net.IPv4len
+	case socks5AddrTypeDomain:
+		na, err := readBytes(r, 1)
+		if err != nil {
+			return nil, errors.Wrap(err, "read num of domain address")
+		}
+		atyp = append(atyp, na[0])
+		n = int(na[0])
+	case socks5AddrTypeIPv6:
+		n = net.IPv6len
+	default:
+		return nil, errors.Errorf("unsupported address type: %0x", atyp[0])
+	}
+	addr, err := readBytes(r, n+2)
+	if err != nil {
+		return nil, errors.Wrap(err, "read address")
+	}
+	return append(atyp, addr...), nil
+}
@@ -1,40 +1,70 @@
 package socks5
 
 import (
+	"context"
 	"net"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/auth"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
 	"github.com/mikumaycry/akari/internal/pkg/transport"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// bindTimeout limits the wait for the peer of a bind request
+var bindTimeout = 60 * time.Second
+
 // HandleConn handle socks5
-func HandleConn(srcConn net.Conn, cfg *config.ServerConf, origLogEntry *log.Entry) {
+func HandleConn(srcConn net.Conn, cfg *config.ServerConf, info *conninfo.Info, origLogEntry *log.Entry) {
 	if err := handleMethod(srcConn); err != nil {
 		origLogEntry.Errorf("handleMethod: %s", err)
 		return
 	}
-	if err := handleAuth(srcConn, cfg.Auth); err != nil {
+	user, err := handleAuth(srcConn, cfg.Credentials)
+	if err != nil {
 		origLogEntry.Errorf("handleAuth: %s", err)
 		return
 	}
-	cmd, dstAddr, err := handleCmd(srcConn)
+	if len(user) != 0 {
+		info.SetUser(user)
+		origLogEntry = origLogEntry.WithField("User", user)
+	}
+	cmd, dstAddr, err := handleCmd(srcConn, cfg.EnableBind)
 	if err != nil {
 		origLogEntry.Errorf("handleCmd: %s", err)
 		return
 	}
 	logEntry := origLogEntry.WithField("DST", dstAddr)
+	if err := info.Allow(); err != nil {
+		rep := newCmdRep()
+		rep.rep = socks5RepNotAllowed
+		rep.write(srcConn)
+		logEntry.Errorf("info.Allow: %s", err)
+		return
+	}
 	defer logEntry.Info("Close DST")
 	logEntry.Info("Open DST")
 	switch cmd {
 	case socks5CmdConnect:
-		handleConnect(dstAddr, logEntry, srcConn)
+		handleConnect(dstAddr, cfg, info.User(), logEntry, srcConn)
 	case socks5CmdBind:
-		handleBind(dstAddr, logEntry, srcConn)
+		handleBind(dstAddr, cfg.Policy, logEntry, srcConn)
 	case socks5CmdUDP:
-		handleUDP(dstAddr, logEntry, srcConn)
+		// datagrams are sent from this host, so outbound and rules of route can not be applied
+		if cfg.Router != nil || !outbound.IsDirect(cfg.Dialer) {
+			rep := newCmdRep()
+			rep.rep = socks5RepCmdUnsupported
+			rep.write(srcConn)
+			logEntry.Error("udp associate is not supported with outbound or rules")
+			return
+		}
+		handleUDP(dstAddr, cfg.Policy, logEntry, srcConn)
 	}
 }
 
@@ -46,24 +76,24 @@ func handleMethod(srcConn net.Conn) error {
 	return nil
 }
 
-func handleAuth(srcConn net.Conn, auth string) error {
+func handleAuth(srcConn net.Conn, users *auth.Users) (string, error) {
 	var req authReq
-	if err := req.read(srcConn, auth); err != nil {
-		return errors.Wrap(err, "req.read")
+	if err := req.read(srcConn, users); err != nil {
+		return "", errors.Wrap(err, "req.read")
 	}
-	return nil
+	return string(req.uname), nil
 }
 
-func handleCmd(srcConn net.Conn) (cmd byte, dst string, err error) {
+func handleCmd(srcConn net.Conn, enableBind bool) (cmd byte, dst string, err error) {
 	var req cmdReq
-	if err := req.read(srcConn); err != nil {
+	if err := req.read(srcConn, enableBind); err != nil {
 		return 0, "", errors.Wrap(err, "req.read")
 	}
 	return req.cmd, req.dst, nil
 }
 
-func handleConnect(dstAddr string, logEntry *log.Entry, srcConn net.Conn) {
-	dstConn, err := handleConnectDial(dstAddr, srcConn)
+func handleConnect(dstAddr string, cfg *config.ServerConf, user string, logEntry *log.Entry, srcConn net.Conn) {
+	dstConn, err := handleConnectDial(dstAddr, cfg, user, srcConn)
 	if err != nil {
 		logEntry.Errorf("handleConnectDial: %s", err)
 		return
@@ -72,32 +102,112 @@ func handleConnect(dstAddr string, logEntry *log.Entry, srcConn net.Conn) {
 	transport.Transport(srcConn, dstConn)
 }
 
-func handleBind(dstAddr string, logEntry *log.Entry, srcConn net.Conn) {
+func handleBind(dstAddr string, policy *acl.Policy, logEntry *log.Entry, srcConn net.Conn) {
+	dstConn, err := handleBindAccept(dstAddr, policy, logEntry, srcConn)
+	if err != nil {
+		logEntry.Errorf("handleBindAccept: %s", err)
+		return
+	}
+	defer dstConn.Close()
+	transport.Transport(srcConn, dstConn)
+}
 
+// handleBindAccept listens on the local ip of srcConn for one conn from dst and sends both replies of bind,
+// dst is checked by policy like connect, conns from other peers are closed
+func handleBindAccept(dstAddr string, policy *acl.Policy, logEntry *log.Entry, srcConn net.Conn) (net.Conn, error) {
+	rep := newCmdRep()
+	ctx, cancel := context.WithTimeout(context.Background(), bindTimeout)
+	peers, _, err := policy.Resolve(ctx, dstAddr)
+	cancel()
+	if err != nil {
+		rep.rep = socks5RepHostUnreachable
+		if errors.Cause(err) == acl.ErrDenied {
+			rep.rep = socks5RepNotAllowed
+		}
+		rep.write(srcConn)
+		return nil, errors.Wrap(err, "policy.Resolve")
+	}
+	local, ok := srcConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		rep.rep = socks5RepServerFailure
+		rep.write(srcConn)
+		return nil, errors.Errorf("unexpected local addr: %v", srcConn.LocalAddr())
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP})
+	if err != nil {
+		rep.rep = socks5RepServerFailure
+		rep.write(srcConn)
+		return nil, errors.Wrap(err, "net.ListenTCP")
+	}
+	defer ln.Close()
+	rep.setBnd(local.IP, ln.Addr().(*net.TCPAddr).Port)
+	if err := rep.write(srcConn); err != nil {
+		return nil, errors.Wrap(err, "write first reply")
+	}
+	logEntry.Infof("Bind %s", ln.Addr())
+	ln.SetDeadline(time.Now().Add(bindTimeout))
+	rep = newCmdRep()
+	for {
+		dstConn, err := ln.AcceptTCP()
+		if err != nil {
+			rep.rep = socks5RepTLLExpired
+			rep.write(srcConn)
+			return nil, errors.Wrap(err, "ln.AcceptTCP")
+		}
+		peer := dstConn.RemoteAddr().(*net.TCPAddr)
+		if !containsIP(peers, peer.IP) {
+			logEntry.Warnf("Bind reject unexpected peer %s", peer)
+			dstConn.Close()
+			continue
+		}
+		rep.setBnd(peer.IP, peer.Port)
+		if err := rep.write(srcConn); err != nil {
+			dstConn.Close()
+			return nil, errors.Wrap(err, "write second reply")
+		}
+		return dstConn, nil
+	}
 }
 
-func handleUDP(dstAddr string, logEntry *log.Entry, srcConn net.Conn) {
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
 
+// dialRep maps error of dial to reply code
+func dialRep(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, acl.ErrDenied):
+		return socks5RepNotAllowed
+	case errors.As(err, &dnsErr):
+		return socks5RepHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5RepTLLExpired
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5RepHostUnreachable
+	}
+	return socks5RepServerFailure
 }
 
-func handleConnectDial(dstAddr string, srcConn net.Conn) (net.Conn, error) {
+func handleConnectDial(dstAddr string, cfg *config.ServerConf, user string, srcConn net.Conn) (net.Conn, error) {
 	rep := newCmdRep()
 	defer func() {
 		rep.write(srcConn)
 	}()
-	dstConn, err := net.Dial("tcp", dstAddr)
+	dstConn, err := cfg.Dial(user, "tcp", dstAddr)
 	if err != nil {
-		switch e := err.(type) {
-		case *net.OpError:
-			switch e.Err.(type) {
-			case *net.DNSError:
-				rep.rep = socks5RepHostUnreachable
-			}
-			rep.rep = socks5RepServerFailure
-		default:
-			rep.rep = socks5RepServerFailure
-		}
-		return nil, errors.Wrap(err, "net.Dial")
+		rep.rep = dialRep(err)
+		return nil, errors.Wrap(err, "cfg.Dial")
 	}
 	host, port, err := net.SplitHostPort(dstConn.LocalAddr().String())
 	if err != nil {
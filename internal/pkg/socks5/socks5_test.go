@@ -0,0 +1,54 @@
+package socks5
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/pkg/errors"
+)
+
+func opError(err error) error {
+	return errors.Wrap(&net.OpError{Op: "dial", Net: "tcp", Err: err}, "cfg.Dial")
+}
+
+func TestDialRep(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		rep  byte
+	}{
+		{"denied", errors.Wrap(acl.ErrDenied, "10.0.0.1:80"), socks5RepNotAllowed},
+		{"dns", errors.Wrap(&net.DNSError{Err: "no such host", Name: "a.test", IsNotFound: true}, "resolver.LookupIP"), socks5RepHostUnreachable},
+		{"timeout", opError(os.ErrDeadlineExceeded), socks5RepTLLExpired},
+		{"refused", opError(os.NewSyscallError("connect", syscall.ECONNREFUSED)), socks5RepConnRefused},
+		{"no network", opError(os.NewSyscallError("connect", syscall.ENETUNREACH)), socks5RepNetworkUnreachable},
+		{"no host", opError(os.NewSyscallError("connect", syscall.EHOSTUNREACH)), socks5RepHostUnreachable},
+		{"other", errors.New("handshake"), socks5RepServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dialRep(tt.err); got != tt.rep {
+				t.Errorf("dialRep() = %d, want %d", got, tt.rep)
+			}
+		})
+	}
+}
+
+func TestDialRepRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Skip("closed port accepted conn")
+	}
+	if got := dialRep(errors.Wrap(err, "cfg.Dial")); got != socks5RepConnRefused {
+		t.Errorf("dialRep() = %d, want %d", got, socks5RepConnRefused)
+	}
+}
@@ -0,0 +1,180 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// UDP ASSOCIATE datagrams are carried over the tunnel stream as frames of
+// 2 bytes big endian length followed by a socks5 UDP request:
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+
+const maxUDPFrameSize = 65535
+
+func readUDPFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, errors.Wrap(err, "read frame length")
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, errors.Wrap(err, "read frame")
+	}
+	return buf[:n], nil
+}
+
+func writeUDPFrame(w io.Writer, packet []byte) error {
+	if len(packet) > maxUDPFrameSize {
+		return errors.Errorf("packet too large: %d", len(packet))
+	}
+	buf := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(buf, uint16(len(packet)))
+	copy(buf[2:], packet)
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "write frame")
+	}
+	return nil
+}
+
+// parseUDPPacket returns dst addr and data of a socks5 UDP request
+func parseUDPPacket(packet []byte) (string, []byte, error) {
+	if len(packet) < 4 {
+		return "", nil, errors.New("packet too short")
+	}
+	if packet[2] != 0 {
+		return "", nil, errors.Errorf("fragmentation is not supported: %d", packet[2])
+	}
+	var host string
+	b := packet[4:]
+	switch packet[3] {
+	case socks5AddrTypeIPv4:
+		if len(b) < net.IPv4len+2 {
+			return "", nil, errors.New("packet too short")
+		}
+		host = net.IP(b[:net.IPv4len]).String()
+		b = b[net.IPv4len:]
+	case socks5AddrTypeDomain:
+		if len(b) < 1 || len(b) < 1+int(b[0])+2 {
+			return "", nil, errors.New("packet too short")
+		}
+		host = string(b[1 : 1+b[0]])
+		b = b[1+b[0]:]
+	case socks5AddrTypeIPv6:
+		if len(b) < net.IPv6len+2 {
+			return "", nil, errors.New("packet too short")
+		}
+		host = net.IP(b[:net.IPv6len]).String()
+		b = b[net.IPv6len:]
+	default:
+		return "", nil, errors.Errorf("unsupported address type: %0x", packet[3])
+	}
+	port := binary.BigEndian.Uint16(b)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), b[2:], nil
+}
+
+// buildUDPPacket prepends socks5 UDP request header of src addr to data
+func buildUDPPacket(src *net.UDPAddr, data []byte) []byte {
+	buf := make([]byte, 0, 4+net.IPv6len+2+len(data))
+	if ipv4 := src.IP.To4(); ipv4 != nil {
+		buf = append(buf, 0, 0, 0, socks5AddrTypeIPv4)
+		buf = append(buf, ipv4...)
+	} else {
+		buf = append(buf, 0, 0, 0, socks5AddrTypeIPv6)
+		buf = append(buf, src.IP.To16()...)
+	}
+	buf = append(buf, byte(src.Port>>8), byte(src.Port))
+	return append(buf, data...)
+}
+
+// peerKey identifies a udp peer, ipv4 and ipv4-mapped ipv6 addrs are the same peer
+func peerKey(addr *net.UDPAddr) string {
+	ip := addr.IP
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port))
+}
+
+// handleUDP relays datagrams of client to dst addrs directly, outbound and rules of route are not applied,
+// only replies from addrs client has sent to are relayed back
+func handleUDP(dstAddr string, policy *acl.Policy, logEntry *log.Entry, srcConn net.Conn) {
+	rep := newCmdRep()
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		rep.rep = socks5RepServerFailure
+		rep.write(srcConn)
+		logEntry.Errorf("net.ListenUDP: %s", err)
+		return
+	}
+	defer udpConn.Close()
+	// datagrams are carried over srcConn, bnd addr is replaced with local relay addr by agent
+	if err := rep.write(srcConn); err != nil {
+		logEntry.Errorf("rep.write: %s", err)
+		return
+	}
+	var mu sync.Mutex
+	peers := make(map[string]struct{})
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, maxUDPFrameSize)
+		for {
+			packet, err := readUDPFrame(srcConn, buf)
+			if err != nil {
+				errc <- errors.Wrap(err, "readUDPFrame")
+				return
+			}
+			dst, data, err := parseUDPPacket(packet)
+			if err != nil {
+				logEntry.Debugf("parseUDPPacket: %s", err)
+				continue
+			}
+			ips, port, err := policy.Resolve(context.Background(), dst)
+			if err != nil {
+				logEntry.Debugf("policy.Resolve: %s", err)
+				continue
+			}
+			addr := &net.UDPAddr{IP: ips[0], Port: port}
+			mu.Lock()
+			peers[peerKey(addr)] = struct{}{}
+			mu.Unlock()
+			if _, err := udpConn.WriteToUDP(data, addr); err != nil {
+				logEntry.Debugf("udpConn.WriteToUDP: %s", err)
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxUDPFrameSize)
+		for {
+			n, addr, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				errc <- errors.Wrap(err, "udpConn.ReadFromUDP")
+				return
+			}
+			mu.Lock()
+			_, ok := peers[peerKey(addr)]
+			mu.Unlock()
+			if !ok {
+				logEntry.Debugf("drop datagram from unknown peer: %s", addr)
+				continue
+			}
+			if err := writeUDPFrame(srcConn, buildUDPPacket(addr, buf[:n])); err != nil {
+				errc <- errors.Wrap(err, "writeUDPFrame")
+				return
+			}
+		}
+	}()
+	if err := <-errc; err != nil && errors.Cause(err) != io.EOF {
+		logEntry.Debugf("udp relay: %s", err)
+	}
+}
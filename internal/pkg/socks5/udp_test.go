@@ -0,0 +1,243 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+	"github.com/mikumaycry/akari/internal/pkg/rules"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestUDPFrame(t *testing.T) {
+	var buf bytes.Buffer
+	for _, v := range [][]byte{[]byte("a"), {}, bytes.Repeat([]byte("b"), 1000)} {
+		if err := writeUDPFrame(&buf, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rbuf := make([]byte, maxUDPFrameSize)
+	for _, want := range []string{"a", "", string(bytes.Repeat([]byte("b"), 1000))} {
+		got, err := readUDPFrame(&buf, rbuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("readUDPFrame() = %q, want %q", got, want)
+		}
+	}
+	if _, err := readUDPFrame(bytes.NewReader([]byte{0, 4, 'a'}), rbuf); err == nil {
+		t.Error("readUDPFrame() of truncated frame succeeded")
+	}
+	if err := writeUDPFrame(&buf, make([]byte, maxUDPFrameSize+1)); err == nil {
+		t.Error("writeUDPFrame() of large packet succeeded")
+	}
+}
+
+func TestParseUDPPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		dst    string
+		data   string
+		err    bool
+	}{
+		{"ipv4", []byte{0, 0, 0, 1, 1, 2, 3, 4, 0, 53, 'x'}, "1.2.3.4:53", "x", false},
+		{"domain", []byte{0, 0, 0, 3, 6, 'a', '.', 't', 'e', 's', 't', 1, 187, 'y', 'z'}, "a.test:443", "yz", false},
+		{"ipv6", append([]byte{0, 0, 0, 4}, append(net.ParseIP("2001:db8::1"), 0, 80)...), "[2001:db8::1]:80", "", false},
+		{"short header", []byte{0, 0, 0}, "", "", true},
+		{"short ipv4", []byte{0, 0, 0, 1, 1, 2, 3, 4, 0}, "", "", true},
+		{"short domain", []byte{0, 0, 0, 3, 6, 'a', '.', 't', 0, 53}, "", "", true},
+		{"fragment", []byte{0, 0, 1, 1, 1, 2, 3, 4, 0, 53}, "", "", true},
+		{"address type", []byte{0, 0, 0, 5, 1, 2, 3, 4, 0, 53}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, data, err := parseUDPPacket(tt.packet)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseUDPPacket() error = %v, want error %v", err, tt.err)
+			}
+			if dst != tt.dst || string(data) != tt.data {
+				t.Errorf("parseUDPPacket() = %s %q, want %s %q", dst, data, tt.dst, tt.data)
+			}
+		})
+	}
+}
+
+func TestBuildUDPPacket(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.ParseIP("1.2.3.4"), Port: 53},
+		{IP: net.ParseIP("2001:db8::1"), Port: 8080},
+	} {
+		dst, data, err := parseUDPPacket(buildUDPPacket(addr, []byte("data")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dst != addr.String() || string(data) != "data" {
+			t.Errorf("parseUDPPacket(buildUDPPacket(%s)) = %s %q", addr, dst, data)
+		}
+	}
+}
+
+// socks5Pair serves socks5 conns of local listener by RelayConn of agent, streams to server are pipes served by HandleConn
+func socks5Pair(t *testing.T, cfg *config.ServerConf) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	logEntry := log.NewEntry(log.StandardLogger())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c1, c2 := net.Pipe()
+			go func() {
+				defer c2.Close()
+				HandleConn(c2, cfg, &conninfo.Info{}, logEntry)
+			}()
+			go func() {
+				defer conn.Close()
+				defer c1.Close()
+				RelayConn(conn, c1, logEntry)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialSocks5 negotiates no auth and sends cmd, the reply is returned
+func dialSocks5(t *testing.T, addr string, cmd []byte) (net.Conn, []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{verSocks5, 1, socks5AuthMethodNone}); err != nil {
+		t.Fatal(err)
+	}
+	method, err := readBytes(conn, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method[1] != socks5AuthMethodNone {
+		t.Fatalf("method = %d", method[1])
+	}
+	if _, err := conn.Write(cmd); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := readBytes(conn, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bnd, err := readAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, append(rep, bnd...)
+}
+
+// udpEcho echoes datagrams, a datagram is sent from spoof to the sender first if spoof is not nil
+func udpEcho(t *testing.T, spoof *net.UDPConn) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if spoof != nil {
+				spoof.WriteToUDP([]byte("spoof"), addr)
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPAssociate(t *testing.T) {
+	policy, err := acl.New(&acl.Conf{AllowPrivate: true}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := socks5Pair(t, &config.ServerConf{Policy: policy})
+	echo := udpEcho(t, nil)
+	spoofer := udpEcho(t, udpEcho(t, nil))
+
+	ctrl, rep := dialSocks5(t, addr, []byte{verSocks5, socks5CmdUDP, 0, socks5AddrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	if rep[1] != socks5RepSuccesss || rep[3] != socks5AddrTypeIPv4 {
+		t.Fatalf("reply = %v", rep)
+	}
+	relay := &net.UDPAddr{IP: net.IP(rep[4:8]), Port: int(rep[8])<<8 | int(rep[9])}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	dst := echo.LocalAddr().(*net.UDPAddr)
+	if _, err := client.WriteToUDP(buildUDPPacket(dst, []byte("ping")), relay); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, data, err := parseUDPPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src != dst.String() || string(data) != "ping" {
+		t.Errorf("reply = %s %q, want %s ping", src, data, dst)
+	}
+
+	// datagrams of peers client has not sent to are dropped
+	dst = spoofer.LocalAddr().(*net.UDPAddr)
+	if _, err := client.WriteToUDP(buildUDPPacket(dst, []byte("pong")), relay); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, data, _ := parseUDPPacket(buf[:n]); src != dst.String() || string(data) != "pong" {
+		t.Errorf("reply = %s %q, want %s pong", src, data, dst)
+	}
+
+	// association ends with control conn
+	ctrl.Close()
+	time.Sleep(50 * time.Millisecond)
+	client.WriteToUDP(buildUDPPacket(dst, []byte("late")), relay)
+	client.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := client.ReadFromUDP(buf); err == nil {
+		t.Error("relay still open after control conn closed")
+	}
+}
+
+func TestUDPAssociateRefused(t *testing.T) {
+	addr := socks5Pair(t, &config.ServerConf{Router: &rules.Router{}})
+	conn, rep := dialSocks5(t, addr, []byte{verSocks5, socks5CmdUDP, 0, socks5AddrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	if rep[1] != socks5RepCmdUnsupported {
+		t.Fatalf("reply = %v, want command not supported", rep)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Errorf("conn not closed: %s", err)
+	}
+}
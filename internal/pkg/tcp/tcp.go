@@ -4,17 +4,44 @@ import (
 	"net"
 
 	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+	"github.com/mikumaycry/akari/internal/pkg/proxyproto"
 	"github.com/mikumaycry/akari/internal/pkg/transport"
 	log "github.com/sirupsen/logrus"
 )
 
 // HandleConn handle TCP
-func HandleConn(srcConn net.Conn, cfg *config.ServerConf, logEntry *log.Entry) {
-	dstConn, err := net.Dial("tcp", cfg.Addr)
-	if err != nil {
-		logEntry.Errorf("net.Dial: %s", err)
+func HandleConn(srcConn net.Conn, cfg *config.ServerConf, info *conninfo.Info, logEntry *log.Entry) {
+	if err := info.Allow(); err != nil {
+		logEntry.Errorf("info.Allow: %s", err)
 		return
 	}
+	var (
+		dstConn net.Conn
+		err     error
+	)
+	if cfg.Balancer != nil {
+		var addr string
+		dstConn, addr, err = cfg.Balancer.Dial(cfg.Dialer, srcConn.RemoteAddr())
+		if err != nil {
+			logEntry.Errorf("cfg.Balancer.Dial: %s", err)
+			return
+		}
+		logEntry = logEntry.WithField("DST", addr)
+		logEntry.Debug("Open backend")
+	} else {
+		dstConn, err = cfg.Dialer.Dial("tcp", cfg.Addr)
+		if err != nil {
+			logEntry.Errorf("cfg.Dialer.Dial: %s", err)
+			return
+		}
+	}
 	defer dstConn.Close()
+	if cfg.ProxyProtocol != 0 {
+		if err := proxyproto.WriteHeader(dstConn, cfg.ProxyProtocol, srcConn.RemoteAddr(), srcConn.LocalAddr(), info.SNI); err != nil {
+			logEntry.Errorf("proxyproto.WriteHeader: %s", err)
+			return
+		}
+	}
 	transport.Transport(srcConn, dstConn)
 }
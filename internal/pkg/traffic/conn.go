@@ -0,0 +1,69 @@
+package traffic
+
+import (
+	"net"
+	"sync"
+
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+)
+
+// Conn counts bytes read from and written to client on the entry of route and user in info
+type Conn struct {
+	net.Conn
+	m    *Meter
+	info *conninfo.Info
+	// auth means user is set by handler later, bytes before that are counted once user is known
+	auth     bool
+	mu       sync.Mutex
+	user     string
+	e        *entry
+	upload   int64
+	download int64
+}
+
+// Wrap returns conn counted by m, auth is true if the route authenticates users
+func (m *Meter) Wrap(conn net.Conn, info *conninfo.Info, auth bool) net.Conn {
+	return &Conn{
+		Conn: conn,
+		m:    m,
+		info: info,
+		auth: auth,
+	}
+}
+
+// Read method
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.add(int64(n), 0)
+	}
+	return n, err
+}
+
+// Write method
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.add(0, int64(n))
+	}
+	return n, err
+}
+
+func (c *Conn) add(upload, download int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user := c.info.User()
+	if c.e == nil || c.user != user {
+		if c.auth && len(user) == 0 {
+			c.upload += upload
+			c.download += download
+			return
+		}
+		c.user = user
+		c.e = c.m.get(c.info.Route, c.user)
+		upload += c.upload
+		download += c.download
+		c.upload, c.download = 0, 0
+	}
+	c.e.add(upload, download)
+}
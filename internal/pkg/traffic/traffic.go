@@ -0,0 +1,224 @@
+package traffic
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// Usage is traffic of one user on one route, upload is read from client and download is written to client
+type Usage struct {
+	Upload        int64  `json:"upload"`
+	Download      int64  `json:"download"`
+	Day           string `json:"day"`
+	DayUpload     int64  `json:"dayUpload"`
+	DayDownload   int64  `json:"dayDownload"`
+	Month         string `json:"month"`
+	MonthUpload   int64  `json:"monthUpload"`
+	MonthDownload int64  `json:"monthDownload"`
+}
+
+// roll resets counters of past day and month
+func (u *Usage) roll(now time.Time) {
+	if day := now.Format(dayLayout); u.Day != day {
+		u.Day, u.DayUpload, u.DayDownload = day, 0, 0
+	}
+	if month := now.Format(monthLayout); u.Month != month {
+		u.Month, u.MonthUpload, u.MonthDownload = month, 0, 0
+	}
+}
+
+// Current returns a copy with counters of past day and month reset
+func (u Usage) Current(now time.Time) Usage {
+	u.roll(now)
+	return u
+}
+
+// Report is usage keyed by route and user, anonymous user is keyed by empty string
+type Report struct {
+	Updated time.Time                    `json:"updated"`
+	Routes  map[string]map[string]*Usage `json:"routes"`
+}
+
+type key struct {
+	route string
+	user  string
+}
+
+type entry struct {
+	mu    sync.Mutex
+	usage Usage
+}
+
+func (e *entry) add(upload, download int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.usage.roll(time.Now())
+	e.usage.Upload += upload
+	e.usage.DayUpload += upload
+	e.usage.MonthUpload += upload
+	e.usage.Download += download
+	e.usage.DayDownload += download
+	e.usage.MonthDownload += download
+}
+
+func (e *entry) snapshot() Usage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.usage.roll(time.Now())
+	return e.usage
+}
+
+// Meter counts traffic per route and user, and saves it to storage periodically
+type Meter struct {
+	mu       sync.Mutex
+	entries  map[key]*entry
+	storage  string
+	interval time.Duration
+}
+
+// New loads usage saved in storage, usage is kept in memory only if storage is empty
+func New(storage string, interval time.Duration) (*Meter, error) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	m := &Meter{
+		entries:  make(map[key]*entry),
+		storage:  storage,
+		interval: interval,
+	}
+	if len(storage) == 0 {
+		return m, nil
+	}
+	report, err := Load(storage)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return m, nil
+		}
+		return nil, errors.Wrap(err, "Load")
+	}
+	for route, users := range report.Routes {
+		for user, usage := range users {
+			m.entries[key{route: route, user: user}] = &entry{usage: *usage}
+		}
+	}
+	return m, nil
+}
+
+// Load reads report from storage
+func Load(storage string) (*Report, error) {
+	data, err := ioutil.ReadFile(storage)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadFile")
+	}
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+	return &report, nil
+}
+
+// Run saves usage every interval until done is closed
+func (m *Meter) Run(done <-chan struct{}) {
+	if len(m.storage) == 0 {
+		return
+	}
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Save(); err != nil {
+				log.Errorf("traffic: save %s: %s", m.storage, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Report returns a snapshot of usage
+func (m *Meter) Report() *Report {
+	m.mu.Lock()
+	entries := make(map[key]*entry, len(m.entries))
+	for k, v := range m.entries {
+		entries[k] = v
+	}
+	m.mu.Unlock()
+	report := &Report{
+		Updated: time.Now(),
+		Routes:  make(map[string]map[string]*Usage),
+	}
+	for k, v := range entries {
+		users, ok := report.Routes[k.route]
+		if !ok {
+			users = make(map[string]*Usage)
+			report.Routes[k.route] = users
+		}
+		usage := v.snapshot()
+		users[k.user] = &usage
+	}
+	return report
+}
+
+// Save writes usage to storage atomically, nothing is written if storage is empty
+func (m *Meter) Save() error {
+	if len(m.storage) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.Report(), "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "json.MarshalIndent")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.storage), filepath.Base(m.storage)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "ioutil.TempFile")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "tmp.Write")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "tmp.Close")
+	}
+	if err := os.Rename(tmp.Name(), m.storage); err != nil {
+		return errors.Wrap(err, "os.Rename")
+	}
+	return nil
+}
+
+func (m *Meter) get(route, user string) *entry {
+	k := key{route: route, user: user}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[k]
+	if !ok {
+		e = &entry{}
+		m.entries[k] = e
+	}
+	return e
+}
+
+// Allow checks daily and monthly quota in bytes of user on route, zero means unlimited
+func (m *Meter) Allow(route, user string, daily, monthly int64) error {
+	usage := m.get(route, user).snapshot()
+	if daily > 0 && usage.DayUpload+usage.DayDownload >= daily {
+		return errors.Errorf("daily quota exceeded: %d bytes", daily)
+	}
+	if monthly > 0 && usage.MonthUpload+usage.MonthDownload >= monthly {
+		return errors.Errorf("monthly quota exceeded: %d bytes", monthly)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package traffic
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+)
+
+// testConn reads from r and writes to w
+type testConn struct {
+	net.Conn
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func (c *testConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *testConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func newTestConn(data string) *testConn {
+	return &testConn{r: bytes.NewReader([]byte(data))}
+}
+
+func usageOf(m *Meter, route, user string) Usage {
+	return m.get(route, user).snapshot()
+}
+
+func TestUsageRoll(t *testing.T) {
+	u := Usage{
+		Upload: 10, Download: 20,
+		Day: "2024-01-31", DayUpload: 1, DayDownload: 2,
+		Month: "2024-01", MonthUpload: 3, MonthDownload: 4,
+	}
+	tests := []struct {
+		name string
+		now  time.Time
+		want Usage
+	}{
+		{"same day", time.Date(2024, 1, 31, 23, 0, 0, 0, time.Local), u},
+		{"other day", time.Date(2024, 1, 30, 0, 0, 0, 0, time.Local), Usage{
+			Upload: 10, Download: 20,
+			Day:   "2024-01-30",
+			Month: "2024-01", MonthUpload: 3, MonthDownload: 4,
+		}},
+		{"next month", time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local), Usage{
+			Upload: 10, Download: 20,
+			Day:   "2024-02-01",
+			Month: "2024-02",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := u.Current(tt.now); got != tt.want {
+				t.Errorf("Current() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConn(t *testing.T) {
+	m, err := New("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &conninfo.Info{Route: "a.test"}
+	conn := m.Wrap(newTestConn("hello"), info, false)
+	ioutil.ReadAll(conn)
+	conn.Write([]byte("abc"))
+	if u := usageOf(m, "a.test", ""); u.Upload != 5 || u.Download != 3 || u.DayUpload != 5 || u.MonthDownload != 3 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestConnAuth(t *testing.T) {
+	m, err := New("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &conninfo.Info{Route: "a.test"}
+	conn := m.Wrap(newTestConn("auth"), info, true)
+	// bytes before auth are counted on the user
+	buf := make([]byte, 4)
+	conn.Read(buf)
+	conn.Write([]byte("ok"))
+	if u := usageOf(m, "a.test", ""); u.Upload != 0 || u.Download != 0 {
+		t.Errorf("anonymous usage = %+v", u)
+	}
+	info.SetUser("u1")
+	conn.Write([]byte("data"))
+	if u := usageOf(m, "a.test", "u1"); u.Upload != 4 || u.Download != 6 {
+		t.Errorf("usage of u1 = %+v", u)
+	}
+	// a stream of mux conn may switch user
+	info.SetUser("u2")
+	conn.Write([]byte("x"))
+	if u := usageOf(m, "a.test", "u2"); u.Upload != 0 || u.Download != 1 {
+		t.Errorf("usage of u2 = %+v", u)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	m, err := New("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.get("a.test", "u1").add(60, 40)
+	tests := []struct {
+		name    string
+		user    string
+		daily   int64
+		monthly int64
+		err     bool
+	}{
+		{"unlimited", "u1", 0, 0, false},
+		{"under daily", "u1", 101, 0, false},
+		{"daily", "u1", 100, 0, true},
+		{"monthly", "u1", 0, 100, true},
+		{"other user", "u2", 100, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.Allow("a.test", tt.user, tt.daily, tt.monthly); (err != nil) != tt.err {
+				t.Errorf("Allow() error = %v, want error %v", err, tt.err)
+			}
+		})
+	}
+	// counters of past days are not counted on today
+	e := m.get("a.test", "u3")
+	e.usage = Usage{Upload: 500, Day: "2000-01-01", DayUpload: 500, Month: "2000-01", MonthUpload: 500}
+	if err := m.Allow("a.test", "u3", 100, 100); err != nil {
+		t.Errorf("Allow() of past usage error = %v", err)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "traffic.json")
+	m, err := New(storage, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.get("a.test", "u1").add(1, 2)
+	m.get("a.test", "").add(3, 4)
+	m.get("b.test", "u1").add(5, 6)
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Load(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := report.Routes["b.test"]["u1"]; u == nil || u.Upload != 5 || u.Download != 6 {
+		t.Errorf("loaded usage = %+v", u)
+	}
+	m2, err := New(storage, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2.get("a.test", "u1").add(1, 1)
+	if u := usageOf(m2, "a.test", "u1"); u.Upload != 2 || u.Download != 3 || u.DayUpload != 2 {
+		t.Errorf("usage after reload = %+v", u)
+	}
+	if u := usageOf(m2, "a.test", ""); u.Upload != 3 || u.Download != 4 {
+		t.Errorf("anonymous usage after reload = %+v", u)
+	}
+	files, err := ioutil.ReadDir(filepath.Dir(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("temp files left: %d files", len(files))
+	}
+}
+
+func TestNewStorage(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := New(filepath.Join(dir, "missing.json"), 0); err != nil {
+		t.Errorf("New() of missing storage error = %v", err)
+	}
+	bad := filepath.Join(dir, "bad.json")
+	if err := ioutil.WriteFile(bad, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(bad, 0); err == nil {
+		t.Error("New() of invalid storage succeeded")
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/ratelimit"
+)
+
+const (
+	limitUpload   = "upload"
+	limitDownload = "download"
+	limitConns    = "conns"
+	limitStreams  = "streams"
+)
+
+// buckets returns buckets of kind shared by route of cfg and of user on the route
+func (s *Server) buckets(cfg *config.ServerConf, user, kind string) []*ratelimit.Bucket {
+	var buckets []*ratelimit.Bucket
+	if b := s.limits.Get(limitKey(cfg, "", kind), limitRate(cfg.Limit, kind)); b != nil {
+		buckets = append(buckets, b)
+	}
+	if b := s.limits.Get(limitKey(cfg, user, kind), limitRate(cfg.LimitOf(user), kind)); b != nil {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// limitKey identifies buckets of route or user, registry also keys them by rate
+func limitKey(cfg *config.ServerConf, user, kind string) string {
+	return cfg.SNI + "|" + cfg.Mode + "|" + user + "|" + kind
+}
+
+func limitRate(limit *config.LimitConf, kind string) float64 {
+	if limit == nil {
+		return 0
+	}
+	switch kind {
+	case limitUpload:
+		return float64(limit.Upload)
+	case limitDownload:
+		return float64(limit.Download)
+	case limitConns:
+		return limit.Conns
+	case limitStreams:
+		return limit.Streams
+	}
+	return 0
+}
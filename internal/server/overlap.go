@@ -0,0 +1,162 @@
+package server
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+// hostAlphabet are runes of lower case host names, sni is lowercased before matching
+var hostAlphabet = []rune("abcdefghijklmnopqrstuvwxyz0123456789-_.")
+
+const (
+	// statePre skips runes before a match starts, statePost skips runes after it ends,
+	// so a program is run like regexp.MatchString, which matches anywhere in sni
+	statePre  = -1
+	statePost = -2
+	// prev runes of a name, only word boundaries depend on prev, and the alphabet has no newline
+	prevStart   = -1
+	prevWord    = 'a'
+	prevNonWord = '.'
+)
+
+// hostProg is a compiled pattern, run as an NFA over hostAlphabet
+type hostProg struct {
+	prog  *syntax.Prog
+	steps map[stepKey][]int
+}
+
+type stepKey struct {
+	state int
+	prev  rune
+	next  rune
+}
+
+// compileHost compiles expr like the router does, case insensitively
+func compileHost(expr string) (*hostProg, error) {
+	re, err := syntax.Parse("(?i)"+expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	return &hostProg{prog: prog, steps: make(map[stepKey][]int)}, nil
+}
+
+// wildcardHost compiles names of a wildcard suffix, which is at least one rune followed by suffix
+func wildcardHost(suffix string) *hostProg {
+	p, _ := compileHost("^.+" + regexp.QuoteMeta(suffix) + "$")
+	return p
+}
+
+// closure returns states waiting for a rune after state, between prev and next runes, -1 next is the end of name
+func (p *hostProg) closure(state int, prev, next rune) []int {
+	var out []int
+	seen := make(map[int]bool)
+	var walk func(pc int)
+	walk = func(pc int) {
+		if seen[pc] {
+			return
+		}
+		seen[pc] = true
+		if pc == statePre {
+			out = append(out, statePre)
+			walk(p.prog.Start)
+			return
+		}
+		if pc == statePost {
+			out = append(out, statePost)
+			return
+		}
+		inst := &p.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			walk(int(inst.Out))
+			walk(int(inst.Arg))
+		case syntax.InstCapture, syntax.InstNop:
+			walk(int(inst.Out))
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(inst.Arg)&^syntax.EmptyOpContext(prev, next) == 0 {
+				walk(int(inst.Out))
+			}
+		case syntax.InstMatch:
+			walk(statePost)
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			out = append(out, pc)
+		}
+	}
+	walk(state)
+	return out
+}
+
+// step returns states after state reads next
+func (p *hostProg) step(state int, prev, next rune) []int {
+	key := stepKey{state: state, prev: prev, next: next}
+	if v, ok := p.steps[key]; ok {
+		return v
+	}
+	var out []int
+	for _, pc := range p.closure(state, prev, next) {
+		switch pc {
+		case statePre, statePost:
+			out = append(out, pc)
+			continue
+		}
+		inst := &p.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			out = append(out, int(inst.Out))
+		default:
+			if inst.MatchRune(next) {
+				out = append(out, int(inst.Out))
+			}
+		}
+	}
+	p.steps[key] = out
+	return out
+}
+
+// accepts reports whether a name may end at state
+func (p *hostProg) accepts(state int, prev rune) bool {
+	for _, pc := range p.closure(state, prev, -1) {
+		if pc == statePost {
+			return true
+		}
+	}
+	return false
+}
+
+// intersects reports whether a and b both match a non empty host name, by searching the product of both NFAs
+func intersects(a, b *hostProg) bool {
+	type node struct {
+		a, b int
+		prev rune
+	}
+	start := node{a: statePre, b: statePre, prev: prevStart}
+	seen := map[node]bool{start: true}
+	queue := []node{start}
+	for len(queue) != 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.prev != prevStart && a.accepts(n.a, n.prev) && b.accepts(n.b, n.prev) {
+			return true
+		}
+		for _, c := range hostAlphabet {
+			prev := rune(prevNonWord)
+			if syntax.IsWordChar(c) {
+				prev = prevWord
+			}
+			for _, x := range a.step(n.a, n.prev, c) {
+				for _, y := range b.step(n.b, n.prev, c) {
+					m := node{a: x, b: y, prev: prev}
+					if !seen[m] {
+						seen[m] = true
+						queue = append(queue, m)
+					}
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errHelloPeeked = errors.New("client hello peeked")
+
+// readOnlyConn feeds recorded bytes to tls.Server and rejects writes
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekClientHello parses ClientHello from conn within helloTimeout without consuming it,
+// the returned conn replays the peeked bytes before reading from conn
+func peekClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return nil, conn, errors.Wrap(err, "conn.SetReadDeadline")
+	}
+	peeked := new(bytes.Buffer)
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, peeked)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &tls.ClientHelloInfo{
+				CipherSuites:      h.CipherSuites,
+				ServerName:        h.ServerName,
+				SupportedCurves:   h.SupportedCurves,
+				SupportedPoints:   h.SupportedPoints,
+				SignatureSchemes:  h.SignatureSchemes,
+				SupportedProtos:   h.SupportedProtos,
+				SupportedVersions: h.SupportedVersions,
+			}
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	bfConn := &bufferdConn{Conn: conn, r: io.MultiReader(peeked, conn)}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, bfConn, errors.Wrap(err, "conn.SetReadDeadline")
+	}
+	if hello == nil {
+		return nil, bfConn, errors.Wrap(err, "tls.Server.Handshake")
+	}
+	return hello, bfConn, nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Client(c1, &tls.Config{ServerName: "a.test"}).Handshake()
+
+	hello, conn, err := peekClientHello(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "a.test" {
+		t.Errorf("ServerName = %q, want a.test", hello.ServerName)
+	}
+	// peeked bytes are replayed
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0x16 {
+		t.Errorf("first byte = %#x, want handshake record", b[0])
+	}
+}
+
+func TestPeekClientHelloTimeout(t *testing.T) {
+	old := helloTimeout
+	helloTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { helloTimeout = old })
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := peekClientHello(c2)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("peekClientHello of idle conn succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peekClientHello blocked on idle conn")
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"crypto/x509"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultSNI matches every server name not matched by other routes
+	defaultSNI = "*"
+	// wildcardPrefix marks a wildcard SNI, e.g. *.tun.example.com
+	wildcardPrefix = "*."
+	// regexpPrefix marks a regular expression SNI, e.g. ~^tun-\d+\.example\.com$
+	regexpPrefix = "~"
+)
+
+type wildcardRoute struct {
+	suffix string
+	cfg    *config.ServerConf
+}
+
+type regexpRoute struct {
+	expr string
+	re   *regexp.Regexp
+	cfg  *config.ServerConf
+}
+
+// router matches sni against routes with precedence:
+// exact > longest wildcard > regexp (in load order) > default
+type router struct {
+	exact     map[string]*config.ServerConf
+	wildcards []wildcardRoute
+	regexps   []regexpRoute
+	def       *config.ServerConf
+	clientCAs map[string]*x509.CertPool
+	// refs counts conns using routes, balancers of a retired router are closed once its conns end
+	mu      sync.Mutex
+	refs    int
+	retired bool
+}
+
+func newRouter() *router {
+	return &router{
+		exact:     make(map[string]*config.ServerConf),
+		clientCAs: make(map[string]*x509.CertPool),
+	}
+}
+
+func (r *router) add(cfg config.ServerConf) error {
+	sni := strings.ToLower(strings.TrimSpace(cfg.SNI))
+	if len(sni) == 0 {
+		return errors.New("empty sni")
+	}
+	if sni == defaultSNI {
+		return r.addDefault(cfg)
+	}
+	item := &cfg
+	if err := validateConf(item); err != nil {
+		return errors.Wrap(err, "validateConf")
+	}
+	if err := prepareALPN(item); err != nil {
+		return errors.Wrap(err, "prepareALPN")
+	}
+	switch {
+	case strings.HasPrefix(sni, regexpPrefix):
+		// sni is matched in lower case, expr is compiled case insensitively instead of lowercased,
+		// which would turn escapes like \D into \d
+		expr := strings.TrimPrefix(strings.TrimSpace(cfg.SNI), regexpPrefix)
+		for _, v := range r.regexps {
+			if v.expr == expr {
+				return errors.Errorf("duplicate regexp sni: %s", cfg.SNI)
+			}
+		}
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return errors.Wrap(err, "regexp.Compile")
+		}
+		r.regexps = append(r.regexps, regexpRoute{expr: expr, re: re, cfg: item})
+	case strings.HasPrefix(sni, wildcardPrefix):
+		suffix := strings.TrimPrefix(sni, "*")
+		if err := validateHostname(suffix[1:]); err != nil {
+			return errors.Wrapf(err, "invalid wildcard sni: %s", cfg.SNI)
+		}
+		for _, v := range r.wildcards {
+			if v.suffix == suffix {
+				return errors.Errorf("duplicate wildcard sni: %s", cfg.SNI)
+			}
+		}
+		r.wildcards = append(r.wildcards, wildcardRoute{suffix: suffix, cfg: item})
+		// longest suffix first, suffixes are unique so the order is deterministic
+		sort.Slice(r.wildcards, func(i, j int) bool {
+			return len(r.wildcards[i].suffix) > len(r.wildcards[j].suffix)
+		})
+	default:
+		if err := validateHostname(sni); err != nil {
+			return errors.Wrapf(err, "invalid sni: %s", cfg.SNI)
+		}
+		if _, ok := r.exact[sni]; ok {
+			return errors.Errorf("duplicate sni: %s", cfg.SNI)
+		}
+		r.exact[sni] = item
+	}
+	return nil
+}
+
+// overlaps reports regexp routes sharing a host name with an exact, wildcard or earlier regexp route,
+// such names would silently go to the route of higher precedence. Patterns are compared as automata over host names
+func (r *router) overlaps() []error {
+	var errs []error
+	exact := make([]string, 0, len(r.exact))
+	for sni := range r.exact {
+		exact = append(exact, sni)
+	}
+	sort.Strings(exact)
+	wildcards := make([]*hostProg, len(r.wildcards))
+	for i, w := range r.wildcards {
+		wildcards[i] = wildcardHost(w.suffix)
+	}
+	progs := make([]*hostProg, len(r.regexps))
+	for i, v := range r.regexps {
+		prog, err := compileHost(v.expr)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "regexp sni %s", v.cfg.SNI))
+			continue
+		}
+		progs[i] = prog
+		for _, sni := range exact {
+			if v.re.MatchString(sni) {
+				errs = append(errs, errors.Errorf("regexp sni %s overlaps exact sni %s", v.cfg.SNI, sni))
+			}
+		}
+		for j, w := range r.wildcards {
+			if intersects(prog, wildcards[j]) {
+				errs = append(errs, errors.Errorf("regexp sni %s overlaps wildcard sni %s", v.cfg.SNI, w.cfg.SNI))
+			}
+		}
+		for j, o := range r.regexps[:i] {
+			if progs[j] != nil && intersects(prog, progs[j]) {
+				errs = append(errs, errors.Errorf("regexp sni %s overlaps regexp sni %s", v.cfg.SNI, o.cfg.SNI))
+			}
+		}
+	}
+	return errs
+}
+
+// addDefault set the route for unmatched sni, either a conf with sni "*" or the fallback in akari config
+func (r *router) addDefault(cfg config.ServerConf) error {
+	if r.def != nil {
+		return errors.Errorf("duplicate default route, already used by %s", r.def.SNI)
+	}
+	item := &cfg
+	if err := validateConf(item); err != nil {
+		return errors.Wrap(err, "validateConf")
+	}
+	if err := prepareALPN(item); err != nil {
+		return errors.Wrap(err, "prepareALPN")
+	}
+	r.def = item
+	return nil
+}
+
+// match returns the route of sni, def is set if only the default route matched
+func (r *router) match(sni string) (cfg *config.ServerConf, def bool, ok bool) {
+	sni = strings.ToLower(sni)
+	if cfg, ok := r.exact[sni]; ok {
+		return cfg, false, true
+	}
+	for _, v := range r.wildcards {
+		if len(sni) > len(v.suffix) && strings.HasSuffix(sni, v.suffix) {
+			return v.cfg, false, true
+		}
+	}
+	for _, v := range r.regexps {
+		if v.re.MatchString(sni) {
+			return v.cfg, false, true
+		}
+	}
+	if r.def != nil {
+		return r.def, true, true
+	}
+	return nil, false, false
+}
+
+// each calls fn for every route
+func (r *router) each(fn func(cfg *config.ServerConf)) {
+	for _, v := range r.exact {
+		fn(v)
+	}
+	for _, v := range r.wildcards {
+		fn(v.cfg)
+	}
+	for _, v := range r.regexps {
+		fn(v.cfg)
+	}
+	if r.def != nil {
+		fn(r.def)
+	}
+}
+
+// acquire holds routes for a conn, false is returned if router is retired
+func (r *router) acquire() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.retired {
+		return false
+	}
+	r.refs++
+	return true
+}
+
+// release is called when conn holding routes ends
+func (r *router) release() {
+	r.mu.Lock()
+	r.refs--
+	done := r.retired && r.refs == 0
+	r.mu.Unlock()
+	if done {
+		r.close()
+	}
+}
+
+// retire closes router once conns holding it end, it's called after router is replaced
+func (r *router) retire() {
+	r.mu.Lock()
+	r.retired = true
+	done := r.refs == 0
+	r.mu.Unlock()
+	if done {
+		r.close()
+	}
+}
+
+// close stops health checks of balancers
+func (r *router) close() {
+	r.each(func(cfg *config.ServerConf) {
+		cfg.Balancer.Close()
+		for i := range cfg.ALPN {
+			cfg.ALPN[i].Balancer.Close()
+		}
+	})
+}
+
+// prepareALPN validates ALPN sub confs, which inherit sni from their parent
+func prepareALPN(cfg *config.ServerConf) error {
+	if len(cfg.ALPN) == 0 {
+		return nil
+	}
+	if cfg.Mode == "passthrough" {
+		return errors.New("alpn is not supported by passthrough mode")
+	}
+	protos := make(map[string]struct{})
+	for i := range cfg.ALPN {
+		sub := &cfg.ALPN[i]
+		if len(sub.Protocol) == 0 {
+			return errors.New("empty alpn protocol")
+		}
+		if _, ok := protos[sub.Protocol]; ok {
+			return errors.Errorf("duplicate alpn protocol: %s", sub.Protocol)
+		}
+		protos[sub.Protocol] = struct{}{}
+		if sub.Mode == "passthrough" || len(sub.ALPN) != 0 {
+			return errors.Errorf("invalid alpn protocol %s: passthrough mode and nested alpn are not supported", sub.Protocol)
+		}
+		if err := validateConf(&sub.ServerConf); err != nil {
+			return errors.Wrapf(err, "alpn protocol %s", sub.Protocol)
+		}
+		sub.SNI = cfg.SNI
+	}
+	return nil
+}
+
+// validateConf checks options of one conf
+func validateConf(cfg *config.ServerConf) error {
+	if cfg.ProxyProtocol != 0 && cfg.ProxyProtocol != 1 && cfg.ProxyProtocol != 2 {
+		return errors.Errorf("invalid proxyProtocol: %d", cfg.ProxyProtocol)
+	}
+	for path, v := range cfg.ReverseProxy {
+		if v.H2C && cfg.Mode != "https" {
+			return errors.Errorf("h2c of reverse proxy path %s is not supported by %s mode", path, cfg.Mode)
+		}
+	}
+	if len(cfg.Backends) != 0 {
+		if cfg.Mode != "tcp" && cfg.Mode != "passthrough" {
+			return errors.Errorf("backends are not supported by %s mode", cfg.Mode)
+		}
+		if len(cfg.Addr) != 0 {
+			return errors.New("addr and backends can not be both set")
+		}
+	}
+	return nil
+}
+
+func validateHostname(name string) error {
+	if len(name) == 0 || len(name) > 253 {
+		return errors.New("invalid length")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return errors.Errorf("invalid label: %q", label)
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return errors.Errorf("invalid character %q in label %q", c, label)
+			}
+		}
+	}
+	return nil
+}
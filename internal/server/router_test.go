@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/cert"
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+)
+
+func newTestRouter(t *testing.T, snis ...string) *router {
+	r := newRouter()
+	for _, sni := range snis {
+		if err := r.add(config.ServerConf{SNI: sni, Mode: "tcp"}); err != nil {
+			t.Fatalf("add(%q): %s", sni, err)
+		}
+	}
+	return r
+}
+
+func TestRouterMatch(t *testing.T) {
+	r := newTestRouter(t,
+		"www.example.com",
+		"*.example.com",
+		"*.tun.example.com",
+		` ~^TUN-\d+\.example\.com$ `,
+		`~^api-\D+\.example\.net$`,
+		`~\.example\.net$`,
+	)
+	tests := []struct {
+		sni   string
+		route string
+	}{
+		{"www.example.com", "www.example.com"},
+		{"WWW.Example.COM", "www.example.com"},
+		{"a.example.com", "*.example.com"},
+		// wildcard matches more than one label
+		{"a.b.example.com", "*.example.com"},
+		{"a.tun.example.com", "*.tun.example.com"},
+		{"tun.example.com", "*.example.com"},
+		{"example.com", ""},
+		// exact and wildcard win over regexp
+		{"tun-1.example.com", "*.example.com"},
+		{"api-x.example.net", `~^api-\D+\.example\.net$`},
+		{"API-X.example.net", `~^api-\D+\.example\.net$`},
+		{"api-1.example.net", `~\.example\.net$`},
+		{"example.net", ""},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		cfg, _, ok := r.match(tt.sni)
+		route := ""
+		if ok {
+			route = cfg.SNI
+		}
+		if route != tt.route {
+			t.Errorf("match(%q) = %q, want %q", tt.sni, route, tt.route)
+		}
+	}
+}
+
+func TestRouterRegexpNormalized(t *testing.T) {
+	r := newTestRouter(t, ` ~^TUN-\d+\.example\.com$ `)
+	for _, sni := range []string{"tun-1.example.com", "TUN-22.EXAMPLE.COM"} {
+		if _, _, ok := r.match(sni); !ok {
+			t.Errorf("match(%q) failed", sni)
+		}
+	}
+	if _, _, ok := r.match("tun-x.example.com"); ok {
+		t.Error(`\d should not be lowercased into \D`)
+	}
+}
+
+func TestRouterAddInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		snis []string
+	}{
+		{"empty", []string{" "}},
+		{"duplicate exact", []string{"a.example.com", "A.example.com"}},
+		{"duplicate wildcard", []string{"*.example.com", " *.EXAMPLE.com"}},
+		{"duplicate regexp", []string{`~^a\.com$`, ` ~^a\.com$`}},
+		{"duplicate default", []string{"*", "*"}},
+		{"malformed regexp", []string{"~^a(.com$"}},
+		{"malformed wildcard", []string{"*."}},
+		{"nested wildcard", []string{"*.*.example.com"}},
+		{"invalid exact", []string{"a b.example.com"}},
+		{"empty label", []string{"a..example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRouter()
+			var err error
+			for _, sni := range tt.snis {
+				if err = r.add(config.ServerConf{SNI: sni, Mode: "tcp"}); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				t.Fatalf("add(%q) should fail", tt.snis)
+			}
+		})
+	}
+}
+
+func TestRouterOverlaps(t *testing.T) {
+	tests := []struct {
+		name string
+		snis []string
+		errs int
+	}{
+		{"disjoint", []string{"www.example.com", "*.example.com", `~^tun-\d+\.example\.net$`, `~^api\.example\.org$`}, 0},
+		{"regexp matches exact", []string{"tun-1.example.net", `~^tun-\d+\.example\.net$`}, 1},
+		{"second alternative matches exact", []string{"tun.example.com", `~^(a|tun)\.example\.com$`}, 1},
+		{"second alternative inside wildcard", []string{"*.tun.example.com", `~^(a|x\.tun)\.example\.com$`}, 1},
+		{"later class rune inside wildcard", []string{"*.tun.example.com", `~^[a-z]\.[s-u]un\.example\.com$`}, 1},
+		{"regexp covers wildcard", []string{"*.example.com", `~\.com$`}, 1},
+		{"regexp inside wildcard", []string{"*.example.com", `~^tun-\d+\.example\.com$`}, 1},
+		{"unanchored regexp", []string{"*.example.com", `~tun`}, 1},
+		{"regexp beside wildcard", []string{"*.tun.example.com", `~^(a|tun)\.example\.com$`}, 0},
+		{"regexp covers regexp", []string{`~^tun-1\.example\.com$`, `~^tun-\d+\.example\.com$`}, 1},
+		{"regexp covered by regexp", []string{`~example`, `~^tun-\d+\.example\.com$`}, 1},
+		{"case insensitive", []string{`~^TUN\.example\.com$`, `~^tun\.`}, 1},
+		{"disjoint digits", []string{`~^tun-\d+\.example\.com$`, `~^tun-\D+\.example\.com$`}, 0},
+		{"disjoint word boundary", []string{`~^tun\b`, `~^tunnel$`}, 0},
+		{"word boundary", []string{`~^tun\b`, `~^tun\.example\.com$`}, 1},
+		{"three regexps", []string{`~^a\.`, `~^b\.`, `~\.com$`}, 2},
+		{"default is not an overlap", []string{"*", `~.*`}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t, tt.snis...)
+			if errs := r.overlaps(); len(errs) != tt.errs {
+				t.Fatalf("overlaps() = %q, want %d errors", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestRouterEach(t *testing.T) {
+	r := newTestRouter(t, "a.example.com", "*.example.com", "~^b", "*")
+	var got []string
+	r.each(func(cfg *config.ServerConf) {
+		got = append(got, cfg.SNI)
+	})
+	if want := []string{"a.example.com", "*.example.com", "~^b", "*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("each = %q, want %q", got, want)
+	}
+}
+
+func TestRouterDefault(t *testing.T) {
+	r := newTestRouter(t, "www.example.com", "*.example.net", "~^api\\.", "*")
+	tests := []struct {
+		sni   string
+		route string
+		def   bool
+	}{
+		{"www.example.com", "www.example.com", false},
+		{"a.example.net", "*.example.net", false},
+		{"api.example.org", "~^api\\.", false},
+		{"unknown.example.org", "*", true},
+		{"empty", "*", true},
+		{"", "*", true},
+	}
+	for _, tt := range tests {
+		cfg, def, ok := r.match(tt.sni)
+		if !ok || cfg.SNI != tt.route || def != tt.def {
+			t.Errorf("match(%q) = %v, %v, %v, want %q, %v", tt.sni, cfg, def, ok, tt.route, tt.def)
+		}
+	}
+}
+
+func TestLoadServerConfFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		confs    []string
+		fallback *config.ServerConf
+		route    string
+		ok       bool
+	}{
+		{"no default", []string{"a.example.com"}, nil, "", true},
+		{"fallback", []string{"a.example.com"}, &config.ServerConf{Mode: "tcp", Addr: "127.0.0.1:80"}, "fallback", true},
+		{"named fallback", nil, &config.ServerConf{SNI: "web", Mode: "tcp", Addr: "127.0.0.1:80"}, "web", true},
+		{"default sni", []string{"a.example.com", "*"}, nil, "*", true},
+		{"default sni and fallback", []string{"*"}, &config.ServerConf{Mode: "tcp", Addr: "127.0.0.1:80"}, "", false},
+		{"invalid fallback", nil, &config.ServerConf{Mode: "tcp", Addr: "127.0.0.1:80", ProxyProtocol: 3}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "akari-conf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			for i, sni := range tt.confs {
+				data, err := json.Marshal(config.ServerConf{SNI: sni, Mode: "tcp", Addr: "127.0.0.1:80"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.json", i)), data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			certs, err := cert.NewStore(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dialers, err := outbound.New(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := loadServerConf(dir, tt.fallback, certs, dialers, nil)
+			if (err == nil) != tt.ok {
+				t.Fatalf("loadServerConf error = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			defer r.close()
+			route := ""
+			if cfg, _, ok := r.match("unknown.example.org"); ok {
+				route = cfg.SNI
+			}
+			if route != tt.route {
+				t.Errorf("unmatched sni goes to %q, want %q", route, tt.route)
+			}
+		})
+	}
+}
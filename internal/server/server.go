@@ -5,22 +5,40 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/acme"
+	"github.com/mikumaycry/akari/internal/pkg/cert"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
 	"github.com/mikumaycry/akari/internal/pkg/https"
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/mikumaycry/akari/internal/pkg/proxyproto"
+	"github.com/mikumaycry/akari/internal/pkg/ratelimit"
+	"github.com/mikumaycry/akari/internal/pkg/resolver"
+	"github.com/mikumaycry/akari/internal/pkg/rules"
+	"github.com/mikumaycry/akari/internal/pkg/socks4"
 	"github.com/mikumaycry/akari/internal/pkg/socks5"
 	"github.com/mikumaycry/akari/internal/pkg/tcp"
+	"github.com/mikumaycry/akari/internal/pkg/traffic"
 	"github.com/mikumaycry/akari/internal/utils"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/xtaci/smux"
 )
 
+var (
+	proxyProtocolTimeout = 10 * time.Second
+	// helloTimeout limits the wait for ClientHello, so idle conns can not hold goroutines before routing
+	helloTimeout = 10 * time.Second
+)
+
 // Server wraps hold tls.Listner and distribute request to pkg based on sni
 type Server struct {
 	wg           sync.WaitGroup
@@ -28,55 +46,126 @@ type Server struct {
 	ln           net.Listener
 	httpsPort    string
 	httpRedirect bool
+	httpAddr     string
 	closeChan    chan struct{}
-	confs        map[string]config.ServerConf
+	conf         string
+	fallback     *config.ServerConf
+	watchConf    bool
+	reloadMu     sync.Mutex
+	router       atomic.Value // *router
+	certs        *cert.Store
+	acme         *acme.Manager
+	proxies      []*net.IPNet
+	traffic      *traffic.Meter
+	limits       *ratelimit.Registry
+	dialers      map[string]outbound.Dialer
+	resolver     *resolver.Resolver
 }
 
 // New method
 func New(cfg *config.Config) (*Server, error) {
-	confs, err := loadServerConf(cfg.Conf)
+	if len(cfg.TLS.Certs) == 0 && cfg.TLS.ACME == nil {
+		return nil, errors.New("empty TLS certs")
+	}
+	certs, err := cert.NewStore(cfg.TLS.Certs)
 	if err != nil {
-		return nil, errors.Wrap(err, "loadServerConf")
+		return nil, errors.Wrap(err, "cert.NewStore")
 	}
-	tlsConfig := &tls.Config{
-		MinVersion:               tls.VersionTLS12,
-		PreferServerCipherSuites: true,
+	var acmeManager *acme.Manager
+	if cfg.TLS.ACME != nil {
+		acmeManager, err = acme.New(*cfg.TLS.ACME, certs)
+		if err != nil {
+			return nil, errors.Wrap(err, "acme.New")
+		}
 	}
-	if cfg.TLS.ForwardSecurity {
-		tlsConfig.CipherSuites = utils.CipherSuites()
+	res, err := resolver.New(cfg.DNS)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolver.New")
 	}
-	if len(cfg.TLS.Certs) == 0 {
-		return nil, errors.New("empty TLS certs")
+	dialers, err := outbound.New(cfg.Outbounds, res)
+	if err != nil {
+		return nil, errors.Wrap(err, "outbound.New")
 	}
-	for _, v := range cfg.TLS.Certs {
-		kp, err := tls.LoadX509KeyPair(v.Cert, v.Key)
-		if err != nil {
-			return nil, errors.Wrap(err, "tls.LoadX509KeyPair")
+	router, err := loadServerConf(cfg.Conf, cfg.Fallback, certs, dialers, res)
+	if err != nil {
+		return nil, errors.Wrap(err, "loadServerConf")
+	}
+	var trustedProxies []*net.IPNet
+	if cfg.ProxyProtocol.Enable {
+		if len(cfg.ProxyProtocol.Trusted) == 0 {
+			return nil, errors.New("empty trusted proxies")
+		}
+		for _, v := range cfg.ProxyProtocol.Trusted {
+			_, ipNet, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "net.ParseCIDR")
+			}
+			trustedProxies = append(trustedProxies, ipNet)
 		}
-		tlsConfig.Certificates = append(tlsConfig.Certificates, kp)
 	}
-	ln, err := tls.Listen("tcp", cfg.Addr, tlsConfig)
+	meter, err := traffic.New(cfg.Traffic.Storage, time.Duration(cfg.Traffic.Interval)*time.Second)
 	if err != nil {
-		return nil, errors.Wrap(err, "tls.Listen")
+		return nil, errors.Wrap(err, "traffic.New")
 	}
 	s := &Server{
-		tlsConfig:    tlsConfig,
-		ln:           ln,
 		httpsPort:    strings.Split(cfg.Addr, ":")[1],
 		httpRedirect: cfg.HTTPRedirect,
-		closeChan:    make(chan struct{}, 1),
-		confs:        confs,
+		httpAddr:     cfg.HTTPAddr,
+		closeChan:    make(chan struct{}),
+		conf:         cfg.Conf,
+		fallback:     cfg.Fallback,
+		watchConf:    cfg.WatchConf,
+		certs:        certs,
+		acme:         acmeManager,
+		proxies:      trustedProxies,
+		traffic:      meter,
+		limits:       ratelimit.NewRegistry(),
+		dialers:      dialers,
+		resolver:     res,
+	}
+	s.router.Store(router)
+	tlsConfig := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		GetCertificate:           s.getCertificate,
+		GetConfigForClient:       s.getConfigForClient,
+	}
+	if cfg.TLS.ForwardSecurity {
+		tlsConfig.CipherSuites = utils.CipherSuites()
+	}
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.Listen")
 	}
+	s.tlsConfig = tlsConfig
+	s.ln = ln
 	return s, nil
 }
 
 // Serve method
 func (s *Server) Serve() error {
 	log.Infof("start listening %s", s.ln.Addr())
-	if s.httpRedirect {
-		log.Info("start listening [::]:80")
+	if s.httpRedirect || s.acme != nil {
+		log.Infof("start listening %s", s.httpAddr)
 		go s.handleHTTPRedirect()
 	}
+	if s.acme != nil {
+		go s.acme.Run(s.closeChan)
+	}
+	go s.traffic.Run(s.closeChan)
+	if s.watchConf {
+		err := utils.WatchDir(s.conf, time.Second, s.closeChan, func() {
+			if err := s.Reload(); err != nil {
+				log.Errorf("server: reload %s: %s", s.conf, err)
+			}
+		})
+		if err != nil {
+			log.Errorf("server: watch %s: %s", s.conf, err)
+		}
+	}
+	if err := s.certs.Watch(time.Second, s.closeChan); err != nil {
+		log.Errorf("server: watch certs: %s", err)
+	}
 	var tempDelay time.Duration
 	for {
 		conn, err := s.ln.Accept()
@@ -97,15 +186,10 @@ func (s *Server) Serve() error {
 			log.Fatalf("server: Accept error: %s", err)
 		}
 		tempDelay = 0
-		tlsConn, ok := conn.(*tls.Conn)
-		if !ok {
-			conn.Close()
-			continue
-		}
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
-			s.handleConn(tlsConn)
+			s.handleConn(conn)
 		}()
 	}
 }
@@ -113,42 +197,274 @@ func (s *Server) Serve() error {
 // Close method
 func (s *Server) Close() error {
 	s.wg.Wait()
-	s.closeChan <- struct{}{}
+	close(s.closeChan)
+	s.getRouter().retire()
+	if err := s.traffic.Save(); err != nil {
+		log.Errorf("server: save traffic: %s", err)
+	}
 	return s.ln.Close()
 }
 
-func (s *Server) handleConn(tlsConn *tls.Conn) {
-	logger := log.WithField("Remote", tlsConn.RemoteAddr())
+// Reload loads certs and conf dir independently and swaps the routing table, the running certs are kept
+// on cert errors and the running routes on conf errors, conns already opened keep using their old ServerConf
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	// e.g. a cert file half written by renewal, routes are still reloaded with the running certs
+	certErr := s.certs.Reload()
+	if certErr != nil {
+		log.Errorf("server: reload certs: %s", certErr)
+	}
+	router, err := loadServerConf(s.conf, s.fallback, s.certs, s.dialers, s.resolver)
+	if err != nil {
+		if errs, ok := err.(confErrors); ok {
+			for _, v := range errs {
+				log.Errorf("server: reload conf: %s", v)
+			}
+		}
+		return errors.Wrap(err, "loadServerConf")
+	}
+	old := s.getRouter()
+	s.router.Store(router)
+	// health checks of old routes keep running for opened conns, e.g. mux sessions
+	old.retire()
+	if certErr != nil {
+		return errors.Wrap(certErr, "certs.Reload")
+	}
+	log.Infof("server: reload %s success", s.conf)
+	return nil
+}
+
+// LogRules logs hit counters of rule lists in use, counters restart when conf is reloaded
+func (s *Server) LogRules() {
+	seen := make(map[*rules.List]struct{})
+	var logList func(cfg *config.ServerConf)
+	logList = func(cfg *config.ServerConf) {
+		if cfg.Router != nil {
+			list := cfg.Router.List()
+			if _, ok := seen[list]; !ok {
+				seen[list] = struct{}{}
+				for _, r := range list.Rules {
+					log.WithField("Rules", list.Name).Infof("%s,%s,%s hits: %d", r.Kind, r.Value, r.Outbound, r.Hits())
+				}
+			}
+		}
+		for i := range cfg.ALPN {
+			logList(&cfg.ALPN[i].ServerConf)
+		}
+	}
+	s.getRouter().each(logList)
+}
+
+func (s *Server) getRouter() *router {
+	return s.router.Load().(*router)
+}
+
+// acquireRouter returns the current router held for a conn, it must be released when conn ends
+func (s *Server) acquireRouter() *router {
+	for {
+		// a retired router is replaced already, load again
+		if r := s.getRouter(); r.acquire() {
+			return r
+		}
+	}
+}
+
+// isTrustedProxy reports whether PROXY protocol header is expected from addr
+func (s *Server) isTrustedProxy(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, v := range s.proxies {
+		if v.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTLSConfig returns tls.Config with client cert verification and ALPN protocols of route,
+// only protocols offered by client are advertised, so clients offering none of them fall back to the route itself
+// instead of failing the handshake
+func (s *Server) routeTLSConfig(router *router, cfg *config.ServerConf, clientProtos []string) *tls.Config {
+	protos := routeProtos(cfg)
+	if len(cfg.ClientCA) == 0 && len(protos) == 0 {
+		return s.tlsConfig
+	}
+	tlsConfig := s.tlsConfig.Clone()
+	if len(cfg.ClientCA) != 0 {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = router.clientCAs[cfg.ClientCA]
+	}
+	tlsConfig.NextProtos = nil
+	for _, v := range protos {
+		for _, p := range clientProtos {
+			if v == p {
+				tlsConfig.NextProtos = append(tlsConfig.NextProtos, v)
+				break
+			}
+		}
+	}
+	return tlsConfig
+}
+
+// routeProtos returns ALPN protocols offered by route, https mode offers h2 if it's supported
+func routeProtos(cfg *config.ServerConf) []string {
+	if len(cfg.ALPN) == 0 && cfg.Mode == "https" && !cfg.Mux {
+		return []string{"h2", "http/1.1"}
+	}
+	return cfg.NextProtos()
+}
+
+// getConfigForClient answers tls-alpn-01 challenge with challenge cert, other hellos use the default config
+func (s *Server) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if s.acme == nil {
+		return nil, nil
+	}
+	c, ok := s.acme.ChallengeCert(hello)
+	if !ok {
+		return nil, nil
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*c},
+		NextProtos:   []string{acme.ALPNProto},
+	}, nil
+}
+
+// getCertificate selects cert named by the matched ServerConf, or by server name
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c, err := s.selectCert(hello.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	return c.TLS, nil
+}
+
+func (s *Server) selectCert(serverName string) (*cert.Cert, error) {
+	var name string
+	sni := serverName
+	if len(sni) == 0 {
+		sni = "empty"
+	}
+	if cfg, _, ok := s.getRouter().match(sni); ok {
+		name = cfg.Cert
+	}
+	return s.certs.Get(name, serverName)
+}
+
+func (s *Server) handleConn(rawConn net.Conn) {
+	logger := log.WithField("Remote", rawConn.RemoteAddr())
+	if s.isTrustedProxy(rawConn.RemoteAddr()) {
+		ppConn, err := proxyproto.NewConn(rawConn, proxyProtocolTimeout)
+		if err != nil {
+			logger.Error("proxyproto.NewConn: ", err)
+			rawConn.Close()
+			return
+		}
+		rawConn = ppConn
+		logger = log.WithFields(log.Fields{
+			"Remote": ppConn.RemoteAddr(),
+			"Proxy":  ppConn.ProxyAddr(),
+		})
+	}
+	hello, rawConn, err := peekClientHello(rawConn)
+	if err != nil {
+		logger.Error("peekClientHello: ", err)
+		rawConn.Close()
+		return
+	}
+	sni := hello.ServerName
+	if len(sni) == 0 {
+		sni = "empty"
+	}
+	router := s.acquireRouter()
+	defer router.release()
+	cfg, _, ok := router.match(sni)
+	info := &conninfo.Info{SNI: hello.ServerName}
+	if ok {
+		info.Route = cfg.SNI
+		// hosts of other routes are forwarded, the default route matches every host and only counts by sni
+		info.Routed = func(host string) bool {
+			c, def, ok := router.match(host)
+			return ok && !def && c.SNI == info.Route
+		}
+		if !ratelimit.AllowAll(s.buckets(cfg, "", limitConns)) {
+			logger.Errorf("conn rate limit exceeded: %s", cfg.SNI)
+			rawConn.Close()
+			return
+		}
+	}
+	if ok && cfg.Mode == "passthrough" {
+		logger = logger.WithFields(log.Fields{
+			"Mode":  cfg.ConnMode(),
+			"SNI":   sni,
+			"Route": cfg.SNI,
+			"DST":   cfg.Addr,
+		})
+		logger.Info("Open Conn")
+		defer logger.Info("Close Conn")
+		defer rawConn.Close()
+		s.setLimit(cfg, info)
+		tcp.HandleConn(s.wrapConn(rawConn, cfg, info), cfg, info, logger)
+		return
+	}
+	tlsConfig := s.tlsConfig
+	if ok {
+		tlsConfig = s.routeTLSConfig(router, cfg, hello.SupportedProtos)
+	}
+	tlsConn := tls.Server(rawConn, tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
 		logger.Error("tlsConn.Handshake: ", err)
 		tlsConn.Close()
 		return
 	}
-	sni := tlsConn.ConnectionState().ServerName
-	if len(sni) == 0 {
-		sni = "empty"
+	if tlsConn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		logger.Debug("acme: tls-alpn-01 challenge")
+		tlsConn.Close()
+		return
 	}
-	cfg, ok := s.confs[sni]
 	if !ok {
 		logger.Errorf("invalid SNI: %s", sni)
 		tlsConn.Close()
 		return
 	}
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; len(proto) != 0 {
+		logger = logger.WithField("ALPN", proto)
+		if sub, ok := cfg.ALPNRoute(proto); ok {
+			cfg = sub
+		}
+	}
 	logger = logger.WithFields(log.Fields{
-		"Mode": cfg.ConnMode(),
-		"SNI":  sni,
-		"TLS":  utils.TLSFormatString(tlsConn),
+		"Mode":  cfg.ConnMode(),
+		"SNI":   sni,
+		"Route": cfg.SNI,
+		"TLS":   utils.TLSFormatString(tlsConn),
 	})
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) != 0 {
+		info.SetUser(certs[0].Subject.CommonName)
+		logger = logger.WithFields(log.Fields{
+			"User":    certs[0].Subject.CommonName,
+			"Subject": certs[0].Subject.String(),
+		})
+	}
+	if c, err := s.selectCert(hello.ServerName); err == nil {
+		logger = logger.WithFields(log.Fields{
+			"Cert":     c.Name,
+			"NotAfter": c.Leaf.NotAfter.Format(time.RFC3339),
+		})
+	}
 	logger.Info("Open Conn")
 	defer logger.Info("Close Conn")
 	if cfg.Mux {
-		handleMuxConn(tlsConn, &cfg, logger)
+		s.handleMuxConn(tlsConn, cfg, info, logger)
 	} else {
-		handleSingleConn(tlsConn, &cfg, logger)
+		s.handleSingleConn(tlsConn, cfg, info, logger)
 	}
 }
 
-func handleMuxConn(srcConn net.Conn, cfg *config.ServerConf, logger *log.Entry) {
+func (s *Server) handleMuxConn(srcConn net.Conn, cfg *config.ServerConf, info *conninfo.Info, logger *log.Entry) {
 	defer srcConn.Close()
 	muxCfg := smux.DefaultConfig()
 	session, err := smux.Server(srcConn, muxCfg)
@@ -163,83 +479,132 @@ func handleMuxConn(srcConn net.Conn, cfg *config.ServerConf, logger *log.Entry)
 			logger.Errorf("session.AcceptStream: %s", err)
 			return
 		}
-		go handleSingleConn(stream, cfg, logger)
+		if !ratelimit.AllowAll(s.buckets(cfg, info.User(), limitStreams)) {
+			logger.Error("stream rate limit exceeded")
+			stream.Close()
+			continue
+		}
+		go s.handleSingleConn(stream, cfg, info.Clone(), logger)
 	}
 }
 
 type bufferdConn struct {
 	net.Conn
-	br *bufio.Reader
+	r io.Reader
 }
 
 func (c *bufferdConn) Read(b []byte) (int, error) {
-	return c.br.Read(b)
+	return c.r.Read(b)
+}
+
+// setLimit sets quota and user conn rate check of cfg on info
+func (s *Server) setLimit(cfg *config.ServerConf, info *conninfo.Info) {
+	if cfg.Quota == nil && cfg.UserLimit == nil && len(cfg.UserLimits) == 0 {
+		return
+	}
+	info.Limit = func(i *conninfo.Info) error {
+		if cfg.Quota != nil {
+			if err := s.traffic.Allow(i.Route, i.User(), cfg.Quota.Daily, cfg.Quota.Monthly); err != nil {
+				return err
+			}
+		}
+		if b := s.limits.Get(limitKey(cfg, i.User(), limitConns), limitRate(cfg.LimitOf(i.User()), limitConns)); b != nil && !b.Allow() {
+			return errors.Errorf("conn rate limit exceeded: %s", i.User())
+		}
+		return nil
+	}
+}
+
+// wrapConn counts traffic of srcConn and shapes its bandwidth
+func (s *Server) wrapConn(srcConn net.Conn, cfg *config.ServerConf, info *conninfo.Info) net.Conn {
+	srcConn = s.traffic.Wrap(srcConn, info, cfg.Credentials != nil)
+	if cfg.Limit == nil && cfg.UserLimit == nil && len(cfg.UserLimits) == 0 {
+		return srcConn
+	}
+	return ratelimit.NewConn(srcConn, info, func(user string) (upload, download []*ratelimit.Bucket) {
+		return s.buckets(cfg, user, limitUpload), s.buckets(cfg, user, limitDownload)
+	})
 }
 
-func handleSingleConn(srcConn net.Conn, cfg *config.ServerConf, logger *log.Entry) {
+func (s *Server) handleSingleConn(srcConn net.Conn, cfg *config.ServerConf, info *conninfo.Info, logger *log.Entry) {
 	defer srcConn.Close()
+	s.setLimit(cfg, info)
+	srcConn = s.wrapConn(srcConn, cfg, info)
 	switch cfg.Mode {
 	case "tcp":
 		logger = logger.WithField("DST", cfg.Addr)
-		tcp.HandleConn(srcConn, cfg, logger)
-	case "socks5":
-		socks5.HandleConn(srcConn, cfg, logger)
-	case "https":
-		https.HandleConn(srcConn, cfg, logger)
-	case "auto":
+		tcp.HandleConn(srcConn, cfg, info, logger)
+	case "socks5", "auto":
 		br := bufio.NewReader(srcConn)
 		b, err := br.Peek(1)
 		if err != nil {
 			logger.Errorf("br.Peek: %s", err)
 			return
 		}
-		bfConn := &bufferdConn{Conn: srcConn, br: br}
-		switch b[0] {
-		case 0x05:
+		bfConn := &bufferdConn{Conn: srcConn, r: br}
+		switch {
+		case b[0] == 0x05:
 			// socks5
-			socks5.HandleConn(bfConn, cfg, logger)
+			socks5.HandleConn(bfConn, cfg, info, logger)
+		case b[0] == 0x04:
+			// socks4 and socks4a
+			socks4.HandleConn(bfConn, cfg, info, logger)
+		case cfg.Mode == "socks5":
+			logger.Errorf("unsupported socks version: %0x", b[0])
 		default:
 			// http
-			https.HandleConn(bfConn, cfg, logger)
+			https.HandleConn(bfConn, cfg, info, logger)
 		}
+	case "https":
+		https.HandleConn(srcConn, cfg, info, logger)
 	default:
 		logger.Errorf("invalid mode: %s", cfg.Mode)
 	}
 }
 
-func (s *Server) handleHTTPRedirect() {
-	httpSNI := make(map[string]struct{})
-	for _, v := range s.confs {
-		if v.Mode == "https" {
-			httpSNI[v.SNI] = struct{}{}
-		}
+// redirectTarget returns https url of req, host without port must match an https route other than the default,
+// so names of the redirect are configured ones instead of any Host sent by client
+func redirectTarget(r *router, req *http.Request, httpsPort string) (string, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
-	if len(httpSNI) == 0 {
-		return
+	host = strings.ToLower(host)
+	cfg, def, ok := r.match(host)
+	if !ok || def || cfg.Mode != "https" {
+		return "", false
+	}
+	target := fmt.Sprintf("https://%s%s", host, req.URL.Path)
+	if httpsPort != "443" {
+		target = fmt.Sprintf("https://%s%s", net.JoinHostPort(host, httpsPort), req.URL.Path)
+	}
+	if len(req.URL.RawQuery) > 0 {
+		target += "?" + req.URL.RawQuery
 	}
+	return target, true
+}
+
+func (s *Server) handleHTTPRedirect() {
 	redirect := func(w http.ResponseWriter, req *http.Request) {
 		logger := log.WithFields(log.Fields{"Mode": "http", "Remote": req.RemoteAddr})
-		_, ok := httpSNI[req.Host]
-		if !ok {
+		target, ok := redirectTarget(s.getRouter(), req, s.httpsPort)
+		if !s.httpRedirect || !ok {
 			logger.Infof("not found: %s", req.Host)
 			http.NotFound(w, req)
 			return
 		}
-		target := fmt.Sprintf("https://%s%s", req.Host, req.URL.Path)
-		if s.httpsPort != "443" {
-			target = fmt.Sprintf("https://%s:%s%s", req.Host, s.httpsPort, req.URL.Path)
-		}
-		if len(req.URL.RawQuery) > 0 {
-			target += "?" + req.URL.RawQuery
-		}
 		logger.Infof("redirect: %s", target)
 		http.Redirect(w, req, target, http.StatusMovedPermanently)
 	}
+	var handler http.Handler = http.HandlerFunc(redirect)
+	if s.acme != nil {
+		handler = s.acme.HTTPHandler(handler)
+	}
 	srv := &http.Server{
-		Addr:         ":80",
+		Addr:         s.httpAddr,
 		WriteTimeout: 60 * time.Second,
 		ReadTimeout:  30 * time.Second,
-		Handler:      http.HandlerFunc(redirect),
+		Handler:      handler,
 	}
 	go srv.ListenAndServe()
 	defer func() {
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/conninfo"
+	"github.com/mikumaycry/akari/internal/pkg/ratelimit"
+	"github.com/mikumaycry/akari/internal/pkg/traffic"
+)
+
+func TestRedirectTarget(t *testing.T) {
+	r := newRouter()
+	for _, cfg := range []config.ServerConf{
+		{SNI: "www.example.com", Mode: "https"},
+		{SNI: "*.example.net", Mode: "https"},
+		{SNI: "tcp.example.com", Mode: "tcp"},
+		{SNI: "*", Mode: "https"},
+	} {
+		if err := r.add(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		target string
+		host   string
+		port   string
+		want   string
+	}{
+		{"exact", "/a?b=c", "www.example.com", "443", "https://www.example.com/a?b=c"},
+		{"host with port", "/a", "www.example.com:8080", "443", "https://www.example.com/a"},
+		{"host with port to https port", "/a", "WWW.example.com:8080", "8443", "https://www.example.com:8443/a"},
+		{"wildcard", "/", "a.example.net", "443", "https://a.example.net/"},
+		{"tcp route", "/", "tcp.example.com", "443", ""},
+		{"default route", "/", "evil.example.org", "443", ""},
+		{"default route with port", "/", "evil.example.org:80", "443", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		req.Host = tt.host
+		got, ok := redirectTarget(r, req, tt.port)
+		if got != tt.want || ok != (len(tt.want) != 0) {
+			t.Errorf("%s: redirectTarget = %q, %v, want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestSetLimitQuota(t *testing.T) {
+	meter, err := traffic.New("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{traffic: meter, limits: ratelimit.NewRegistry()}
+	cfg := &config.ServerConf{SNI: "a.test", Quota: &config.QuotaConf{Daily: 10}}
+	info := &conninfo.Info{Route: "a.test"}
+	s.setLimit(cfg, info)
+	info.SetUser("u1")
+	if err := info.Allow(); err != nil {
+		t.Fatalf("Allow() before traffic error = %v", err)
+	}
+	conn := s.wrapConn(&discardConn{}, cfg, info)
+	conn.Write(make([]byte, 10))
+	if err := info.Allow(); err == nil {
+		t.Error("Allow() after quota succeeded")
+	}
+	// quota is per user
+	other := &conninfo.Info{Route: "a.test"}
+	s.setLimit(cfg, other)
+	other.SetUser("u2")
+	if err := other.Allow(); err != nil {
+		t.Errorf("Allow() of other user error = %v", err)
+	}
+}
+
+// discardConn discards writes
+type discardConn struct {
+	net.Conn
+}
+
+func (c *discardConn) Write(b []byte) (int, error) { return len(b), nil }
@@ -1,30 +1,247 @@
 package server
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 
 	"github.com/mikumaycry/akari/internal/config"
+	"github.com/mikumaycry/akari/internal/pkg/acl"
+	"github.com/mikumaycry/akari/internal/pkg/auth"
+	"github.com/mikumaycry/akari/internal/pkg/balancer"
+	"github.com/mikumaycry/akari/internal/pkg/cert"
+	"github.com/mikumaycry/akari/internal/pkg/outbound"
+	"github.com/mikumaycry/akari/internal/pkg/resolver"
+	"github.com/mikumaycry/akari/internal/pkg/rules"
 	"github.com/pkg/errors"
 )
 
-func loadServerConf(confDir string) (map[string]config.ServerConf, error) {
-	m := make(map[string]config.ServerConf)
+// rulesExt is extension of rule list files in conf dir
+const rulesExt = ".rules"
+
+// confErrors collects errors of every conf file
+type confErrors []error
+
+func (e confErrors) Error() string {
+	s := make([]string, 0, len(e))
+	for _, v := range e {
+		s = append(s, v.Error())
+	}
+	return strings.Join(s, "; ")
+}
+
+func loadServerConf(confDir string, fallback *config.ServerConf, certs *cert.Store, dialers map[string]outbound.Dialer, res *resolver.Resolver) (*router, error) {
+	r := newRouter()
 	fileInfo, err := ioutil.ReadDir(confDir)
 	if err != nil {
 		return nil, errors.Wrap(err, "ioutil.ReadDir")
 	}
+	var errs confErrors
 	for _, file := range fileInfo {
-		data, err := ioutil.ReadFile(filepath.Join(confDir, file.Name()))
+		// rule lists share conf dir and are loaded by routes referencing them
+		if file.IsDir() || strings.HasSuffix(file.Name(), rulesExt) {
+			continue
+		}
+		if err := loadServerConfFile(r, filepath.Join(confDir, file.Name())); err != nil {
+			errs = append(errs, errors.Wrap(err, file.Name()))
+		}
+	}
+	errs = append(errs, r.overlaps()...)
+	if fallback != nil {
+		item := *fallback
+		if len(item.SNI) == 0 {
+			item.SNI = "fallback"
+		}
+		if err := r.addDefault(item); err != nil {
+			errs = append(errs, errors.Wrap(err, "router.addDefault: fallback"))
+		}
+	}
+	lists := make(map[string]*rules.List)
+	r.each(func(cfg *config.ServerConf) {
+		if len(cfg.Cert) != 0 && !certs.Has(cfg.Cert) {
+			errs = append(errs, errors.Errorf("%s: cert not found: %s", cfg.SNI, cfg.Cert))
+		}
+		if err := loadCredentials(cfg); err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s: loadCredentials", cfg.SNI))
+		}
+		if err := loadPolicy(cfg, res); err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s: loadPolicy", cfg.SNI))
+		}
+		if err := loadDialer(cfg, dialers); err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s: loadDialer", cfg.SNI))
+		}
+		if err := loadRouter(cfg, confDir, dialers, lists); err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s: loadRouter", cfg.SNI))
+		}
+		if err := loadBalancer(cfg); err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s: loadBalancer", cfg.SNI))
+		}
+		if len(cfg.ClientCA) == 0 {
+			return
+		}
+		if cfg.Mode == "passthrough" {
+			errs = append(errs, errors.Errorf("%s: clientCA is not supported by passthrough mode", cfg.SNI))
+			return
+		}
+		if _, ok := r.clientCAs[cfg.ClientCA]; ok {
+			return
+		}
+		pool, err := loadCertPool(cfg.ClientCA)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s: loadCertPool", cfg.SNI))
+			return
+		}
+		r.clientCAs[cfg.ClientCA] = pool
+	})
+	if len(errs) != 0 {
+		r.close()
+		return nil, errs
+	}
+	return r, nil
+}
+
+func loadServerConfFile(r *router, name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return errors.Wrap(err, "ioutil.ReadFile")
+	}
+	var item config.ServerConf
+	if err := json.Unmarshal(data, &item); err != nil {
+		return errors.Wrap(err, "json.Unmarshal")
+	}
+	if err := r.add(item); err != nil {
+		return errors.Wrap(err, "router.add")
+	}
+	return nil
+}
+
+// loadCredentials builds users of cfg and its ALPN sub confs
+func loadCredentials(cfg *config.ServerConf) error {
+	entries := cfg.Users
+	if len(cfg.Auth) != 0 {
+		entries = append([]string{cfg.Auth}, entries...)
+	}
+	users, err := auth.New(entries, cfg.HTPasswd)
+	if err != nil {
+		return errors.Wrap(err, "auth.New")
+	}
+	cfg.Credentials = users
+	for i := range cfg.ALPN {
+		if err := loadCredentials(&cfg.ALPN[i].ServerConf); err != nil {
+			return errors.Wrapf(err, "alpn protocol %s", cfg.ALPN[i].Protocol)
+		}
+	}
+	return nil
+}
+
+// loadPolicy builds destination policy of cfg and its ALPN sub confs
+func loadPolicy(cfg *config.ServerConf, res *resolver.Resolver) error {
+	prefer, err := resolver.ParsePreference(cfg.IPPreference)
+	if err != nil {
+		return errors.Wrap(err, "resolver.ParsePreference")
+	}
+	policy, err := acl.New(cfg.ACL, res, prefer)
+	if err != nil {
+		return errors.Wrap(err, "acl.New")
+	}
+	cfg.Policy = policy
+	for i := range cfg.ALPN {
+		if err := loadPolicy(&cfg.ALPN[i].ServerConf, res); err != nil {
+			return errors.Wrapf(err, "alpn protocol %s", cfg.ALPN[i].Protocol)
+		}
+	}
+	return nil
+}
+
+// loadDialer looks up outbound dialer of cfg and its ALPN sub confs, direct is used by default
+func loadDialer(cfg *config.ServerConf, dialers map[string]outbound.Dialer) error {
+	name := cfg.Outbound
+	if len(name) == 0 {
+		name = "direct"
+	}
+	routeDialers, err := preferDialers(cfg, dialers)
+	if err != nil {
+		return err
+	}
+	dialer, ok := routeDialers[name]
+	if !ok {
+		return errors.Errorf("outbound not found: %s", name)
+	}
+	cfg.Dialer = dialer
+	for i := range cfg.ALPN {
+		if err := loadDialer(&cfg.ALPN[i].ServerConf, dialers); err != nil {
+			return errors.Wrapf(err, "alpn protocol %s", cfg.ALPN[i].Protocol)
+		}
+	}
+	return nil
+}
+
+// preferDialers returns dialers of which direct dials by ipPreference of cfg
+func preferDialers(cfg *config.ServerConf, dialers map[string]outbound.Dialer) (map[string]outbound.Dialer, error) {
+	prefer, err := resolver.ParsePreference(cfg.IPPreference)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolver.ParsePreference")
+	}
+	return outbound.WithPreference(dialers, prefer), nil
+}
+
+// loadRouter builds outbound rules of cfg and its ALPN sub confs, lists caches rule files by name
+func loadRouter(cfg *config.ServerConf, confDir string, dialers map[string]outbound.Dialer, lists map[string]*rules.List) error {
+	if len(cfg.Rules) != 0 {
+		list, ok := lists[cfg.Rules]
+		if !ok {
+			var err error
+			list, err = rules.Load(filepath.Join(confDir, cfg.Rules))
+			if err != nil {
+				return errors.Wrap(err, "rules.Load")
+			}
+			lists[cfg.Rules] = list
+		}
+		routeDialers, err := preferDialers(cfg, dialers)
+		if err != nil {
+			return err
+		}
+		router, err := rules.NewRouter(list, routeDialers)
+		if err != nil {
+			return errors.Wrap(err, "rules.NewRouter")
+		}
+		cfg.Router = router
+	}
+	for i := range cfg.ALPN {
+		if err := loadRouter(&cfg.ALPN[i].ServerConf, confDir, dialers, lists); err != nil {
+			return errors.Wrapf(err, "alpn protocol %s", cfg.ALPN[i].Protocol)
+		}
+	}
+	return nil
+}
+
+// loadBalancer builds balancer of backends of cfg and its ALPN sub confs, health checks start here and stop by router.close
+func loadBalancer(cfg *config.ServerConf) error {
+	if len(cfg.Backends) != 0 {
+		b, err := balancer.New(cfg.SNI, cfg.Backends, cfg.Balance, cfg.HealthCheck, cfg.Dialer)
 		if err != nil {
-			return nil, errors.Wrap(err, "ioutil.ReadFile")
+			return errors.Wrap(err, "balancer.New")
 		}
-		var item config.ServerConf
-		if err := json.Unmarshal(data, &item); err != nil {
-			return nil, errors.Wrap(err, "json.Unmarshal")
+		cfg.Balancer = b
+	}
+	for i := range cfg.ALPN {
+		if err := loadBalancer(&cfg.ALPN[i].ServerConf); err != nil {
+			return errors.Wrapf(err, "alpn protocol %s", cfg.ALPN[i].Protocol)
 		}
-		m[item.SNI] = item
 	}
-	return m, nil
+	return nil
+}
+
+func loadCertPool(name string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadFile")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no cert found: %s", name)
+	}
+	return pool, nil
 }
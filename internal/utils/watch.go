@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// WatchDir calls fn after files under dir change, events within delay are merged into one call
+func WatchDir(dir string, delay time.Duration, done <-chan struct{}, fn func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "fsnotify.NewWatcher")
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return errors.Wrap(err, "watcher.Add")
+	}
+	go func() {
+		defer watcher.Close()
+		timer := time.NewTimer(delay)
+		timer.Stop()
+		for {
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				timer.Reset(delay)
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			case <-timer.C:
+				fn()
+			}
+		}
+	}()
+	return nil
+}